@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// API keys look like sk_<prefix>_<secret>. The prefix identifies the key in
+// listings and logs but is not unique; only a hash of the whole key is
+// stored, and keys are looked up by it.
+const apiKeyTag = "sk"
+
+// how often last_used_at is updated for a key in use
+var apiKeyLastUsedResolution = time.Minute
+
+type apiKey struct {
+	API_Key_ID string `json:"api_key_id"`
+	Name       string `json:"name"`
+	Prefix     string `json:"prefix"`
+	// personal keys act on behalf of User_ID, service keys of no one
+	Type    string `json:"type"`
+	User_ID string `json:"user_id,omitempty"`
+	// keys bound to a workspace cannot be used in any other
+	Workspace_ID string     `json:"workspace_id,omitempty"`
+	Scopes       []string   `json:"scopes"`
+	Created_At   time.Time  `json:"created_at"`
+	Expires_At   *time.Time `json:"expires_at,omitempty"`
+	Revoked_At   *time.Time `json:"revoked_at,omitempty"`
+	Last_Used_At *time.Time `json:"last_used_at,omitempty"`
+	// the key itself, only returned when it is created
+	Key string `json:"key,omitempty"`
+
+	hash string
+}
+
+type apiKeyInput struct {
+	Name         string     `json:"name"`
+	User_ID      string     `json:"user_id"`
+	Workspace_ID string     `json:"workspace_id"`
+	Scopes       []string   `json:"scopes"`
+	Expires_At   *time.Time `json:"expires_at"`
+}
+
+var errAPIKeyNotFound = notFoundError("api_key_not_found", "API key not found")
+
+const apiKeyColumns = "api_key_id, prefix, key_hash, name, user_id, workspace_id, scopes, created_at, expires_at, revoked_at, last_used_at"
+
+func (in apiKeyInput) validate() validationErrors {
+	var errs validationErrors
+	errs.required("name", in.Name)
+	errs.maxLength("name", in.Name, 255)
+	if in.User_ID != "" && !isValidUUID(in.User_ID) {
+		errs.add("user_id", "must be a UUID")
+	}
+	if in.Workspace_ID != "" && !isValidUUID(in.Workspace_ID) {
+		errs.add("workspace_id", "must be a UUID")
+	}
+	if len(in.Scopes) == 0 {
+		errs.add("scopes", "is required")
+	}
+	for _, s := range in.Scopes {
+		if !containsString(allScopes, s) {
+			errs.add("scopes", fmt.Sprintf("unknown scope %q, must be one of %s", s, strings.Join(allScopes, ", ")))
+		}
+	}
+	if in.Expires_At != nil && !in.Expires_At.After(time.Now()) {
+		errs.add("expires_at", "must be in the future")
+	}
+	return errs
+}
+
+// newAPIKey generates a key for in. The secret is only available in Key
+// until the apiKey is discarded.
+func newAPIKey(in apiKeyInput) (*apiKey, error) {
+	prefix := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	k := &apiKey{
+		Name:         in.Name,
+		Prefix:       hex.EncodeToString(prefix),
+		User_ID:      in.User_ID,
+		Workspace_ID: in.Workspace_ID,
+		Scopes:       in.Scopes,
+		Expires_At:   in.Expires_At,
+	}
+	k.Key = apiKeyTag + "_" + k.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	k.hash = hashToken(k.Key)
+	k.setType()
+	return k, nil
+}
+
+// hashToken is how API keys and session tokens are stored. They are long
+// and random, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyPrefix extracts the prefix of a key, or returns false if key is not
+// shaped like one.
+func apiKeyPrefix(key string) (string, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyTag || len(parts[1]) != 8 || parts[2] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func (k *apiKey) setType() {
+	if k.User_ID != "" {
+		k.Type = "personal"
+	} else {
+		k.Type = "service"
+	}
+}
+
+// active reports whether the key can be used at now.
+func (k *apiKey) active(now time.Time) bool {
+	return k.Revoked_At == nil && (k.Expires_At == nil || now.Before(*k.Expires_At))
+}
+
+func (k *apiKey) principal() *principal {
+	p := &principal{name: "api-key:" + k.Prefix, apiKey: k, scopes: k.Scopes, workspaceId: k.Workspace_ID}
+	if k.User_ID != "" {
+		p.name = k.User_ID
+		p.userId = k.User_ID
+	}
+	return p
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (k *apiKey) scan(row rowScanner) error {
+	var userId, workspaceId sql.NullString
+	var expiresAt, revokedAt, lastUsedAt sql.NullTime
+	err := row.Scan(&k.API_Key_ID, &k.Prefix, &k.hash, &k.Name, &userId, &workspaceId, pq.Array(&k.Scopes),
+		&k.Created_At, &expiresAt, &revokedAt, &lastUsedAt)
+	if err != nil {
+		return err
+	}
+	k.User_ID = userId.String
+	k.Workspace_ID = workspaceId.String
+	k.Expires_At = nullTime(expiresAt)
+	k.Revoked_At = nullTime(revokedAt)
+	k.Last_Used_At = nullTime(lastUsedAt)
+	k.setType()
+	return nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func (k *apiKey) createAPIKey(ctx context.Context, db queryer) error {
+	userId := sql.NullString{String: k.User_ID, Valid: k.User_ID != ""}
+	workspaceId := sql.NullString{String: k.Workspace_ID, Valid: k.Workspace_ID != ""}
+	err := db.QueryRowContext(ctx,
+		`INSERT INTO api_keys(prefix, key_hash, name, user_id, workspace_id, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING api_key_id, created_at`,
+		k.Prefix, k.hash, k.Name, userId, workspaceId, pq.Array(k.Scopes), k.Expires_At,
+	).Scan(&k.API_Key_ID, &k.Created_At)
+	return dbError(err)
+}
+
+// API keys are managed by whom they act for: users see their personal keys,
+// anonymous requests and service keys the service keys. Both only see the
+// keys usable in the workspace of ctx, where keys bound to no workspace
+// count as keys of the default workspace.
+const apiKeyOwned = "user_id IS NOT DISTINCT FROM $1 AND COALESCE(workspace_id, $2) = $3"
+
+func apiKeyOwner(ctx context.Context) []interface{} {
+	userId := principalFrom(ctx).userId
+	return []interface{}{sql.NullString{String: userId, Valid: userId != ""}, defaultWorkspaceId, workspaceFrom(ctx).id}
+}
+
+func (k *apiKey) getAPIKey(ctx context.Context, db queryer) error {
+	err := k.scan(db.QueryRowContext(ctx,
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE api_key_id=$4 AND "+apiKeyOwned,
+		append(apiKeyOwner(ctx), k.API_Key_ID)...,
+	))
+	if err == sql.ErrNoRows {
+		return errAPIKeyNotFound
+	}
+	return err
+}
+
+// revokeAPIKey makes the key unusable. Revoking a key again keeps the time
+// of the first revocation.
+func (k *apiKey) revokeAPIKey(ctx context.Context, db queryer) error {
+	err := k.scan(db.QueryRowContext(ctx,
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, now()) WHERE api_key_id=$4 AND "+apiKeyOwned+" RETURNING "+apiKeyColumns,
+		append(apiKeyOwner(ctx), k.API_Key_ID)...,
+	))
+	if err == sql.ErrNoRows {
+		return errAPIKeyNotFound
+	}
+	return err
+}
+
+func getAPIKeys(ctx context.Context, db queryer) ([]apiKey, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE "+apiKeyOwned+" ORDER BY created_at", apiKeyOwner(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []apiKey{}
+	for rows.Next() {
+		var k apiKey
+		if err := k.scan(rows); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// authenticateAPIKey looks up the active key matching key.
+func authenticateAPIKey(ctx context.Context, db queryer, key string) (*apiKey, error) {
+	if _, ok := apiKeyPrefix(key); !ok {
+		return nil, errInvalidCredentials
+	}
+
+	k := &apiKey{}
+	err := k.scan(db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash=$1", hashToken(key)))
+	if err == sql.ErrNoRows {
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !k.active(time.Now()) {
+		return nil, errInvalidCredentials
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE api_keys SET last_used_at = now() WHERE api_key_id=$1 AND (last_used_at IS NULL OR last_used_at < $2)",
+		k.API_Key_ID, time.Now().Add(-apiKeyLastUsedResolution),
+	)
+	return k, err
+}
+
+func pathAPIKeyId(req *http.Request) (string, error) {
+	id := mux.Vars(req)["api_key_id"]
+	if !isValidUUID(id) {
+		return "", badRequestError("invalid_api_key_id", "Invalid API key ID")
+	}
+	return id, nil
+}
+
+func (a *App) getAPIKeys(w http.ResponseWriter, req *http.Request) {
+	keys, err := getAPIKeys(req.Context(), a.DB)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (a *App) getAPIKey(w http.ResponseWriter, req *http.Request) {
+	id, err := pathAPIKeyId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	k := apiKey{API_Key_ID: id}
+	if err := k.getAPIKey(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, k)
+}
+
+// createAPIKey issues a new key. Callers can only grant scopes they hold
+// themselves, and keys bound to a workspace only create keys bound to it.
+// Users only create personal keys for themselves, everyone else only
+// service keys, so no key can do more than the one it was created with.
+func (a *App) createAPIKey(w http.ResponseWriter, req *http.Request) {
+	var in apiKeyInput
+	if err := decodeJSONBody(w, req, &in); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := in.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+	ctx := req.Context()
+	p := principalFrom(ctx)
+	if in.User_ID != "" && in.User_ID != p.userId {
+		respondWithProblem(w, req, forbiddenError("user_not_allowed", "Personal API keys can only be created by their user"))
+		return
+	}
+	in.User_ID = p.userId
+	if in.Workspace_ID == "" {
+		in.Workspace_ID = p.workspaceId
+	}
+	if in.Workspace_ID != "" {
+		id, _ := parseWorkspaceId(in.Workspace_ID)
+		if _, err := accessWorkspace(ctx, a.DB, p, id); err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+		in.Workspace_ID = id
+	}
+	for _, s := range in.Scopes {
+		if !p.hasScope(s) {
+			respondWithProblem(w, req, forbiddenError("scope_not_held", fmt.Sprintf("Cannot grant the %s scope without holding it", s)))
+			return
+		}
+	}
+
+	k, err := newAPIKey(in)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if err := k.createAPIKey(ctx, a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, k)
+}
+
+func (a *App) revokeAPIKey(w http.ResponseWriter, req *http.Request) {
+	id, err := pathAPIKeyId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	k := apiKey{API_Key_ID: id}
+	if err := k.revokeAPIKey(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, k)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func useAnonymousScopes(t *testing.T, scopes ...string) {
+	previous := a.Config.Auth.AnonymousScopes
+	a.Config.Auth.AnonymousScopes = scopes
+	t.Cleanup(func() { a.Config.Auth.AnonymousScopes = previous })
+}
+
+func TestAPIKeyPrefix(t *testing.T) {
+	k, err := newAPIKey(apiKeyInput{Name: "CI", Scopes: []string{scopeTasksRead}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix, ok := apiKeyPrefix(k.Key); !ok || prefix != k.Prefix {
+		t.Errorf("Expected prefix %s in %s. Got %q", k.Prefix, k.Key, prefix)
+	}
+	for _, key := range []string{"", "sk_", "sk_abc_secret", "pk_1a2b3c4d_secret", "sk_1a2b3c4d_"} {
+		if _, ok := apiKeyPrefix(key); ok {
+			t.Errorf("Expected %q not to be accepted as a key", key)
+		}
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t)
+	key := addAPIKey("", scopeCategoriesRead)
+
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	if response.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a WWW-Authenticate header")
+	}
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("X-API-Key", key)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/category", bytes.NewBufferString(`{"name":"Denied"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "insufficient_scope" {
+		t.Errorf("Expected code 'insufficient_scope'. Got '%v'", p.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Authorization", "Bearer "+key[:len(key)-1]+"x")
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+}
+
+func TestAPIKeysSharingAPrefix(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t)
+	var keys []string
+	for _, name := range []string{"First", "Second"} {
+		k, _ := newAPIKey(apiKeyInput{Name: name, Scopes: []string{scopeCategoriesRead}})
+		k.Prefix = "0badcafe"
+		k.Key = apiKeyTag + "_" + k.Prefix + k.Key[len(apiKeyTag)+9:]
+		k.hash = hashToken(k.Key)
+		if err := k.createAPIKey(context.Background(), a.DB); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k.Key)
+	}
+
+	for _, key := range keys {
+		req, _ := http.NewRequest("GET", "/categories", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+}
+
+func TestInvalidAPIKeyOnAnonymousRoute(t *testing.T) {
+	clearTables()
+
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Authorization", "Bearer sk_00000000_nope")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "invalid_credentials" {
+		t.Errorf("Expected code 'invalid_credentials'. Got '%v'", p.Code)
+	}
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	clearTables()
+	admin := addAPIKey("", scopeAPIKeysRead, scopeAPIKeysWrite, scopeCategoriesRead)
+
+	req, _ := http.NewRequest("POST", "/api-keys", bytes.NewBufferString(`{"name":"Reporting","scopes":["categories:read"]}`))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var created apiKey
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if created.Type != "service" || !strings.HasPrefix(created.Key, "sk_"+created.Prefix+"_") {
+		t.Errorf("Expected a service key starting with its prefix. Got %+v", created)
+	}
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/api-keys/"+created.API_Key_ID, nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if strings.Contains(response.Body.String(), created.Key) {
+		t.Errorf("Expected the key not to be shown again")
+	}
+
+	req, _ = http.NewRequest("POST", "/api-keys", bytes.NewBufferString(`{"name":"Escalation","scopes":["admin"]}`))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/api-keys", bytes.NewBufferString(`{"name":"","scopes":["everything"]}`))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+}
+
+func TestPersonalAPIKey(t *testing.T) {
+	clearTables()
+	u := user{Email: "ada@example.com", Name: "Ada"}
+	if err := u.createUser(context.Background(), a.DB); err != nil {
+		t.Fatal(err)
+	}
+	key := addAPIKey(u.User_ID, scopeCategoriesRead)
+	buf := captureRequestLog(t)
+
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	if !strings.Contains(buf.String(), `"user":"`+u.User_ID+`"`) {
+		t.Errorf("Expected the request to be logged for user %s. Got %s", u.User_ID, buf.String())
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	clearTables()
+	admin := addAPIKey("", scopeAPIKeysWrite)
+	k, _ := newAPIKey(apiKeyInput{Name: "Leaked", Scopes: []string{scopeCategoriesRead}})
+	k.createAPIKey(context.Background(), a.DB)
+
+	req, _ := http.NewRequest("DELETE", "/api-keys/"+k.API_Key_ID, nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var revoked apiKey
+	json.Unmarshal(response.Body.Bytes(), &revoked)
+	if revoked.Revoked_At == nil {
+		t.Errorf("Expected revoked_at to be set")
+	}
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Authorization", "Bearer "+k.Key)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("DELETE", "/api-keys/"+uuid.New().String(), nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+func TestPersonalAPIKeysCreateOnlyPersonalKeys(t *testing.T) {
+	clearTables()
+	adaId, _ := addSession(t, "ada@example.com")
+	graceId, _ := addSession(t, "grace@example.com")
+	ada := addAPIKey(adaId, scopeAPIKeysWrite, scopeCategoriesRead)
+
+	for _, body := range []string{
+		`{"name":"Impersonation","user_id":"` + graceId + `","scopes":["categories:read"]}`,
+		`{"name":"Elsewhere","workspace_id":"` + addWorkspace(t, "Not Ada's") + `","scopes":["categories:read"]}`,
+		`{"name":"Escalation","scopes":["categories:write"]}`,
+	} {
+		req, _ := http.NewRequest("POST", "/api-keys", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+ada)
+		response := executeRequest(req)
+		if response.Code != http.StatusForbidden && response.Code != http.StatusNotFound {
+			t.Errorf("Expected %s to be rejected. Got status %d", body, response.Code)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "/api-keys", bytes.NewBufferString(`{"name":"CLI","scopes":["categories:read"]}`))
+	req.Header.Set("Authorization", "Bearer "+ada)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var created apiKey
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if created.Type != "personal" || created.User_ID != adaId {
+		t.Errorf("Expected a personal key of %s. Got %+v", adaId, created)
+	}
+
+	req, _ = http.NewRequest("POST", "/api-keys", bytes.NewBufferString(`{"name":"Impersonation","user_id":"`+adaId+`","scopes":["api_keys:write"]}`))
+	req.Header.Set("Authorization", "Bearer "+addAPIKey("", scopeAPIKeysWrite))
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+}
+
+func TestAPIKeysAreScopedToOwner(t *testing.T) {
+	clearTables()
+	adaId, _ := addSession(t, "ada@example.com")
+	graceId, _ := addSession(t, "grace@example.com")
+	ada := addAPIKey(adaId, scopeAPIKeysRead, scopeAPIKeysWrite)
+	grace := addAPIKey(graceId, scopeAPIKeysRead, scopeAPIKeysWrite)
+	service := addAPIKey("", scopeAPIKeysRead, scopeAPIKeysWrite)
+	elsewhere := addWorkspaceAPIKey(t, addWorkspace(t, "Elsewhere"), scopeAPIKeysRead, scopeAPIKeysWrite)
+
+	keys := map[string]apiKey{}
+	for name, key := range map[string]string{"ada": ada, "grace": grace, "service": service, "elsewhere": elsewhere} {
+		req, _ := http.NewRequest("GET", "/api-keys", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		var listed []apiKey
+		json.Unmarshal(response.Body.Bytes(), &listed)
+		if len(listed) != 1 {
+			t.Fatalf("Expected %s to only see its own key. Got %+v", name, listed)
+		}
+		keys[name] = listed[0]
+	}
+
+	for _, other := range []string{"grace", "service", "elsewhere"} {
+		req, _ := http.NewRequest("GET", "/api-keys/"+keys[other].API_Key_ID, nil)
+		req.Header.Set("Authorization", "Bearer "+ada)
+		checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+		req, _ = http.NewRequest("DELETE", "/api-keys/"+keys[other].API_Key_ID, nil)
+		req.Header.Set("Authorization", "Bearer "+ada)
+		checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	}
+
+	req, _ := http.NewRequest("DELETE", "/api-keys/"+keys["elsewhere"].API_Key_ID, nil)
+	req.Header.Set("Authorization", "Bearer "+service)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	// not revoked by anyone else
+	req, _ = http.NewRequest("GET", "/api-keys", nil)
+	req.Header.Set("Authorization", "Bearer "+elsewhere)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+}
+
+func TestExpiredAPIKey(t *testing.T) {
+	clearTables()
+	key := addAPIKey("", scopeCategoriesRead)
+	prefix, _ := apiKeyPrefix(key)
+	a.DB.Exec("UPDATE api_keys SET expires_at = now() - interval '1 minute' WHERE prefix=$1", prefix)
+
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+}
+
+// TestRoutesRequireDocumentedScopes checks every operation against the scope
+// openapi.json says it requires. Public operations have an empty security.
+func TestRoutesRequireDocumentedScopes(t *testing.T) {
+	spec := loadSpec(t)
+	paths := spec["paths"].(map[string]interface{})
+	url := strings.NewReplacer(
+		"{category_id}", uuid.New().String(),
+		"{task_id}", "1",
+		"{api_key_id}", uuid.New().String(),
+		"{group}", "engineering",
+		"{workspace_id}", uuid.New().String(),
+		"{user_id}", uuid.New().String(),
+		"{webhook_id}", uuid.New().String(),
+		"{delivery_id}", uuid.New().String(),
+		"{reminder_id}", uuid.New().String(),
+		"{notification_id}", uuid.New().String(),
+		"{frequency}", digestDaily,
+	)
+
+	for path, item := range paths {
+		for method, op := range item.(map[string]interface{}) {
+			if method == "parameters" {
+				continue
+			}
+			if security, ok := op.(map[string]interface{})["security"].([]interface{}); ok && len(security) == 0 {
+				continue
+			}
+			scope, _ := op.(map[string]interface{})["x-required-scope"].(string)
+			if !containsString(allScopes, scope) {
+				t.Errorf("%s %s: unknown x-required-scope %q", strings.ToUpper(method), path, scope)
+				continue
+			}
+
+			var others []string
+			for _, s := range allScopes {
+				if s != scope {
+					others = append(others, s)
+				}
+			}
+			useAnonymousScopes(t, others...)
+			req, _ := http.NewRequest(strings.ToUpper(method), url.Replace(path), nil)
+			if response := executeRequest(req); response.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s: expected the %s scope to be required. Got status %d", strings.ToUpper(method), path, scope, response.Code)
+			}
+		}
+	}
+}
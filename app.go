@@ -2,77 +2,196 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"os"
-	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type App struct {
 	Router *mux.Router
 	DB     *sql.DB
+	Config Config
+
+	workers workerGroup
+	metrics *metrics
+	tracer  *tracer
+	logger  *logger
+	// buckets of rateLimited and the proxies trusted to name the client
+	rateLimits     rateLimitStore
+	trustedProxies []*net.IPNet
+	// nil unless single sign-on is configured
+	oidc     *oidcProvider
+	webhooks *webhookSender
+	// events reach the handlers subscribed to the bus through the outbox
+	events *eventBus
+	outbox *outboxRelay
+	// nil unless events are published to NATS
+	nats      *natsConn
+	reminders *reminderScheduler
+	digests   *digestSender
+	mail      *mailSender
+	// set to 1 once shutdown starts, see drain
+	draining int32
 }
 
 var uuidPattern string = "[0-9a-f-]+"
 
-func (a *App) Initialize(host, port, user, dbname string) {
-	connectionString := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable", host, port, user, dbname)
+func (a *App) Initialize(cfg Config) {
+	a.Config = cfg
 
-	var err error
-	a.DB, err = sql.Open("postgres", connectionString)
+	a.logger = rootLogger
+	if level, err := parseLogLevel(cfg.Log.Level); err == nil {
+		a.logger.setLevel(level)
+	}
+
+	a.metrics = newMetrics()
+	a.tracer = &tracer{sampleRatio: cfg.Tracing.SampleRatio}
+	if cfg.Tracing.Endpoint != "" {
+		a.tracer.exporter = newSpanExporter(cfg.Tracing.Endpoint, cfg.Tracing.ServiceName)
+	}
+
+	connector, err := pq.NewConnector(cfg.Database.connectionString())
 	if err != nil {
 		log.Fatal(err)
 	}
+	a.DB = sql.OpenDB(instrumentedConnector{
+		Connector:    connector,
+		metrics:      a.metrics,
+		tracer:       a.tracer,
+		queryTimeout: cfg.Database.QueryTimeout,
+	})
+	a.DB.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	a.DB.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	a.DB.SetConnMaxLifetime(cfg.Database.ConnMaxLifetime)
+	a.DB.SetConnMaxIdleTime(cfg.Database.ConnMaxIdleTime)
+	a.metrics.registerDBStats(a.DB.Stats)
+
+	if cfg.OIDC.Issuer != "" {
+		a.oidc = newOIDCProvider(cfg.OIDC)
+	}
+
+	a.webhooks = newWebhookSender(a.DB, cfg.Webhooks, a.metrics)
+	a.events = &eventBus{}
+	sinks := []eventSink{a.events, webhookSink{db: a.DB}}
+	if cfg.Outbox.NATSURL != "" {
+		if a.nats, err = newNATSConn(cfg.Outbox.NATSURL); err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, natsSink{conn: a.nats, prefix: cfg.Outbox.NATSSubjectPrefix})
+	}
+	a.outbox = newOutboxRelay(a.DB, cfg.Outbox, a.metrics, sinks...)
+	a.reminders = newReminderScheduler(a.DB, a.metrics, inboxChannel{}, emailChannel{}, webhookChannel{})
+	a.digests = newDigestSender(a.DB, a.metrics)
+	a.mail = newMailSender(a.DB, cfg.Mail, a.metrics)
+
+	a.trustedProxies, _ = cfg.RateLimit.trustedNetworks()
+	if cfg.RateLimit.Store == "postgres" {
+		a.rateLimits = &postgresRateLimitStore{db: a.DB}
+	} else {
+		a.rateLimits = newMemoryRateLimitStore()
+	}
 
 	a.Router = mux.NewRouter()
+	a.Router.Use(a.traceRequests, a.logRequests, a.instrument, a.cors, a.authenticate, a.rateLimited, a.limitRequestTime, a.selectWorkspace)
 
 	a.initializeRoutes()
 }
 
 func (a *App) initializeRoutes() {
 	// categories
-	a.Router.HandleFunc("/categories", a.getCategories).Methods("GET")
-	a.Router.HandleFunc("/category", a.createCategory).Methods("POST")
-	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}", uuidPattern), a.getCategory).Methods("GET")
-	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}", uuidPattern), a.updateCategory).Methods("PUT")
-	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}", uuidPattern), a.deleteCategory).Methods("DELETE")
+	a.Router.HandleFunc("/categories", requireScope(scopeCategoriesRead, a.getCategories)).Methods("GET")
+	a.Router.HandleFunc("/category", requireScope(scopeCategoriesWrite, a.idempotent(a.createCategory))).Methods("POST")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}", uuidPattern), requireScope(scopeCategoriesRead, a.requireCategoryRole(roleViewer, a.getCategory))).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}", uuidPattern), requireScope(scopeCategoriesWrite, a.requireCategoryRole(roleEditor, a.updateCategory))).Methods("PUT")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}", uuidPattern), requireScope(scopeCategoriesWrite, a.requireCategoryRole(roleOwner, a.deleteCategory))).Methods("DELETE")
 
-	// tasks
-	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/tasks", uuidPattern), a.getTasks).Methods("GET")
-	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task", uuidPattern), a.createTask).Methods("POST")
-	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task/{task_id:[0-9]+}", uuidPattern), a.getTask).Methods("GET")
-	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task/{task_id:[0-9]+}", uuidPattern), a.updateTask).Methods("PUT")
-	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task/{task_id:[0-9]+}", uuidPattern), a.deleteTask).Methods("DELETE")
-}
+	// sharing with identity provider groups
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/group-roles", uuidPattern), requireScope(scopeCategoriesRead, a.requireCategoryRole(roleOwner, a.getGroupRoles))).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/group-roles/{group}", uuidPattern), requireScope(scopeCategoriesWrite, a.requireCategoryRole(roleOwner, a.setGroupRole))).Methods("PUT")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/group-roles/{group}", uuidPattern), requireScope(scopeCategoriesWrite, a.requireCategoryRole(roleOwner, a.deleteGroupRole))).Methods("DELETE")
 
-func (a *App) Run(port string) {
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), a.Router))
+	// tasks
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/tasks", uuidPattern), requireScope(scopeTasksRead, a.requireCategoryRole(roleViewer, a.getTasks))).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/tasks:batch", uuidPattern), requireScope(scopeTasksWrite, a.requireCategoryRole(roleEditor, a.idempotent(a.batchTasks)))).Methods("POST")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task", uuidPattern), requireScope(scopeTasksWrite, a.requireCategoryRole(roleEditor, a.idempotent(a.createTask)))).Methods("POST")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task/{task_id:[0-9]+}", uuidPattern), requireScope(scopeTasksRead, a.requireCategoryRole(roleViewer, a.getTask))).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task/{task_id:[0-9]+}", uuidPattern), requireScope(scopeTasksWrite, a.requireCategoryRole(roleEditor, a.updateTask))).Methods("PUT")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task/{task_id:[0-9]+}", uuidPattern), requireScope(scopeTasksWrite, a.requireCategoryRole(roleEditor, a.deleteTask))).Methods("DELETE")
+
+	// reminders are personal, so viewers may set them too
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task/{task_id:[0-9]+}/reminders", uuidPattern), requireScope(scopeTasksRead, a.requireCategoryRole(roleViewer, a.getReminders))).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task/{task_id:[0-9]+}/reminders", uuidPattern), requireScope(scopeTasksWrite, a.requireCategoryRole(roleViewer, a.idempotent(a.createReminder)))).Methods("POST")
+	a.Router.HandleFunc(fmt.Sprintf("/category/{category_id:%v}/task/{task_id:[0-9]+}/reminders/{reminder_id:%v}", uuidPattern, uuidPattern), requireScope(scopeTasksWrite, a.requireCategoryRole(roleViewer, a.deleteReminder))).Methods("DELETE")
+
+	// the inbox of the user
+	a.Router.HandleFunc("/notifications", requireScope(scopeNotificationsRead, a.getNotifications)).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/notifications/{notification_id:%v}:read", uuidPattern), requireScope(scopeNotificationsWrite, a.idempotent(a.markNotificationRead))).Methods("POST")
+	a.Router.HandleFunc("/digests", requireScope(scopeNotificationsRead, a.getDigestSubscriptions)).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/digests/{frequency:%v}", strings.Join(digestFrequencies, "|")), requireScope(scopeNotificationsWrite, a.subscribeDigest)).Methods("PUT")
+	a.Router.HandleFunc(fmt.Sprintf("/digests/{frequency:%v}", strings.Join(digestFrequencies, "|")), requireScope(scopeNotificationsWrite, a.unsubscribeDigest)).Methods("DELETE")
+
+	// workspaces
+	a.Router.HandleFunc("/workspaces", requireScope(scopeWorkspacesRead, a.getWorkspaces)).Methods("GET")
+	a.Router.HandleFunc("/workspaces", requireScope(scopeWorkspacesWrite, a.idempotent(a.createWorkspace))).Methods("POST")
+	a.Router.HandleFunc(fmt.Sprintf("/workspaces/{workspace_id:%v}", uuidPattern), requireScope(scopeWorkspacesRead, a.requireWorkspaceRole(workspaceRoleMember, a.getWorkspace))).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/workspaces/{workspace_id:%v}", uuidPattern), requireScope(scopeWorkspacesWrite, a.requireWorkspaceRole(workspaceRoleAdmin, a.updateWorkspace))).Methods("PUT")
+	a.Router.HandleFunc(fmt.Sprintf("/workspaces/{workspace_id:%v}", uuidPattern), requireScope(scopeWorkspacesWrite, a.requireWorkspaceRole(workspaceRoleAdmin, a.deleteWorkspace))).Methods("DELETE")
+	a.Router.HandleFunc(fmt.Sprintf("/workspaces/{workspace_id:%v}/members", uuidPattern), requireScope(scopeWorkspacesRead, a.requireWorkspaceRole(workspaceRoleMember, a.getWorkspaceMembers))).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/workspaces/{workspace_id:%v}/members/{user_id:%v}", uuidPattern, uuidPattern), requireScope(scopeWorkspacesWrite, a.requireWorkspaceRole(workspaceRoleAdmin, a.setWorkspaceMember))).Methods("PUT")
+	a.Router.HandleFunc(fmt.Sprintf("/workspaces/{workspace_id:%v}/members/{user_id:%v}", uuidPattern, uuidPattern), requireScope(scopeWorkspacesWrite, a.requireWorkspaceRole(workspaceRoleAdmin, a.removeWorkspaceMember))).Methods("DELETE")
+
+	// webhooks see every event of the workspace, so only its admins manage them
+	a.Router.HandleFunc("/webhooks", requireScope(scopeWebhooksRead, requireCurrentWorkspaceRole(workspaceRoleAdmin, a.getWebhooks))).Methods("GET")
+	a.Router.HandleFunc("/webhooks", requireScope(scopeWebhooksWrite, requireCurrentWorkspaceRole(workspaceRoleAdmin, a.idempotent(a.createWebhook)))).Methods("POST")
+	a.Router.HandleFunc(fmt.Sprintf("/webhooks/{webhook_id:%v}", uuidPattern), requireScope(scopeWebhooksRead, requireCurrentWorkspaceRole(workspaceRoleAdmin, a.getWebhook))).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/webhooks/{webhook_id:%v}", uuidPattern), requireScope(scopeWebhooksWrite, requireCurrentWorkspaceRole(workspaceRoleAdmin, a.updateWebhook))).Methods("PUT")
+	a.Router.HandleFunc(fmt.Sprintf("/webhooks/{webhook_id:%v}", uuidPattern), requireScope(scopeWebhooksWrite, requireCurrentWorkspaceRole(workspaceRoleAdmin, a.deleteWebhook))).Methods("DELETE")
+	a.Router.HandleFunc(fmt.Sprintf("/webhooks/{webhook_id:%v}/deliveries", uuidPattern), requireScope(scopeWebhooksRead, requireCurrentWorkspaceRole(workspaceRoleAdmin, a.getWebhookDeliveries))).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/webhooks/{webhook_id:%v}/deliveries/{delivery_id:%v}:redeliver", uuidPattern, uuidPattern), requireScope(scopeWebhooksWrite, requireCurrentWorkspaceRole(workspaceRoleAdmin, a.idempotent(a.redeliverWebhookDelivery)))).Methods("POST")
+
+	// single sign-on
+	a.Router.HandleFunc("/auth/login", a.login).Methods("GET")
+	a.Router.HandleFunc("/auth/callback", a.callback).Methods("GET")
+	a.Router.HandleFunc("/auth/logout", a.logout).Methods("POST")
+
+	// API keys
+	a.Router.HandleFunc("/api-keys", requireScope(scopeAPIKeysRead, a.getAPIKeys)).Methods("GET")
+	a.Router.HandleFunc("/api-keys", requireScope(scopeAPIKeysWrite, a.idempotent(a.createAPIKey))).Methods("POST")
+	a.Router.HandleFunc(fmt.Sprintf("/api-keys/{api_key_id:%v}", uuidPattern), requireScope(scopeAPIKeysRead, a.getAPIKey)).Methods("GET")
+	a.Router.HandleFunc(fmt.Sprintf("/api-keys/{api_key_id:%v}", uuidPattern), requireScope(scopeAPIKeysWrite, a.revokeAPIKey)).Methods("DELETE")
+
+	// probes
+	a.Router.HandleFunc("/healthz", a.getHealthz).Methods("GET")
+	a.Router.HandleFunc("/readyz", a.getReadyz).Methods("GET")
+
+	a.Router.HandleFunc("/metrics", a.getMetrics).Methods("GET")
+	a.Router.HandleFunc("/admin/log-level", a.adminEndpoint(requireScope(scopeAdmin, a.getLogLevel))).Methods("GET")
+	a.Router.HandleFunc("/admin/log-level", a.adminEndpoint(requireScope(scopeAdmin, a.updateLogLevel))).Methods("PUT")
+
+	// documentation
+	a.Router.HandleFunc("/openapi.json", a.getOpenAPISpec).Methods("GET")
+	a.Router.HandleFunc("/docs", a.getDocs).Methods("GET")
+
+	// CORS preflight requests for every route
+	a.Router.Methods("OPTIONS").HandlerFunc(a.preflight)
 }
 
 // categories
 func (a *App) getCategory(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(req)
-	categoryId := vars["category_id"]
-
-	if !isValidUUID(categoryId) {
-		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+	categoryId, err := pathCategoryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
 
 	c := category{Category_ID: categoryId}
-	if err := c.getCategory(a.DB); err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Category not found")
-		default:
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-		}
+	if err := c.getCategory(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
 
@@ -80,36 +199,44 @@ func (a *App) getCategory(w http.ResponseWriter, req *http.Request) {
 }
 
 func (a *App) getCategories(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
-	categories, err := getCategories(a.DB)
+	var categories []category
+	var err error
+	if p := principalFrom(req.Context()); p.userId != "" && workspaceFrom(req.Context()).role != workspaceRoleAdmin {
+		categories, err = getCategoriesSharedWith(req.Context(), a.DB, p.userId)
+	} else {
+		categories, err = getCategories(req.Context(), a.DB)
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithProblem(w, req, err)
 		return
 	}
 	respondWithJSON(w, http.StatusOK, categories)
 }
 
 func (a *App) updateCategory(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(req)
-	// id, err := strconv.Atoi(vars["category_id"])
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Invalid category ID")
-	// 	return
-	// }
-	id := vars["category_id"]
+	id, err := pathCategoryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
 
 	var c category
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&c); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if err := decodeJSONBody(w, req, &c); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := c.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
 		return
 	}
-	defer req.Body.Close()
 	c.Category_ID = id
 
-	if err := c.updateCategory(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	ctx := req.Context()
+	err = inTransaction(ctx, a.DB, func(tx *sql.Tx) error {
+		return c.updateCategory(ctx, tx)
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
 
@@ -117,42 +244,52 @@ func (a *App) updateCategory(w http.ResponseWriter, req *http.Request) {
 }
 
 func (a *App) createCategory(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
 	var c category
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&c); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if err := decodeJSONBody(w, req, &c); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := c.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
 		return
 	}
-	defer req.Body.Close()
 
-	if err := c.createCategory(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	// users own the categories they create
+	ctx := req.Context()
+	err := inTransaction(ctx, a.DB, func(tx *sql.Tx) error {
+		if err := c.createCategory(ctx, tx); err != nil {
+			return err
+		}
+		if p := principalFrom(ctx); p.userId != "" {
+			return shareCategory(ctx, tx, c.Category_ID, p.userId, roleOwner, shareDirect)
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusCreated, c)
 }
 
-// to do: when deleting a category you need to also delete all tasks under that category first
 func (a *App) deleteCategory(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(req)
-	// id, err := strconv.Atoi(vars["category_id"])
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Invalid category ID")
-	// 	return
-	// }
-
-	id := vars["category_id"]
-
-	c := category{Category_ID: id}
-	if err := c.deleteCategoryTasks(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	id, err := pathCategoryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
-	if err := c.deleteCategory(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+
+	ctx := req.Context()
+	c := category{Category_ID: id}
+	err = inTransaction(ctx, a.DB, func(tx *sql.Tx) error {
+		if err := c.deleteCategoryTasks(ctx, tx); err != nil {
+			return err
+		}
+		return c.deleteCategory(ctx, tx)
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
 
@@ -161,24 +298,29 @@ func (a *App) deleteCategory(w http.ResponseWriter, req *http.Request) {
 
 // tasks
 func (a *App) createTask(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(req)
-	id := vars["category_id"]
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Invalid category ID")
-	// 	return
-	// }
+	id, err := pathCategoryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
 
-	t := task{Category_ID: id}
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&t); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	var t task
+	if err := decodeJSONBody(w, req, &t); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := t.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
 		return
 	}
-	defer req.Body.Close()
+	t.Category_ID = id
 
-	if err := t.createTask(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	ctx := req.Context()
+	err = inTransaction(ctx, a.DB, func(tx *sql.Tx) error {
+		return t.createTask(ctx, tx)
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
 
@@ -186,27 +328,15 @@ func (a *App) createTask(w http.ResponseWriter, req *http.Request) {
 }
 
 func (a *App) getTask(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(req)
-	categoryId := vars["category_id"]
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Invalid category ID")
-	// 	return
-	// }
-	taskId, err := strconv.Atoi(vars["task_id"])
+	categoryId, taskId, err := pathTaskIds(req)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid task ID")
+		respondWithProblem(w, req, err)
 		return
 	}
 
 	t := task{Category_ID: categoryId, Task_ID: taskId}
-	if err := t.getTask(a.DB); err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Task not found")
-		default:
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-		}
+	if err := t.getTask(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
 
@@ -214,45 +344,46 @@ func (a *App) getTask(w http.ResponseWriter, req *http.Request) {
 }
 
 func (a *App) getTasks(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(req)
-	// categoryId, err := strconv.Atoi(vars["category_id"])
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Invalid category ID")
-	// 	return
-	// }
-	categoryId := vars["category_id"]
+	categoryId, err := pathCategoryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
 
 	c := category{Category_ID: categoryId}
-	tasks, err := c.getTasks(a.DB)
+	tasks, err := c.getTasks(req.Context(), a.DB)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithProblem(w, req, err)
 		return
 	}
 	respondWithJSON(w, http.StatusOK, tasks)
 }
 
 func (a *App) updateTask(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(req)
-	taskId, err := strconv.Atoi(vars["task_id"])
-
+	categoryId, taskId, err := pathTaskIds(req)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid task ID")
+		respondWithProblem(w, req, err)
 		return
 	}
 
 	var t task
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&t); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if err := decodeJSONBody(w, req, &t); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := t.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
 		return
 	}
-	defer req.Body.Close()
 
 	t.Task_ID = taskId
-	if err := t.updateTask(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	t.Category_ID = categoryId
+	ctx := req.Context()
+	err = inTransaction(ctx, a.DB, func(tx *sql.Tx) error {
+		return t.updateTask(ctx, tx)
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
 
@@ -260,19 +391,58 @@ func (a *App) updateTask(w http.ResponseWriter, req *http.Request) {
 }
 
 func (a *App) deleteTask(w http.ResponseWriter, req *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(req)
-	taskId, err := strconv.Atoi(vars["task_id"])
+	categoryId, taskId, err := pathTaskIds(req)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid task ID")
+		respondWithProblem(w, req, err)
 		return
 	}
 
-	t := task{Task_ID: taskId}
-	if err := t.deleteTask(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	ctx := req.Context()
+	t := task{Category_ID: categoryId, Task_ID: taskId}
+	err = inTransaction(ctx, a.DB, func(tx *sql.Tx) error {
+		return t.deleteTask(ctx, tx)
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
+
+func (a *App) batchTasks(w http.ResponseWriter, req *http.Request) {
+	categoryId, err := pathCategoryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	var b batchRequest
+	if err := decodeJSONBody(w, req, &b); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := b.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+
+	c := category{Category_ID: categoryId}
+	if err := c.getCategory(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	if b.Continue_On_Error {
+		status, res := runBatchContinueOnError(a.DB, req, categoryId, b.Operations)
+		respondWithJSON(w, status, res)
+		return
+	}
+
+	status, res, err := runBatch(a.DB, req, categoryId, b.Operations)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, status, res)
+}
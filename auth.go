@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// scopes an API key can be granted
+const (
+	scopeCategoriesRead  = "categories:read"
+	scopeCategoriesWrite = "categories:write"
+	scopeTasksRead       = "tasks:read"
+	scopeTasksWrite      = "tasks:write"
+	scopeAPIKeysRead     = "api_keys:read"
+	scopeAPIKeysWrite    = "api_keys:write"
+	scopeWorkspacesRead  = "workspaces:read"
+	scopeWorkspacesWrite = "workspaces:write"
+	scopeWebhooksRead    = "webhooks:read"
+	scopeWebhooksWrite   = "webhooks:write"
+	// the inbox of the user
+	scopeNotificationsRead  = "notifications:read"
+	scopeNotificationsWrite = "notifications:write"
+	scopeAdmin              = "admin"
+)
+
+var allScopes = []string{
+	scopeCategoriesRead, scopeCategoriesWrite,
+	scopeTasksRead, scopeTasksWrite,
+	scopeAPIKeysRead, scopeAPIKeysWrite,
+	scopeWorkspacesRead, scopeWorkspacesWrite,
+	scopeWebhooksRead, scopeWebhooksWrite,
+	scopeNotificationsRead, scopeNotificationsWrite,
+	scopeAdmin,
+}
+
+var (
+	errAuthenticationRequired = &appError{Kind: kindUnauthorized, Code: "authentication_required", Message: "Authentication required"}
+	errInvalidCredentials     = &appError{Kind: kindUnauthorized, Code: "invalid_credentials", Message: "Invalid, expired or revoked credentials"}
+)
+
+// principal is who a request is made by and what it may do. Requests
+// without credentials are made by the anonymous principal, whose scopes are
+// configured with auth.anonymous_scopes.
+type principal struct {
+	// user ID or another name for the request log and rate limits, empty
+	// for anonymous requests
+	name string
+	// set when acting for a user, whose category roles then apply as well
+	userId string
+	// set for API keys bound to a workspace
+	workspaceId string
+	apiKey      *apiKey
+	scopes      []string
+}
+
+func (p *principal) anonymous() bool {
+	return p.name == ""
+}
+
+func (p *principal) hasScope(scope string) bool {
+	return containsString(p.scopes, scope)
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the principal of the request, the anonymous one if
+// the authenticate middleware has not run.
+func principalFrom(ctx context.Context) *principal {
+	if p, ok := ctx.Value(principalKey{}).(*principal); ok {
+		return p
+	}
+	return &principal{}
+}
+
+// authenticate resolves the credentials of a request, if any, to its
+// principal. Invalid API keys are rejected even on routes that anonymous
+// requests may use, so clients notice a revoked or mistyped key, and count
+// against the failed attempts of the client. Expired session cookies are
+// ignored, browsers are sent to log in again instead.
+func (a *App) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := &principal{scopes: a.Config.Auth.AnonymousScopes}
+
+		if key := apiKeyFrom(req); key != "" {
+			if a.tooManyAuthFailures(w, req) {
+				respondWithProblem(w, req, errRateLimited)
+				return
+			}
+			k, err := authenticateAPIKey(req.Context(), a.DB, key)
+			if err == errInvalidCredentials {
+				a.recordAuthFailure(req)
+				respondUnauthorized(w, req, err)
+				return
+			}
+			if err != nil {
+				respondWithProblem(w, req, err)
+				return
+			}
+			p = k.principal()
+		} else if cookie, err := req.Cookie(sessionCookie); err == nil {
+			userId, err := sessionUser(req.Context(), a.DB, cookie.Value)
+			if err != nil {
+				respondWithProblem(w, req, err)
+				return
+			}
+			if userId != "" {
+				p = &principal{name: userId, userId: userId, scopes: a.Config.Auth.SessionScopes}
+			}
+		}
+
+		if !p.anonymous() {
+			setRequestUser(req.Context(), p.name)
+		}
+		next.ServeHTTP(w, req.WithContext(withPrincipal(req.Context(), p)))
+	})
+}
+
+// requireScope only lets requests through whose principal holds scope.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		p := principalFrom(req.Context())
+		if p.hasScope(scope) {
+			next(w, req)
+			return
+		}
+		if p.anonymous() {
+			respondUnauthorized(w, req, errAuthenticationRequired)
+			return
+		}
+		respondWithProblem(w, req, forbiddenError("insufficient_scope", fmt.Sprintf("Requires the %s scope", scope)))
+	}
+}
+
+func respondUnauthorized(w http.ResponseWriter, req *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="scheduler"`)
+	respondWithProblem(w, req, err)
+}
+
+// apiKeyFrom reads the key from an "Authorization: Bearer" or X-API-Key
+// header.
+func apiKeyFrom(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
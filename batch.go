@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+type batchOperation struct {
+	Op          string     `json:"op"`
+	Task_ID     int        `json:"task_id"`
+	Task        string     `json:"task"`
+	Seq         int        `json:"seq"`
+	Complete    bool       `json:"complete"`
+	Due_At      *time.Time `json:"due_at"`
+	Category_ID string     `json:"category_id"`
+}
+
+type batchRequest struct {
+	Continue_On_Error bool             `json:"continue_on_error"`
+	Operations        []batchOperation `json:"operations"`
+}
+
+type batchResult struct {
+	Index  int      `json:"index"`
+	Op     string   `json:"op"`
+	Status int      `json:"status"`
+	Task   *task    `json:"task,omitempty"`
+	Error  *problem `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []batchResult `json:"results"`
+}
+
+var (
+	errBatchRolledBack  = &appError{Kind: kindFailedDependency, Code: "batch_rolled_back", Message: "Rolled back"}
+	errBatchNotExecuted = &appError{Kind: kindFailedDependency, Code: "batch_not_executed", Message: "Not executed"}
+)
+
+// failed records err as the outcome of the operation.
+func (r batchResult) failed(req *http.Request, err error) batchResult {
+	p := problemFor(req, err)
+	r.Status = p.Status
+	r.Task = nil
+	r.Error = &p
+	return r
+}
+
+// runBatchOperation applies a single operation to the tasks of categoryId and
+// reports the outcome as an HTTP status code.
+func runBatchOperation(db queryer, req *http.Request, categoryId string, index int, op batchOperation) batchResult {
+	ctx := req.Context()
+	result := batchResult{Index: index, Op: op.Op}
+	t := task{Task_ID: op.Task_ID, Category_ID: categoryId, Task: op.Task, Seq: op.Seq, Complete: op.Complete, Due_At: op.Due_At}
+
+	if errs := op.validate(); len(errs) > 0 {
+		return result.failed(req, validationError(errs))
+	}
+
+	var err error
+	switch op.Op {
+	case "create":
+		err = t.createTask(ctx, db)
+		result.Status = http.StatusCreated
+	case "update":
+		err = t.updateTask(ctx, db)
+		result.Status = http.StatusOK
+	case "complete":
+		t.Complete = true
+		err = t.completeTask(ctx, db)
+		result.Status = http.StatusOK
+	case "move":
+		// the target category needs the same role as this one
+		if err = authorizeCategory(ctx, db, op.Category_ID, roleEditor); err == nil {
+			err = t.moveTask(ctx, db, op.Category_ID)
+		}
+		result.Status = http.StatusOK
+	case "delete":
+		err = t.deleteTask(ctx, db)
+		result.Status = http.StatusOK
+	}
+
+	if err != nil {
+		return result.failed(req, err)
+	}
+
+	if op.Op != "delete" {
+		result.Task = &t
+	}
+	return result
+}
+
+// runBatch executes every operation in a single transaction and rolls back on
+// the first failure. The returned status is the one of the failing operation,
+// or 200 when everything was committed.
+func runBatch(db *sql.DB, req *http.Request, categoryId string, ops []batchOperation) (int, batchResponse, error) {
+	res := batchResponse{Results: []batchResult{}}
+
+	tx, err := db.BeginTx(req.Context(), nil)
+	if err != nil {
+		return 0, res, err
+	}
+
+	for i, op := range ops {
+		result := runBatchOperation(tx, req, categoryId, i, op)
+		if result.Status >= http.StatusBadRequest {
+			tx.Rollback()
+			for j := range res.Results {
+				res.Results[j] = res.Results[j].failed(req, errBatchRolledBack)
+			}
+			res.Results = append(res.Results, result)
+			for j := i + 1; j < len(ops); j++ {
+				res.Results = append(res.Results, batchResult{Index: j, Op: ops[j].Op}.failed(req, errBatchNotExecuted))
+			}
+			return result.Status, res, nil
+		}
+		res.Results = append(res.Results, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, res, err
+	}
+	res.Committed = true
+	return http.StatusOK, res, nil
+}
+
+// runBatchContinueOnError executes every operation in a transaction of its
+// own, so failures do not affect the other operations. 207 is returned if any
+// operation failed.
+func runBatchContinueOnError(db *sql.DB, req *http.Request, categoryId string, ops []batchOperation) (int, batchResponse) {
+	res := batchResponse{Committed: true, Results: []batchResult{}}
+	status := http.StatusOK
+
+	for i, op := range ops {
+		var result batchResult
+		err := inTransaction(req.Context(), db, func(tx *sql.Tx) error {
+			result = runBatchOperation(tx, req, categoryId, i, op)
+			if result.Status >= http.StatusBadRequest {
+				return errBatchRolledBack
+			}
+			return nil
+		})
+		if err != nil && err != errBatchRolledBack {
+			result = batchResult{Index: i, Op: op.Op}.failed(req, err)
+		}
+		if result.Status >= http.StatusBadRequest {
+			status = http.StatusMultiStatus
+		}
+		res.Results = append(res.Results, result)
+	}
+	return status, res
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestBatchTasks(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+	taskIds := addTasksToCategory(categoryId, 3)
+
+	jsonString := []byte(fmt.Sprintf(`{"operations": [
+		{"op": "create", "task": "New task"},
+		{"op": "update", "task_id": %v, "task": "Updated task", "seq": 1},
+		{"op": "complete", "task_id": %v},
+		{"op": "delete", "task_id": %v}
+	]}`, taskIds[0], taskIds[1], taskIds[2]))
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/category/%v/tasks:batch", categoryId), bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var res batchResponse
+	json.Unmarshal(response.Body.Bytes(), &res)
+	if !res.Committed {
+		t.Errorf("Expected batch to be committed")
+	}
+	if len(res.Results) != 4 {
+		t.Errorf("Expected 4 results. Got %v", len(res.Results))
+	}
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/category/%v/task/%v", categoryId, taskIds[1]), nil)
+	response = executeRequest(req)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["complete"] != true {
+		t.Errorf("Expected task %v to be complete. Got %v", taskIds[1], m["complete"])
+	}
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/category/%v/task/%v", categoryId, taskIds[2]), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestBatchTasksRollsBackOnFailure(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+	taskId := addTaskToCategory(categoryId)
+
+	jsonString := []byte(fmt.Sprintf(`{"operations": [
+		{"op": "delete", "task_id": %v},
+		{"op": "explode"}
+	]}`, taskId))
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/category/%v/tasks:batch", categoryId), bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var res batchResponse
+	json.Unmarshal(response.Body.Bytes(), &res)
+	if res.Committed {
+		t.Errorf("Expected batch to be rolled back")
+	}
+	if res.Results[0].Status != http.StatusFailedDependency {
+		t.Errorf("Expected first operation status to be %v. Got %v", http.StatusFailedDependency, res.Results[0].Status)
+	}
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/category/%v/task/%v", categoryId, taskId), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestBatchTasksContinueOnError(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+	taskId := addTaskToCategory(categoryId)
+
+	jsonString := []byte(fmt.Sprintf(`{"continue_on_error": true, "operations": [
+		{"op": "delete", "task_id": %v},
+		{"op": "explode"}
+	]}`, taskId))
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/category/%v/tasks:batch", categoryId), bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusMultiStatus, response.Code)
+
+	var res batchResponse
+	json.Unmarshal(response.Body.Bytes(), &res)
+	if res.Results[0].Status != http.StatusOK {
+		t.Errorf("Expected first operation status to be %v. Got %v", http.StatusOK, res.Results[0].Status)
+	}
+	if res.Results[1].Status != http.StatusUnprocessableEntity {
+		t.Errorf("Expected second operation status to be %v. Got %v", http.StatusUnprocessableEntity, res.Results[1].Status)
+	}
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/category/%v/task/%v", categoryId, taskId), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestBatchTasksReportMissingTasksAndCategories(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+	taskId := addTaskToCategory(categoryId)
+
+	jsonString := []byte(fmt.Sprintf(`{"continue_on_error": true, "operations": [
+		{"op": "update", "task_id": 999, "task": "Nowhere"},
+		{"op": "complete", "task_id": 999},
+		{"op": "move", "task_id": 999, "category_id": %q},
+		{"op": "delete", "task_id": 999},
+		{"op": "move", "task_id": %v, "category_id": %q}
+	]}`, categoryId, taskId, uuid.New().String()))
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/category/%v/tasks:batch", categoryId), bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusMultiStatus, response.Code)
+
+	var res batchResponse
+	json.Unmarshal(response.Body.Bytes(), &res)
+	codes := []string{"task_not_found", "task_not_found", "task_not_found", "task_not_found", "category_not_found"}
+	if len(res.Results) != len(codes) {
+		t.Fatalf("Expected %v results. Got %+v", len(codes), res.Results)
+	}
+	for i, code := range codes {
+		if r := res.Results[i]; r.Status != http.StatusNotFound || r.Error == nil || r.Error.Code != code {
+			t.Errorf("Expected operation %v to fail with 404 %s. Got %+v", i, code, r)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/category/%v/task/%v", categoryId, taskId), nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 )
 
@@ -10,44 +11,92 @@ type category struct {
 	Description string `json:"description"`
 }
 
-func (c *category) createCategory(db *sql.DB) error {
-	err := db.QueryRow(
-		"INSERT INTO categories(name, description) VALUES ($1, $2) RETURNING category_id",
-		c.Name, c.Description,
+var errCategoryNotFound = notFoundError("category_not_found", "Category not found")
+
+// Every query is restricted to the workspace of ctx, so categories of other
+// workspaces are not found even by ID. Changes publish their event with db,
+// so they should run in a transaction.
+
+func (c *category) createCategory(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO categories(name, description, workspace_id) VALUES ($1, $2, $3) RETURNING category_id",
+		c.Name, c.Description, workspaceFrom(ctx).id,
 	).Scan(&c.Category_ID)
-	return err
+	if err != nil {
+		return dbError(err)
+	}
+	return publishEvent(ctx, db, eventCategoryCreated, c)
 }
 
-func (c *category) getCategory(db *sql.DB) error {
-	return db.QueryRow(
-		"SELECT name, description FROM categories WHERE category_id=$1",
-		c.Category_ID,
+func (c *category) getCategory(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		"SELECT name, description FROM categories WHERE category_id=$1 AND workspace_id=$2",
+		c.Category_ID, workspaceFrom(ctx).id,
 	).Scan(&c.Name, &c.Description)
+	if err == sql.ErrNoRows {
+		return errCategoryNotFound
+	}
+	return err
 }
 
-func (c *category) updateCategory(db *sql.DB) error {
-	_, err := db.Exec(
-		"UPDATE categories SET name=$1, description=$2 WHERE category_id=$3",
-		c.Name, c.Description, c.Category_ID,
+func (c *category) updateCategory(ctx context.Context, db queryer) error {
+	res, err := db.ExecContext(ctx,
+		"UPDATE categories SET name=$1, description=$2 WHERE category_id=$3 AND workspace_id=$4",
+		c.Name, c.Description, c.Category_ID, workspaceFrom(ctx).id,
 	)
-	return err
+	if err := affectedOrNotFound(res, err, errCategoryNotFound); err != nil {
+		return err
+	}
+	return publishEvent(ctx, db, eventCategoryUpdated, c)
 }
 
-func (c *category) deleteCategory(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM categories WHERE category_id=$1", c.Category_ID)
-	return err
+func (c *category) deleteCategory(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		"DELETE FROM categories WHERE category_id=$1 AND workspace_id=$2 RETURNING name, description",
+		c.Category_ID, workspaceFrom(ctx).id,
+	).Scan(&c.Name, &c.Description)
+	if err == sql.ErrNoRows {
+		return errCategoryNotFound
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	return publishEvent(ctx, db, eventCategoryDeleted, c)
 }
 
-func (c *category) deleteCategoryTasks(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM tasks WHERE category_id=$1", c.Category_ID)
+func (c *category) deleteCategoryTasks(ctx context.Context, db queryer) error {
+	_, err := db.ExecContext(ctx,
+		"DELETE FROM tasks WHERE category_id IN (SELECT category_id FROM categories WHERE category_id=$1 AND workspace_id=$2)",
+		c.Category_ID, workspaceFrom(ctx).id,
+	)
 	return err
 }
 
-func getCategories(db *sql.DB) ([]category, error) {
-	rows, err := db.Query("SELECT category_id, name, description FROM categories")
+func getCategories(ctx context.Context, db queryer) ([]category, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT category_id, name, description FROM categories WHERE workspace_id=$1",
+		workspaceFrom(ctx).id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanCategories(rows)
+}
+
+// getCategoriesSharedWith lists the categories userId has any role on.
+func getCategoriesSharedWith(ctx context.Context, db queryer, userId string) ([]category, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT c.category_id, c.name, c.description FROM categories c
+		JOIN category_shares s ON s.category_id = c.category_id WHERE s.user_id=$1 AND c.workspace_id=$2`,
+		userId, workspaceFrom(ctx).id,
+	)
 	if err != nil {
 		return nil, err
 	}
+	return scanCategories(rows)
+}
+
+func scanCategories(rows *sql.Rows) ([]category, error) {
 	defer rows.Close()
 
 	categories := []category{}
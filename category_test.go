@@ -27,10 +27,17 @@ func TestGetNonExistentCategory(t *testing.T) {
 	response := executeRequest(req)
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 
-	var m map[string]string
-	json.Unmarshal(response.Body.Bytes(), &m)
-	if m["error"] != "Category not found" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'Category not found'. Got %s", m["error"])
+	if ct := response.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Expected content type 'application/problem+json'. Got %s", ct)
+	}
+
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "category_not_found" {
+		t.Errorf("Expected the 'code' key of the response to be set to 'category_not_found'. Got %s", p.Code)
+	}
+	if p.Detail != "Category not found" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'Category not found'. Got %s", p.Detail)
 	}
 }
 
@@ -0,0 +1,269 @@
+// Package client is a typed Go client for the scheduler HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultBaseDelay  = 100 * time.Millisecond
+	defaultMaxDelay   = 2 * time.Second
+)
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	header     http.Header
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how often a failed idempotent call is retried and the
+// bounds of the exponential backoff between attempts.
+func WithRetries(maxRetries int, baseDelay, maxDelay time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.baseDelay = baseDelay
+		c.maxDelay = maxDelay
+	}
+}
+
+// WithHeader adds a header, e.g. Authorization, to every request.
+func WithHeader(key, value string) Option {
+	return func(c *Client) { c.header.Add(key, value) }
+}
+
+// WithWorkspace makes every request work in the workspace with id instead
+// of the default one.
+func WithWorkspace(id string) Option {
+	return func(c *Client) { c.header.Set("X-Workspace-ID", id) }
+}
+
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		header:     http.Header{},
+		maxRetries: defaultMaxRetries,
+		baseDelay:  defaultBaseDelay,
+		maxDelay:   defaultMaxDelay,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// categories
+
+func (c *Client) ListCategories(ctx context.Context) ([]Category, error) {
+	var categories []Category
+	err := c.do(ctx, "GET", "/categories", nil, &categories)
+	return categories, err
+}
+
+func (c *Client) GetCategory(ctx context.Context, categoryId string) (*Category, error) {
+	var category Category
+	if err := c.do(ctx, "GET", "/category/"+categoryId, nil, &category); err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+func (c *Client) CreateCategory(ctx context.Context, name, description string) (*Category, error) {
+	var category Category
+	in := Category{Name: name, Description: description}
+	if err := c.do(ctx, "POST", "/category", in, &category); err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+func (c *Client) UpdateCategory(ctx context.Context, category Category) (*Category, error) {
+	var updated Category
+	in := Category{Name: category.Name, Description: category.Description}
+	if err := c.do(ctx, "PUT", "/category/"+category.Category_ID, in, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (c *Client) DeleteCategory(ctx context.Context, categoryId string) error {
+	return c.do(ctx, "DELETE", "/category/"+categoryId, nil, nil)
+}
+
+// tasks
+
+func (c *Client) ListTasks(ctx context.Context, categoryId string) ([]Task, error) {
+	var tasks []Task
+	err := c.do(ctx, "GET", fmt.Sprintf("/category/%s/tasks", categoryId), nil, &tasks)
+	return tasks, err
+}
+
+func (c *Client) GetTask(ctx context.Context, categoryId string, taskId int) (*Task, error) {
+	var task Task
+	if err := c.do(ctx, "GET", fmt.Sprintf("/category/%s/task/%d", categoryId, taskId), nil, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (c *Client) CreateTask(ctx context.Context, categoryId string, task Task) (*Task, error) {
+	var created Task
+	in := Task{Task: task.Task, Seq: task.Seq, Complete: task.Complete, Due_At: task.Due_At}
+	if err := c.do(ctx, "POST", fmt.Sprintf("/category/%s/task", categoryId), in, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (c *Client) UpdateTask(ctx context.Context, task Task) (*Task, error) {
+	var updated Task
+	in := Task{Task: task.Task, Seq: task.Seq, Complete: task.Complete, Due_At: task.Due_At}
+	path := fmt.Sprintf("/category/%s/task/%d", task.Category_ID, task.Task_ID)
+	if err := c.do(ctx, "PUT", path, in, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func (c *Client) DeleteTask(ctx context.Context, categoryId string, taskId int) error {
+	return c.do(ctx, "DELETE", fmt.Sprintf("/category/%s/task/%d", categoryId, taskId), nil, nil)
+}
+
+// BatchTasks applies several operations to the tasks of a category. When the
+// batch is rejected the per-operation results are returned along with the
+// error.
+func (c *Client) BatchTasks(ctx context.Context, categoryId string, batch BatchRequest) (*BatchResponse, error) {
+	var res BatchResponse
+	err := c.do(ctx, "POST", fmt.Sprintf("/category/%s/tasks:batch", categoryId), batch, &res)
+	if err != nil && res.Results == nil {
+		return nil, err
+	}
+	return &res, err
+}
+
+// do sends the request, retrying transient failures of idempotent requests.
+// POST requests are made idempotent with a generated Idempotency-Key.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	header := c.header.Clone()
+	if method == "POST" && header.Get("Idempotency-Key") == "" {
+		header.Set("Idempotency-Key", uuid.New().String())
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = c.attempt(ctx, method, path, header, body, out)
+		if !retry || attempt >= c.maxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.backoff(attempt)):
+		}
+	}
+}
+
+// attempt performs a single round trip and reports whether it may be retried.
+func (c *Client) attempt(ctx context.Context, method, path string, header http.Header, body []byte, out interface{}) (bool, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return false, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json, application/problem+json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return true, err
+	}
+
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if res.StatusCode >= http.StatusBadRequest {
+		apiErr := &APIError{Status: res.StatusCode, Code: "http_error", Title: http.StatusText(res.StatusCode)}
+		switch contentType {
+		case "application/problem+json":
+			json.Unmarshal(data, apiErr)
+		case "application/json":
+			// the body is a regular payload describing the failure
+			if out != nil {
+				json.Unmarshal(data, out)
+			}
+		}
+		return retryable(res.StatusCode), apiErr
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before retry number attempt, doubling each time
+// with full jitter.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.baseDelay << uint(attempt)
+	if d <= 0 || d > c.maxDelay {
+		d = c.maxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
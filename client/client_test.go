@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetriesTransientFailures(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"category_id":"b119178b-2fd2-4a5c-9301-190c341df180","name":"Test","description":""}]`))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRetries(3, time.Millisecond, 10*time.Millisecond))
+	categories, err := c.ListCategories(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error. Got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts. Got %v", attempts)
+	}
+	if len(categories) != 1 {
+		t.Errorf("Expected 1 category. Got %v", len(categories))
+	}
+}
+
+func TestPostsReuseIdempotencyKeyAcrossRetries(t *testing.T) {
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		keys = append(keys, req.Header.Get("Idempotency-Key"))
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRetries(2, time.Millisecond, 10*time.Millisecond))
+	_, err := c.CreateCategory(context.Background(), "Test", "")
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if len(keys) != 3 {
+		t.Fatalf("Expected 3 attempts. Got %v", len(keys))
+	}
+	if keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Errorf("Expected the same idempotency key on every attempt. Got %v", keys)
+	}
+}
+
+func TestProblemResponsesBecomeAPIErrors(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"type":"/problems/category_not_found","title":"Not Found","status":404,"detail":"Category not found","code":"category_not_found"}`))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	_, err := c.GetCategory(context.Background(), "b119178b-2fd2-4a5c-9301-190c341df180")
+	if !IsNotFound(err) {
+		t.Fatalf("Expected a not found error. Got %v", err)
+	}
+	if err.(*APIError).Code != "category_not_found" {
+		t.Errorf("Expected code 'category_not_found'. Got %s", err.(*APIError).Code)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected client errors not to be retried. Got %v attempts", attempts)
+	}
+}
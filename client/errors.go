@@ -0,0 +1,52 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// APIError mirrors the problem details returned by the server.
+type APIError struct {
+	Type           string       `json:"type"`
+	Title          string       `json:"title"`
+	Status         int          `json:"status"`
+	Detail         string       `json:"detail,omitempty"`
+	Instance       string       `json:"instance,omitempty"`
+	Code           string       `json:"code"`
+	Fields         []FieldError `json:"fields,omitempty"`
+	Correlation_ID string       `json:"correlation_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("scheduler: %d %s: %s", e.Status, e.Code, e.Detail)
+	}
+	return fmt.Sprintf("scheduler: %d %s", e.Status, e.Code)
+}
+
+func hasStatus(err error, status int) bool {
+	var e *APIError
+	return errors.As(err, &e) && e.Status == status
+}
+
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+func IsValidation(err error) bool {
+	return hasStatus(err, http.StatusUnprocessableEntity)
+}
+
+func IsForbidden(err error) bool {
+	return hasStatus(err, http.StatusForbidden)
+}
@@ -0,0 +1,72 @@
+package client
+
+import "context"
+
+// CategoryIterator walks all categories. The API currently returns every item
+// in a single page, so the first call to Next fetches everything.
+type CategoryIterator struct {
+	fetch   func() ([]Category, error)
+	items   []Category
+	i       int
+	fetched bool
+	err     error
+}
+
+func (c *Client) Categories(ctx context.Context) *CategoryIterator {
+	return &CategoryIterator{fetch: func() ([]Category, error) { return c.ListCategories(ctx) }}
+}
+
+func (it *CategoryIterator) Next() bool {
+	if !it.fetched {
+		it.items, it.err = it.fetch()
+		it.fetched = true
+		it.i = -1
+	}
+	if it.err != nil {
+		return false
+	}
+	it.i++
+	return it.i < len(it.items)
+}
+
+func (it *CategoryIterator) Category() Category {
+	return it.items[it.i]
+}
+
+func (it *CategoryIterator) Err() error {
+	return it.err
+}
+
+// TaskIterator walks all tasks of a category, see CategoryIterator.
+type TaskIterator struct {
+	fetch   func() ([]Task, error)
+	items   []Task
+	i       int
+	fetched bool
+	err     error
+}
+
+func (c *Client) Tasks(ctx context.Context, categoryId string) *TaskIterator {
+	return &TaskIterator{fetch: func() ([]Task, error) { return c.ListTasks(ctx, categoryId) }}
+}
+
+func (it *TaskIterator) Next() bool {
+	if !it.fetched {
+		it.items, it.err = it.fetch()
+		it.fetched = true
+		it.i = -1
+	}
+	if it.err != nil {
+		return false
+	}
+	it.i++
+	return it.i < len(it.items)
+}
+
+func (it *TaskIterator) Task() Task {
+	return it.items[it.i]
+}
+
+func (it *TaskIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,48 @@
+package client
+
+import "time"
+
+type Category struct {
+	Category_ID string `json:"category_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type Task struct {
+	Task_ID     int        `json:"task_id"`
+	Category_ID string     `json:"category_id"`
+	Task        string     `json:"task"`
+	Seq         int        `json:"seq"`
+	Complete    bool       `json:"complete"`
+	Due_At      *time.Time `json:"due_at,omitempty"`
+}
+
+// BatchOperation is a single entry of a batch. Op is one of create, update,
+// complete, move or delete; Category_ID is the target category of a move.
+type BatchOperation struct {
+	Op          string     `json:"op"`
+	Task_ID     int        `json:"task_id,omitempty"`
+	Task        string     `json:"task,omitempty"`
+	Seq         int        `json:"seq,omitempty"`
+	Complete    bool       `json:"complete,omitempty"`
+	Due_At      *time.Time `json:"due_at,omitempty"`
+	Category_ID string     `json:"category_id,omitempty"`
+}
+
+type BatchRequest struct {
+	Continue_On_Error bool             `json:"continue_on_error,omitempty"`
+	Operations        []BatchOperation `json:"operations"`
+}
+
+type BatchResult struct {
+	Index  int       `json:"index"`
+	Op     string    `json:"op"`
+	Status int       `json:"status"`
+	Task   *Task     `json:"task,omitempty"`
+	Error  *APIError `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultWebhookTolerance is how old a delivery ParseWebhook accepts.
+const DefaultWebhookTolerance = 5 * time.Minute
+
+// maxWebhookBody bounds what ParseWebhook reads from a delivery; longer ones
+// fail the signature check.
+const maxWebhookBody = 1 << 20
+
+var (
+	ErrInvalidWebhookSignature = errors.New("scheduler: invalid webhook signature")
+	ErrWebhookTooOld           = errors.New("scheduler: webhook timestamp outside the tolerance")
+)
+
+// WebhookEvent is the body of a webhook delivery. Data is the category or
+// task the event is about.
+type WebhookEvent struct {
+	Event_ID     string          `json:"event_id"`
+	Type         string          `json:"type"`
+	Workspace_ID string          `json:"workspace_id"`
+	Occurred_At  time.Time       `json:"occurred_at"`
+	Data         json.RawMessage `json:"data"`
+}
+
+// VerifyWebhookSignature checks the X-Webhook-Signature header of a
+// delivery against its body and the secret of the webhook, and that it was
+// signed no more than tolerance ago.
+func VerifyWebhookSignature(secret, header string, body []byte, tolerance time.Duration) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidWebhookSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	valid := false
+	for _, s := range signatures {
+		if sig, err := hex.DecodeString(s); err == nil && hmac.Equal(sig, expected) {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrInvalidWebhookSignature
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return ErrWebhookTooOld
+	}
+	return nil
+}
+
+// ParseWebhook reads and verifies a delivery received by an HTTP handler.
+func ParseWebhook(req *http.Request, secret string) (*WebhookEvent, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxWebhookBody))
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyWebhookSignature(secret, req.Header.Get("X-Webhook-Signature"), body, DefaultWebhookTolerance); err != nil {
+		return nil, err
+	}
+	var e WebhookEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matthi01/scheduler/client"
+)
+
+func TestClientAgainstRouter(t *testing.T) {
+	clearTables()
+	srv := httptest.NewServer(a.Router)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := client.New(srv.URL)
+
+	created, err := c.CreateCategory(ctx, "Client category", "Created by the client")
+	if err != nil {
+		t.Fatalf("Could not create category. Error: %v", err)
+	}
+
+	created.Name = "Renamed category"
+	if _, err := c.UpdateCategory(ctx, *created); err != nil {
+		t.Errorf("Could not update category. Error: %v", err)
+	}
+
+	task, err := c.CreateTask(ctx, created.Category_ID, client.Task{Task: "Client task"})
+	if err != nil {
+		t.Fatalf("Could not create task. Error: %v", err)
+	}
+
+	task.Complete = true
+	updated, err := c.UpdateTask(ctx, *task)
+	if err != nil {
+		t.Fatalf("Could not update task. Error: %v", err)
+	}
+	if !updated.Complete {
+		t.Errorf("Expected task to be complete")
+	}
+
+	res, err := c.BatchTasks(ctx, created.Category_ID, client.BatchRequest{
+		Operations: []client.BatchOperation{{Op: "create", Task: "Batch task"}},
+	})
+	if err != nil || !res.Committed {
+		t.Errorf("Expected batch to be committed. Error: %v", err)
+	}
+
+	count := 0
+	it := c.Tasks(ctx, created.Category_ID)
+	for it.Next() {
+		count++
+	}
+	if it.Err() != nil {
+		t.Errorf("Could not iterate tasks. Error: %v", it.Err())
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 tasks. Got %v", count)
+	}
+
+	if err := c.DeleteTask(ctx, created.Category_ID, task.Task_ID); err != nil {
+		t.Errorf("Could not delete task. Error: %v", err)
+	}
+	if _, err := c.GetTask(ctx, created.Category_ID, task.Task_ID); !client.IsNotFound(err) {
+		t.Errorf("Expected deleted task to be not found. Got %v", err)
+	}
+
+	if _, err := c.CreateCategory(ctx, "", ""); !client.IsValidation(err) {
+		t.Errorf("Expected a validation error. Got %v", err)
+	}
+
+	if err := c.DeleteCategory(ctx, created.Category_ID); err != nil {
+		t.Errorf("Could not delete category. Error: %v", err)
+	}
+	if _, err := c.GetCategory(ctx, created.Category_ID); !client.IsNotFound(err) {
+		t.Errorf("Expected deleted category to be not found. Got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+const bashCompletion = `_scheduler() {
+    local cur words
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    case "$COMP_CWORD" in
+        1) words="categories tasks completion" ;;
+        2)
+            case "${COMP_WORDS[1]}" in
+                categories) words="list create rename delete" ;;
+                tasks) words="ls add done undo mv rm" ;;
+                completion) words="bash zsh" ;;
+            esac
+            ;;
+    esac
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -F _scheduler scheduler
+`
+
+const zshCompletion = `#compdef scheduler
+_scheduler() {
+    case $CURRENT in
+        2) compadd categories tasks completion ;;
+        3)
+            case $words[2] in
+                categories) compadd list create rename delete ;;
+                tasks) compadd ls add done undo mv rm ;;
+                completion) compadd bash zsh ;;
+            esac
+            ;;
+    esac
+}
+compdef _scheduler scheduler
+`
+
+func writeCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		fmt.Fprint(w, bashCompletion)
+	case "zsh":
+		fmt.Fprint(w, zshCompletion)
+	default:
+		return fmt.Errorf("unsupported shell %q, expected bash or zsh", shell)
+	}
+	return nil
+}
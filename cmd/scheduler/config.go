@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const defaultServer = "http://localhost:3000"
+
+type config struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "scheduler", "config.json")
+}
+
+// loadConfig reads the config file at path, if any, and applies the
+// SCHEDULER_SERVER and SCHEDULER_TOKEN environment variables on top.
+func loadConfig(path string) (config, error) {
+	cfg := config{Server: defaultServer}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return cfg, err
+		default:
+			if err := json.Unmarshal(data, &cfg); err != nil {
+				return cfg, err
+			}
+		}
+	}
+
+	if v := os.Getenv("SCHEDULER_SERVER"); v != "" {
+		cfg.Server = v
+	}
+	if v := os.Getenv("SCHEDULER_TOKEN"); v != "" {
+		cfg.Token = v
+	}
+	return cfg, nil
+}
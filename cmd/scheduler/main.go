@@ -0,0 +1,295 @@
+// Command scheduler manages categories and tasks through the scheduler API.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/matthi01/scheduler/client"
+)
+
+const usage = `Usage: scheduler [flags] <command> [args]
+
+Commands:
+  categories list
+  categories create <name> [-d description]
+  categories rename <category_id> <name>
+  categories delete <category_id>
+  tasks ls <category_id>
+  tasks add <category_id> <task>
+  tasks done <category_id> <task_id>
+  tasks undo <category_id> <task_id>
+  tasks mv <category_id> <task_id> <target_category_id>
+  tasks rm <category_id> <task_id>
+  completion bash|zsh
+
+Flags:
+`
+
+var errUsage = errors.New("invalid usage")
+
+type cli struct {
+	client *client.Client
+	out    io.Writer
+	json   bool
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("scheduler", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", defaultConfigPath(), "path of the config file")
+	server := fs.String("server", "", "base URL of the scheduler API")
+	token := fs.String("token", "", "API token")
+	output := fs.String("o", "table", "output format: table or json")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() == 2 && fs.Arg(0) == "completion" {
+		if err := writeCompletion(stdout, fs.Arg(1)); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		return 0
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "could not load config: %v\n", err)
+		return 1
+	}
+	if *server != "" {
+		cfg.Server = *server
+	}
+	if *token != "" {
+		cfg.Token = *token
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+
+	var opts []client.Option
+	if cfg.Token != "" {
+		opts = append(opts, client.WithHeader("Authorization", "Bearer "+cfg.Token))
+	}
+	c := &cli{client: client.New(cfg.Server, opts...), out: stdout, json: *output == "json"}
+
+	err = c.dispatch(context.Background(), fs.Args())
+	switch {
+	case err == errUsage:
+		fs.Usage()
+		return 2
+	case err != nil:
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func (c *cli) dispatch(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	rest := args[2:]
+
+	switch args[0] + " " + args[1] {
+	case "categories list":
+		return c.listCategories(ctx)
+	case "categories create":
+		return c.createCategory(ctx, rest)
+	case "categories rename":
+		return c.renameCategory(ctx, rest)
+	case "categories delete":
+		return c.deleteCategory(ctx, rest)
+	case "tasks ls":
+		return c.listTasks(ctx, rest)
+	case "tasks add":
+		return c.addTask(ctx, rest)
+	case "tasks done":
+		return c.setTaskComplete(ctx, rest, true)
+	case "tasks undo":
+		return c.setTaskComplete(ctx, rest, false)
+	case "tasks mv":
+		return c.moveTask(ctx, rest)
+	case "tasks rm":
+		return c.removeTask(ctx, rest)
+	}
+	return errUsage
+}
+
+// categories
+func (c *cli) listCategories(ctx context.Context) error {
+	categories, err := c.client.ListCategories(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printCategories(categories...)
+}
+
+func (c *cli) createCategory(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("categories create", flag.ContinueOnError)
+	description := fs.String("d", "", "description of the category")
+	if len(args) < 1 {
+		return errUsage
+	}
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	category, err := c.client.CreateCategory(ctx, args[0], *description)
+	if err != nil {
+		return err
+	}
+	return c.printCategories(*category)
+}
+
+func (c *cli) renameCategory(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	category, err := c.client.GetCategory(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	category.Name = args[1]
+	category, err = c.client.UpdateCategory(ctx, *category)
+	if err != nil {
+		return err
+	}
+	return c.printCategories(*category)
+}
+
+func (c *cli) deleteCategory(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return c.client.DeleteCategory(ctx, args[0])
+}
+
+// tasks
+func (c *cli) listTasks(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	tasks, err := c.client.ListTasks(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return c.printTasks(tasks...)
+}
+
+func (c *cli) addTask(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	task, err := c.client.CreateTask(ctx, args[0], client.Task{Task: strings.Join(args[1:], " ")})
+	if err != nil {
+		return err
+	}
+	return c.printTasks(*task)
+}
+
+func (c *cli) setTaskComplete(ctx context.Context, args []string, complete bool) error {
+	categoryId, taskId, err := taskArgs(args, 2)
+	if err != nil {
+		return err
+	}
+	task, err := c.client.GetTask(ctx, categoryId, taskId)
+	if err != nil {
+		return err
+	}
+	task.Complete = complete
+	task, err = c.client.UpdateTask(ctx, *task)
+	if err != nil {
+		return err
+	}
+	return c.printTasks(*task)
+}
+
+func (c *cli) moveTask(ctx context.Context, args []string) error {
+	categoryId, taskId, err := taskArgs(args, 3)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.BatchTasks(ctx, categoryId, client.BatchRequest{
+		Operations: []client.BatchOperation{{Op: "move", Task_ID: taskId, Category_ID: args[2]}},
+	})
+	if err != nil {
+		if res != nil && len(res.Results) > 0 && res.Results[0].Error != nil {
+			return res.Results[0].Error
+		}
+		return err
+	}
+	return c.printTasks(*res.Results[0].Task)
+}
+
+func (c *cli) removeTask(ctx context.Context, args []string) error {
+	categoryId, taskId, err := taskArgs(args, 2)
+	if err != nil {
+		return err
+	}
+	return c.client.DeleteTask(ctx, categoryId, taskId)
+}
+
+func taskArgs(args []string, n int) (string, int, error) {
+	if len(args) != n {
+		return "", 0, errUsage
+	}
+	taskId, err := strconv.Atoi(args[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid task ID %q", args[1])
+	}
+	return args[0], taskId, nil
+}
+
+// output
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cli) printCategories(categories ...client.Category) error {
+	if c.json {
+		return c.printJSON(categories)
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tDESCRIPTION")
+	for _, cat := range categories {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", cat.Category_ID, cat.Name, cat.Description)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) printTasks(tasks ...client.Task) error {
+	if c.json {
+		return c.printJSON(tasks)
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDONE\tSEQ\tTASK")
+	for _, t := range tasks {
+		done := " "
+		if t.Complete {
+			done = "x"
+		}
+		fmt.Fprintf(tw, "%d\t[%s]\t%d\t%s\n", t.Task_ID, done, t.Seq, t.Task)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestListCategoriesOutput(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Expected the token to be sent. Got %q", req.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"category_id":"b119178b-2fd2-4a5c-9301-190c341df180","name":"Groceries","description":"Weekly"}]`))
+	}))
+	defer srv.Close()
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-config", "", "-server", srv.URL, "-token", "secret", "categories", "list"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Expected exit code 0. Got %v: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Groceries") {
+		t.Errorf("Expected table output to contain the category name. Got %s", stdout.String())
+	}
+
+	stdout.Reset()
+	code = run([]string{"-config", "", "-server", srv.URL, "-token", "secret", "-o", "json", "categories", "list"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Expected exit code 0. Got %v: %s", code, stderr.String())
+	}
+	var categories []map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &categories); err != nil || len(categories) != 1 {
+		t.Errorf("Expected JSON output with 1 category. Got %s", stdout.String())
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"-config", "", "tasks", "explode"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2. Got %v", code)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"completion", "bash"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0. Got %v", code)
+	}
+	if !strings.Contains(stdout.String(), "complete -F _scheduler scheduler") {
+		t.Errorf("Expected a bash completion script. Got %s", stdout.String())
+	}
+}
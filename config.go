@@ -0,0 +1,809 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every setting of the server. It is built from defaults, an
+// optional TOML file, environment variables and command line flags, each
+// layer overriding the previous one.
+type Config struct {
+	Server    ServerConfig
+	Database  DatabaseConfig
+	Log       LogConfig
+	Tracing   TracingConfig
+	CORS      CORSConfig
+	RateLimit RateLimitConfig
+	Auth      AuthConfig
+	OIDC      OIDCConfig
+	Webhooks  WebhooksConfig
+	Outbox    OutboxConfig
+	Reminders RemindersConfig
+	Digests   DigestsConfig
+	Mail      MailConfig
+}
+
+type ServerConfig struct {
+	Addr              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// deadline of the context of every request, 0 for none
+	RequestTimeout time.Duration
+	// how long /readyz reports draining before the listener is closed, so
+	// load balancers stop routing new requests first
+	DrainDelay time.Duration
+	// how long in-flight requests are given to finish on shutdown
+	ShutdownTimeout time.Duration
+	// TLS is served when both files are set. They are reloaded when changed.
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+type DatabaseConfig struct {
+	// DSN, if set, is used as is and the individual connection settings
+	// below are ignored.
+	DSN             string
+	Host            string
+	Port            int
+	User            string
+	Password        string
+	Name            string
+	SSLMode         string
+	SSLRootCert     string
+	ConnectTimeout  time.Duration
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// deadline of every single query, 0 for none
+	QueryTimeout time.Duration
+}
+
+type LogConfig struct {
+	// debug, info, warn or error; can be changed at runtime with
+	// PUT /admin/log-level if AdminEndpoint is set
+	Level string
+	// serve /admin/log-level to keys with the admin scope
+	AdminEndpoint bool
+}
+
+type TracingConfig struct {
+	// OTLP/HTTP collector such as http://localhost:4318; spans are only
+	// exported if it is set
+	Endpoint    string
+	ServiceName string
+	// fraction of new traces that are sampled, from 0 to 1
+	SampleRatio    float64
+	ExportInterval time.Duration
+}
+
+// CORSConfig controls which browser origins may call the API. Lists are
+// comma separated in the environment and in flags.
+type CORSConfig struct {
+	// exact origins, "*" for any, or patterns with one wildcard such as
+	// https://*.example.com
+	AllowedOrigins []string
+	AllowedMethods []string
+	// "*" allows whatever headers the browser asks for
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// how long browsers may cache a preflight response
+	MaxAge time.Duration
+}
+
+// RateLimitConfig sets how many requests a user, or a client IP for
+// anonymous requests, may make. Limits are written as requests/period such
+// as 100/m, and 0 turns a limit off.
+type RateLimitConfig struct {
+	// memory keeps the buckets per instance, postgres shares them between
+	// all instances
+	Store  string
+	Reads  rateLimit
+	Writes rateLimit
+	// also limits invalid API keys per client IP
+	Auth rateLimit
+	// CIDRs of proxies whose X-Forwarded-For header is believed
+	TrustedProxies []string
+}
+
+type AuthConfig struct {
+	// what requests without an API key may do; empty to require a key for
+	// every API route
+	AnonymousScopes []string
+	// what users logged in with single sign-on may do
+	SessionScopes []string
+	SessionTTL    time.Duration
+}
+
+// OIDCConfig enables logging in with an OpenID Connect provider if Issuer is
+// set.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// the /auth/callback URL of this server as registered at the provider
+	RedirectURL string
+	// requested in addition to openid
+	Scopes []string
+	// ID token claim listing the groups of the user
+	GroupsClaim string
+}
+
+// WebhooksConfig controls how events are delivered to webhook subscribers.
+// Failed deliveries are retried after RetryInterval, doubled with every
+// attempt up to MaxRetryInterval.
+type WebhooksConfig struct {
+	// how often due deliveries are looked for
+	PollInterval time.Duration
+	// how long a receiver may take to respond
+	Timeout          time.Duration
+	MaxAttempts      int
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// allow URLs resolving to loopback, link-local and private addresses,
+	// which are refused by default so subscribers cannot reach internal
+	// services
+	AllowPrivateNetworks bool
+}
+
+// OutboxConfig controls how the events written to the outbox are published.
+// Sinks that fail are retried after RetryInterval, doubled with every
+// attempt up to MaxRetryInterval, until they accept the event.
+type OutboxConfig struct {
+	// how often due events are looked for
+	PollInterval time.Duration
+	// how long a sink may take to accept an event
+	Timeout          time.Duration
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// how long published events are kept
+	Retention time.Duration
+	// nats://[user:password@]host[:port] of a NATS server events are also
+	// published to, none if empty
+	NATSURL           string
+	NATSSubjectPrefix string
+}
+
+type RemindersConfig struct {
+	// how often due reminders are looked for
+	PollInterval time.Duration
+}
+
+type DigestsConfig struct {
+	// how often due digests are looked for, which is also how late they
+	// can be
+	PollInterval time.Duration
+}
+
+// MailConfig enables email notifications if SMTPAddr is set. Emails that
+// could not be sent are retried after RetryInterval, doubled with every
+// attempt up to MaxRetryInterval.
+type MailConfig struct {
+	// host:port of the SMTP server. STARTTLS is used if the server offers
+	// it, and credentials are only sent over TLS or to localhost.
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+	// sender address of every email
+	From string
+	// how often due emails are sent
+	PollInterval time.Duration
+	// how long the SMTP server may take to accept an email
+	Timeout          time.Duration
+	MaxAttempts      int
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+}
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:              ":3000",
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			RequestTimeout:    20 * time.Second,
+			DrainDelay:        5 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Host:            "localhost",
+			Port:            5432,
+			Name:            "scheduler",
+			SSLMode:         "disable",
+			ConnectTimeout:  5 * time.Second,
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+			QueryTimeout:    10 * time.Second,
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+		Tracing: TracingConfig{
+			ServiceName:    "scheduler",
+			SampleRatio:    1,
+			ExportInterval: 5 * time.Second,
+		},
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"*"},
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Content-Type", "Idempotency-Key", "X-Request-ID", "traceparent", "Authorization", "X-API-Key"},
+			ExposedHeaders: []string{"X-Request-ID", "X-Correlation-ID", "Idempotent-Replayed", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
+			MaxAge:         10 * time.Minute,
+		},
+		RateLimit: RateLimitConfig{
+			Store:  "memory",
+			Reads:  rateLimit{Requests: 300, Period: time.Minute},
+			Writes: rateLimit{Requests: 60, Period: time.Minute},
+			Auth:   rateLimit{Requests: 10, Period: time.Minute},
+		},
+		Auth: AuthConfig{
+			AnonymousScopes: []string{scopeCategoriesRead, scopeCategoriesWrite, scopeTasksRead, scopeTasksWrite},
+			SessionScopes:   []string{scopeCategoriesRead, scopeCategoriesWrite, scopeTasksRead, scopeTasksWrite, scopeWorkspacesRead, scopeWorkspacesWrite, scopeWebhooksRead, scopeWebhooksWrite, scopeNotificationsRead, scopeNotificationsWrite},
+			SessionTTL:      12 * time.Hour,
+		},
+		OIDC: OIDCConfig{
+			Scopes:      []string{"email", "profile"},
+			GroupsClaim: "groups",
+		},
+		Webhooks: WebhooksConfig{
+			PollInterval:     5 * time.Second,
+			Timeout:          10 * time.Second,
+			MaxAttempts:      10,
+			RetryInterval:    30 * time.Second,
+			MaxRetryInterval: 6 * time.Hour,
+		},
+		Outbox: OutboxConfig{
+			PollInterval:      time.Second,
+			Timeout:           10 * time.Second,
+			RetryInterval:     5 * time.Second,
+			MaxRetryInterval:  10 * time.Minute,
+			Retention:         7 * 24 * time.Hour,
+			NATSSubjectPrefix: "scheduler",
+		},
+		Reminders: RemindersConfig{
+			PollInterval: 15 * time.Second,
+		},
+		Digests: DigestsConfig{
+			PollInterval: time.Minute,
+		},
+		Mail: MailConfig{
+			PollInterval:     10 * time.Second,
+			Timeout:          30 * time.Second,
+			MaxAttempts:      8,
+			RetryInterval:    time.Minute,
+			MaxRetryInterval: time.Hour,
+		},
+	}
+}
+
+// setting binds a Config field to its file key, environment variable and flag.
+type setting struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	field func(c *Config) interface{}
+}
+
+var settings = []setting{
+	{"server.addr", "PORT", "addr", "address to listen on", func(c *Config) interface{} { return &c.Server.Addr }},
+	{"server.read_timeout", "APP_READ_TIMEOUT", "read-timeout", "maximum duration for reading a request", func(c *Config) interface{} { return &c.Server.ReadTimeout }},
+	{"server.read_header_timeout", "APP_READ_HEADER_TIMEOUT", "read-header-timeout", "maximum duration for reading request headers", func(c *Config) interface{} { return &c.Server.ReadHeaderTimeout }},
+	{"server.write_timeout", "APP_WRITE_TIMEOUT", "write-timeout", "maximum duration for writing a response", func(c *Config) interface{} { return &c.Server.WriteTimeout }},
+	{"server.idle_timeout", "APP_IDLE_TIMEOUT", "idle-timeout", "how long idle keep-alive connections are kept", func(c *Config) interface{} { return &c.Server.IdleTimeout }},
+	{"server.request_timeout", "APP_REQUEST_TIMEOUT", "request-timeout", "how long a request may take before its queries are cancelled", func(c *Config) interface{} { return &c.Server.RequestTimeout }},
+	{"server.drain_delay", "APP_DRAIN_DELAY", "drain-delay", "how long readiness fails before shutting down", func(c *Config) interface{} { return &c.Server.DrainDelay }},
+	{"server.shutdown_timeout", "APP_SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long in-flight requests may take on shutdown", func(c *Config) interface{} { return &c.Server.ShutdownTimeout }},
+	{"server.tls_cert_file", "APP_TLS_CERT_FILE", "tls-cert", "TLS certificate file", func(c *Config) interface{} { return &c.Server.TLSCertFile }},
+	{"server.tls_key_file", "APP_TLS_KEY_FILE", "tls-key", "TLS private key file", func(c *Config) interface{} { return &c.Server.TLSKeyFile }},
+	{"database.dsn", "APP_DB_DSN", "db-dsn", "full database connection string", func(c *Config) interface{} { return &c.Database.DSN }},
+	{"database.host", "HOST", "db-host", "database host", func(c *Config) interface{} { return &c.Database.Host }},
+	{"database.port", "APP_DB_PORT", "db-port", "database port", func(c *Config) interface{} { return &c.Database.Port }},
+	{"database.user", "APP_DB_USERNAME", "db-user", "database user", func(c *Config) interface{} { return &c.Database.User }},
+	{"database.password", "APP_DB_PASSWORD", "db-password", "database password", func(c *Config) interface{} { return &c.Database.Password }},
+	{"database.name", "APP_DB_NAME", "db-name", "database name", func(c *Config) interface{} { return &c.Database.Name }},
+	{"database.sslmode", "APP_DB_SSLMODE", "db-sslmode", "database SSL mode", func(c *Config) interface{} { return &c.Database.SSLMode }},
+	{"database.sslrootcert", "APP_DB_SSLROOTCERT", "db-sslrootcert", "CA certificate for verify-ca and verify-full", func(c *Config) interface{} { return &c.Database.SSLRootCert }},
+	{"database.connect_timeout", "APP_DB_CONNECT_TIMEOUT", "db-connect-timeout", "timeout for opening a connection", func(c *Config) interface{} { return &c.Database.ConnectTimeout }},
+	{"database.max_open_conns", "APP_DB_MAX_OPEN_CONNS", "db-max-open-conns", "maximum number of open connections", func(c *Config) interface{} { return &c.Database.MaxOpenConns }},
+	{"database.max_idle_conns", "APP_DB_MAX_IDLE_CONNS", "db-max-idle-conns", "maximum number of idle connections", func(c *Config) interface{} { return &c.Database.MaxIdleConns }},
+	{"database.conn_max_lifetime", "APP_DB_CONN_MAX_LIFETIME", "db-conn-max-lifetime", "maximum lifetime of a connection", func(c *Config) interface{} { return &c.Database.ConnMaxLifetime }},
+	{"database.conn_max_idle_time", "APP_DB_CONN_MAX_IDLE_TIME", "db-conn-max-idle-time", "maximum idle time of a connection", func(c *Config) interface{} { return &c.Database.ConnMaxIdleTime }},
+	{"database.query_timeout", "APP_DB_QUERY_TIMEOUT", "db-query-timeout", "how long a single query may take", func(c *Config) interface{} { return &c.Database.QueryTimeout }},
+	{"log.level", "APP_LOG_LEVEL", "log-level", "minimum level of log lines: debug, info, warn or error", func(c *Config) interface{} { return &c.Log.Level }},
+	{"log.admin_endpoint", "APP_LOG_ADMIN_ENDPOINT", "log-admin-endpoint", "serve /admin/log-level to keys with the admin scope", func(c *Config) interface{} { return &c.Log.AdminEndpoint }},
+	{"tracing.endpoint", "OTEL_EXPORTER_OTLP_ENDPOINT", "otlp-endpoint", "OTLP/HTTP collector to export traces to", func(c *Config) interface{} { return &c.Tracing.Endpoint }},
+	{"tracing.service_name", "OTEL_SERVICE_NAME", "service-name", "service name reported with traces", func(c *Config) interface{} { return &c.Tracing.ServiceName }},
+	{"tracing.sample_ratio", "OTEL_TRACES_SAMPLER_ARG", "trace-sample-ratio", "fraction of new traces to sample, from 0 to 1", func(c *Config) interface{} { return &c.Tracing.SampleRatio }},
+	{"tracing.export_interval", "APP_TRACE_EXPORT_INTERVAL", "trace-export-interval", "how often spans are sent to the collector", func(c *Config) interface{} { return &c.Tracing.ExportInterval }},
+	{"cors.allowed_origins", "APP_CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "origins browsers may call the API from", func(c *Config) interface{} { return &c.CORS.AllowedOrigins }},
+	{"cors.allowed_methods", "APP_CORS_ALLOWED_METHODS", "cors-allowed-methods", "methods allowed in cross-origin requests", func(c *Config) interface{} { return &c.CORS.AllowedMethods }},
+	{"cors.allowed_headers", "APP_CORS_ALLOWED_HEADERS", "cors-allowed-headers", "request headers allowed in cross-origin requests", func(c *Config) interface{} { return &c.CORS.AllowedHeaders }},
+	{"cors.exposed_headers", "APP_CORS_EXPOSED_HEADERS", "cors-exposed-headers", "response headers readable by cross-origin callers", func(c *Config) interface{} { return &c.CORS.ExposedHeaders }},
+	{"cors.allow_credentials", "APP_CORS_ALLOW_CREDENTIALS", "cors-allow-credentials", "allow cookies and authorization headers in cross-origin requests", func(c *Config) interface{} { return &c.CORS.AllowCredentials }},
+	{"cors.max_age", "APP_CORS_MAX_AGE", "cors-max-age", "how long browsers may cache preflight responses", func(c *Config) interface{} { return &c.CORS.MaxAge }},
+	{"rate_limit.store", "APP_RATE_LIMIT_STORE", "rate-limit-store", "where rate limit buckets are kept: memory or postgres", func(c *Config) interface{} { return &c.RateLimit.Store }},
+	{"rate_limit.reads", "APP_RATE_LIMIT_READS", "rate-limit-reads", "read requests allowed per client, such as 300/m", func(c *Config) interface{} { return &c.RateLimit.Reads }},
+	{"rate_limit.writes", "APP_RATE_LIMIT_WRITES", "rate-limit-writes", "write requests allowed per client, such as 60/m", func(c *Config) interface{} { return &c.RateLimit.Writes }},
+	{"rate_limit.auth", "APP_RATE_LIMIT_AUTH", "rate-limit-auth", "authentication requests and invalid API keys allowed per client, such as 10/m", func(c *Config) interface{} { return &c.RateLimit.Auth }},
+	{"auth.anonymous_scopes", "APP_AUTH_ANONYMOUS_SCOPES", "auth-anonymous-scopes", "scopes of requests without an API key", func(c *Config) interface{} { return &c.Auth.AnonymousScopes }},
+	{"auth.session_scopes", "APP_AUTH_SESSION_SCOPES", "auth-session-scopes", "scopes of users logged in with single sign-on", func(c *Config) interface{} { return &c.Auth.SessionScopes }},
+	{"auth.session_ttl", "APP_AUTH_SESSION_TTL", "auth-session-ttl", "how long a login lasts", func(c *Config) interface{} { return &c.Auth.SessionTTL }},
+	{"oidc.issuer", "APP_OIDC_ISSUER", "oidc-issuer", "OpenID Connect issuer URL, enables single sign-on", func(c *Config) interface{} { return &c.OIDC.Issuer }},
+	{"oidc.client_id", "APP_OIDC_CLIENT_ID", "oidc-client-id", "client ID registered at the issuer", func(c *Config) interface{} { return &c.OIDC.ClientID }},
+	{"oidc.client_secret", "APP_OIDC_CLIENT_SECRET", "oidc-client-secret", "client secret, empty for public clients", func(c *Config) interface{} { return &c.OIDC.ClientSecret }},
+	{"oidc.redirect_url", "APP_OIDC_REDIRECT_URL", "oidc-redirect-url", "the /auth/callback URL of this server", func(c *Config) interface{} { return &c.OIDC.RedirectURL }},
+	{"oidc.scopes", "APP_OIDC_SCOPES", "oidc-scopes", "scopes requested in addition to openid", func(c *Config) interface{} { return &c.OIDC.Scopes }},
+	{"oidc.groups_claim", "APP_OIDC_GROUPS_CLAIM", "oidc-groups-claim", "ID token claim listing the groups of the user", func(c *Config) interface{} { return &c.OIDC.GroupsClaim }},
+	{"webhooks.poll_interval", "APP_WEBHOOKS_POLL_INTERVAL", "webhooks-poll-interval", "how often due webhook deliveries are sent", func(c *Config) interface{} { return &c.Webhooks.PollInterval }},
+	{"webhooks.timeout", "APP_WEBHOOKS_TIMEOUT", "webhooks-timeout", "how long a webhook receiver may take to respond", func(c *Config) interface{} { return &c.Webhooks.Timeout }},
+	{"webhooks.max_attempts", "APP_WEBHOOKS_MAX_ATTEMPTS", "webhooks-max-attempts", "attempts before a webhook delivery fails", func(c *Config) interface{} { return &c.Webhooks.MaxAttempts }},
+	{"webhooks.retry_interval", "APP_WEBHOOKS_RETRY_INTERVAL", "webhooks-retry-interval", "wait before the first retry of a webhook delivery", func(c *Config) interface{} { return &c.Webhooks.RetryInterval }},
+	{"webhooks.max_retry_interval", "APP_WEBHOOKS_MAX_RETRY_INTERVAL", "webhooks-max-retry-interval", "longest wait between webhook delivery attempts", func(c *Config) interface{} { return &c.Webhooks.MaxRetryInterval }},
+	{"webhooks.allow_private_networks", "APP_WEBHOOKS_ALLOW_PRIVATE_NETWORKS", "webhooks-allow-private-networks", "allow webhook URLs on private networks", func(c *Config) interface{} { return &c.Webhooks.AllowPrivateNetworks }},
+	{"outbox.poll_interval", "APP_OUTBOX_POLL_INTERVAL", "outbox-poll-interval", "how often unpublished events are published", func(c *Config) interface{} { return &c.Outbox.PollInterval }},
+	{"outbox.timeout", "APP_OUTBOX_TIMEOUT", "outbox-timeout", "how long an event sink may take to accept an event", func(c *Config) interface{} { return &c.Outbox.Timeout }},
+	{"outbox.retry_interval", "APP_OUTBOX_RETRY_INTERVAL", "outbox-retry-interval", "wait before publishing an event to a failed sink again", func(c *Config) interface{} { return &c.Outbox.RetryInterval }},
+	{"outbox.max_retry_interval", "APP_OUTBOX_MAX_RETRY_INTERVAL", "outbox-max-retry-interval", "longest wait between attempts to publish an event", func(c *Config) interface{} { return &c.Outbox.MaxRetryInterval }},
+	{"outbox.retention", "APP_OUTBOX_RETENTION", "outbox-retention", "how long published events are kept", func(c *Config) interface{} { return &c.Outbox.Retention }},
+	{"outbox.nats_url", "APP_OUTBOX_NATS_URL", "outbox-nats-url", "NATS server to publish events to", func(c *Config) interface{} { return &c.Outbox.NATSURL }},
+	{"outbox.nats_subject_prefix", "APP_OUTBOX_NATS_SUBJECT_PREFIX", "outbox-nats-subject-prefix", "prefix of the NATS subjects of events", func(c *Config) interface{} { return &c.Outbox.NATSSubjectPrefix }},
+	{"reminders.poll_interval", "APP_REMINDERS_POLL_INTERVAL", "reminders-poll-interval", "how often due reminders are fired", func(c *Config) interface{} { return &c.Reminders.PollInterval }},
+	{"digests.poll_interval", "APP_DIGESTS_POLL_INTERVAL", "digests-poll-interval", "how often due digests are sent", func(c *Config) interface{} { return &c.Digests.PollInterval }},
+	{"mail.smtp_addr", "APP_MAIL_SMTP_ADDR", "mail-smtp-addr", "host:port of the SMTP server, enables email notifications", func(c *Config) interface{} { return &c.Mail.SMTPAddr }},
+	{"mail.smtp_user", "APP_MAIL_SMTP_USER", "mail-smtp-user", "user to authenticate to the SMTP server as", func(c *Config) interface{} { return &c.Mail.SMTPUser }},
+	{"mail.smtp_password", "APP_MAIL_SMTP_PASSWORD", "mail-smtp-password", "password of the SMTP user", func(c *Config) interface{} { return &c.Mail.SMTPPassword }},
+	{"mail.from", "APP_MAIL_FROM", "mail-from", "sender address of emails", func(c *Config) interface{} { return &c.Mail.From }},
+	{"mail.poll_interval", "APP_MAIL_POLL_INTERVAL", "mail-poll-interval", "how often queued emails are sent", func(c *Config) interface{} { return &c.Mail.PollInterval }},
+	{"mail.timeout", "APP_MAIL_TIMEOUT", "mail-timeout", "how long the SMTP server may take to accept an email", func(c *Config) interface{} { return &c.Mail.Timeout }},
+	{"mail.max_attempts", "APP_MAIL_MAX_ATTEMPTS", "mail-max-attempts", "attempts before an email fails", func(c *Config) interface{} { return &c.Mail.MaxAttempts }},
+	{"mail.retry_interval", "APP_MAIL_RETRY_INTERVAL", "mail-retry-interval", "wait before the first retry of an email", func(c *Config) interface{} { return &c.Mail.RetryInterval }},
+	{"mail.max_retry_interval", "APP_MAIL_MAX_RETRY_INTERVAL", "mail-max-retry-interval", "longest wait between attempts to send an email", func(c *Config) interface{} { return &c.Mail.MaxRetryInterval }},
+	{"rate_limit.trusted_proxies", "APP_RATE_LIMIT_TRUSTED_PROXIES", "rate-limit-trusted-proxies", "CIDRs of proxies whose X-Forwarded-For is trusted", func(c *Config) interface{} { return &c.RateLimit.TrustedProxies }},
+}
+
+func (s setting) set(c *Config, value string) error {
+	var err error
+	switch f := s.field(c).(type) {
+	case *string:
+		*f = value
+	case *int:
+		*f, err = strconv.Atoi(value)
+	case *float64:
+		*f, err = strconv.ParseFloat(value, 64)
+	case *bool:
+		*f, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*f, err = time.ParseDuration(value)
+	case *rateLimit:
+		*f, err = parseRateLimit(value)
+	case *[]string:
+		*f = nil
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*f = append(*f, v)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s", value, s.key)
+	}
+	return nil
+}
+
+// loadConfigFile applies a TOML file to c. Only the subset needed here is
+// understood: [section] headers and key = value pairs with string, integer,
+// float, boolean or single-line string array values.
+func (c *Config) loadConfigFile(r io.Reader) error {
+	byKey := map[string]setting{}
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
+
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(parts[0])
+		if section != "" {
+			key = section + "." + key
+		}
+		value := strings.TrimSpace(parts[1])
+		if strings.HasPrefix(value, "[") {
+			list, err := parseStringArray(value)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", n, err)
+			}
+			value = list
+		} else if strings.HasPrefix(value, `"`) {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid string %s", n, value)
+			}
+			value = unquoted
+		} else if i := strings.Index(value, "#"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+
+		s, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("line %d: unknown setting %s", n, key)
+		}
+		if err := s.set(c, value); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseStringArray turns ["a", "b"] into the comma separated list a,b.
+func parseStringArray(value string) (string, error) {
+	end := strings.LastIndex(value, "]")
+	if end < 0 {
+		return "", fmt.Errorf("invalid array %s", value)
+	}
+	if rest := strings.TrimSpace(value[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("invalid array %s", value)
+	}
+	items := []string{}
+	for _, item := range strings.Split(value[1:end], ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		unquoted, err := strconv.Unquote(item)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s in array", item)
+		}
+		items = append(items, unquoted)
+	}
+	return strings.Join(items, ","), nil
+}
+
+func (c *Config) loadEnv() error {
+	for _, s := range settings {
+		// set but empty is a value too, the empty list for list settings
+		v, ok := os.LookupEnv(s.env)
+		if !ok {
+			continue
+		}
+		// PORT has historically been given as a bare port or ":port"
+		if s.env == "PORT" && v != "" && !strings.Contains(v, ":") {
+			v = ":" + v
+		}
+		if err := s.set(c, v); err != nil {
+			return fmt.Errorf("%s: %v", s.env, err)
+		}
+	}
+	return nil
+}
+
+// configFlags registers a flag for every setting on fs. After parsing, load
+// builds the Config with the flags that were given applied last.
+type configFlags struct {
+	fs     *flag.FlagSet
+	file   *string
+	values map[string]*string
+}
+
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	cf := &configFlags{
+		fs:     fs,
+		file:   fs.String("config", os.Getenv("APP_CONFIG_FILE"), "TOML config file (APP_CONFIG_FILE)"),
+		values: map[string]*string{},
+	}
+	for _, s := range settings {
+		cf.values[s.flag] = fs.String(s.flag, "", fmt.Sprintf("%s (%s)", s.usage, s.env))
+	}
+	return cf
+}
+
+// load builds the Config from all layers and validates it.
+func (cf *configFlags) load() (Config, error) {
+	cfg := defaultConfig()
+
+	if *cf.file != "" {
+		f, err := os.Open(*cf.file)
+		if err != nil {
+			return cfg, err
+		}
+		defer f.Close()
+		if err := cfg.loadConfigFile(f); err != nil {
+			return cfg, fmt.Errorf("%s: %v", *cf.file, err)
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return cfg, err
+	}
+
+	var err error
+	cf.fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				err = s.set(&cfg, *cf.values[s.flag])
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	if errs := cfg.validate(); len(errs) > 0 {
+		return cfg, fmt.Errorf("invalid configuration: %v", errs)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() validationErrors {
+	var errs validationErrors
+	errs.required("server.addr", c.Server.Addr)
+	errs.nonNegative("server.read_timeout", c.Server.ReadTimeout)
+	errs.nonNegative("server.read_header_timeout", c.Server.ReadHeaderTimeout)
+	errs.nonNegative("server.write_timeout", c.Server.WriteTimeout)
+	errs.nonNegative("server.idle_timeout", c.Server.IdleTimeout)
+	errs.nonNegative("server.request_timeout", c.Server.RequestTimeout)
+	errs.nonNegative("server.drain_delay", c.Server.DrainDelay)
+	errs.nonNegative("server.shutdown_timeout", c.Server.ShutdownTimeout)
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		errs.add("server.tls_cert_file", "must be given together with server.tls_key_file")
+	}
+
+	d := c.Database
+	if d.DSN == "" {
+		errs.required("database.host", d.Host)
+		errs.required("database.name", d.Name)
+		if d.Port < 1 || d.Port > 65535 {
+			errs.add("database.port", "must be between 1 and 65535")
+		}
+		errs.oneOf("database.sslmode", d.SSLMode, sslModes)
+		if (d.SSLMode == "verify-ca" || d.SSLMode == "verify-full") && d.SSLRootCert == "" {
+			errs.add("database.sslrootcert", "is required for sslmode "+d.SSLMode)
+		}
+	}
+	errs.min("database.max_open_conns", d.MaxOpenConns, 0)
+	errs.min("database.max_idle_conns", d.MaxIdleConns, 0)
+	errs.nonNegative("database.connect_timeout", d.ConnectTimeout)
+	errs.nonNegative("database.conn_max_lifetime", d.ConnMaxLifetime)
+	errs.nonNegative("database.conn_max_idle_time", d.ConnMaxIdleTime)
+	errs.nonNegative("database.query_timeout", d.QueryTimeout)
+
+	errs.oneOf("log.level", c.Log.Level, logLevelNames)
+
+	if c.CORS.AllowCredentials && containsString(c.CORS.AllowedOrigins, "*") {
+		errs.add("cors.allowed_origins", "must list origins explicitly when credentials are allowed")
+	}
+	errs.nonNegative("cors.max_age", c.CORS.MaxAge)
+
+	errs.oneOf("rate_limit.store", c.RateLimit.Store, rateLimitStores)
+	if _, err := c.RateLimit.trustedNetworks(); err != nil {
+		errs.add("rate_limit.trusted_proxies", err.Error())
+	}
+
+	for _, s := range c.Auth.AnonymousScopes {
+		errs.oneOf("auth.anonymous_scopes", s, allScopes)
+	}
+	for _, s := range c.Auth.SessionScopes {
+		errs.oneOf("auth.session_scopes", s, allScopes)
+	}
+	if c.Auth.SessionTTL <= 0 {
+		errs.add("auth.session_ttl", "must be positive")
+	}
+
+	if o := c.OIDC; o.Issuer != "" {
+		if !isHTTPURL(o.Issuer) {
+			errs.add("oidc.issuer", "must be an http or https URL")
+		}
+		errs.required("oidc.client_id", o.ClientID)
+		if !isHTTPURL(o.RedirectURL) {
+			errs.add("oidc.redirect_url", "must be an http or https URL")
+		}
+		errs.required("oidc.groups_claim", o.GroupsClaim)
+	}
+
+	wh := c.Webhooks
+	if wh.PollInterval <= 0 {
+		errs.add("webhooks.poll_interval", "must be positive")
+	}
+	if wh.Timeout <= 0 {
+		errs.add("webhooks.timeout", "must be positive")
+	}
+	errs.min("webhooks.max_attempts", wh.MaxAttempts, 1)
+	if wh.RetryInterval <= 0 {
+		errs.add("webhooks.retry_interval", "must be positive")
+	}
+	if wh.MaxRetryInterval < wh.RetryInterval {
+		errs.add("webhooks.max_retry_interval", "must not be less than webhooks.retry_interval")
+	}
+
+	ob := c.Outbox
+	if ob.PollInterval <= 0 {
+		errs.add("outbox.poll_interval", "must be positive")
+	}
+	if ob.Timeout <= 0 {
+		errs.add("outbox.timeout", "must be positive")
+	}
+	if ob.RetryInterval <= 0 {
+		errs.add("outbox.retry_interval", "must be positive")
+	}
+	if ob.MaxRetryInterval < ob.RetryInterval {
+		errs.add("outbox.max_retry_interval", "must not be less than outbox.retry_interval")
+	}
+	if ob.Retention <= 0 {
+		errs.add("outbox.retention", "must be positive")
+	}
+	if ob.NATSURL != "" {
+		if _, err := newNATSConn(ob.NATSURL); err != nil {
+			errs.add("outbox.nats_url", err.Error())
+		}
+		errs.required("outbox.nats_subject_prefix", ob.NATSSubjectPrefix)
+	}
+
+	if c.Reminders.PollInterval <= 0 {
+		errs.add("reminders.poll_interval", "must be positive")
+	}
+	if c.Digests.PollInterval <= 0 {
+		errs.add("digests.poll_interval", "must be positive")
+	}
+
+	if m := c.Mail; m.enabled() {
+		if _, _, err := net.SplitHostPort(m.SMTPAddr); err != nil {
+			errs.add("mail.smtp_addr", "must be host:port")
+		}
+		if !validEmailAddress(m.From) {
+			errs.add("mail.from", "must be an email address")
+		}
+		if m.PollInterval <= 0 {
+			errs.add("mail.poll_interval", "must be positive")
+		}
+		if m.Timeout <= 0 {
+			errs.add("mail.timeout", "must be positive")
+		}
+		errs.min("mail.max_attempts", m.MaxAttempts, 1)
+		if m.RetryInterval <= 0 {
+			errs.add("mail.retry_interval", "must be positive")
+		}
+		if m.MaxRetryInterval < m.RetryInterval {
+			errs.add("mail.max_retry_interval", "must not be less than mail.retry_interval")
+		}
+	}
+
+	t := c.Tracing
+	if t.Endpoint != "" {
+		if !isHTTPURL(t.Endpoint) {
+			errs.add("tracing.endpoint", "must be an http or https URL")
+		}
+		errs.required("tracing.service_name", t.ServiceName)
+		if t.ExportInterval <= 0 {
+			errs.add("tracing.export_interval", "must be positive")
+		}
+	}
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		errs.add("tracing.sample_ratio", "must be between 0 and 1")
+	}
+	return errs
+}
+
+// connectionString returns the DSN, or builds a key/value connection string
+// from the individual settings.
+func (d DatabaseConfig) connectionString() string {
+	if d.DSN != "" {
+		return d.DSN
+	}
+
+	quote := func(v string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+	}
+	parts := []string{
+		"host=" + quote(d.Host),
+		"port=" + strconv.Itoa(d.Port),
+		"dbname=" + quote(d.Name),
+		"sslmode=" + quote(d.SSLMode),
+	}
+	if d.User != "" {
+		parts = append(parts, "user="+quote(d.User))
+	}
+	if d.Password != "" {
+		parts = append(parts, "password="+quote(d.Password))
+	}
+	if d.SSLRootCert != "" {
+		parts = append(parts, "sslrootcert="+quote(d.SSLRootCert))
+	}
+	if d.ConnectTimeout > 0 {
+		parts = append(parts, "connect_timeout="+strconv.Itoa(int(math.Ceil(d.ConnectTimeout.Seconds()))))
+	}
+	return strings.Join(parts, " ")
+}
+
+var rateLimitStores = []string{"memory", "postgres"}
+
+// limit is the limit of a group of routes, see rateLimitGroup.
+func (c RateLimitConfig) limit(group string) rateLimit {
+	switch group {
+	case "auth":
+		return c.Auth
+	case "writes":
+		return c.Writes
+	default:
+		return c.Reads
+	}
+}
+
+// longestPeriod is after how long any bucket is full again.
+func (c RateLimitConfig) longestPeriod() time.Duration {
+	longest := c.Reads.Period
+	for _, l := range []rateLimit{c.Writes, c.Auth} {
+		if l.Period > longest {
+			longest = l.Period
+		}
+	}
+	return longest
+}
+
+// trustedNetworks parses TrustedProxies. Single addresses are accepted as
+// well as CIDRs.
+func (c RateLimitConfig) trustedNetworks() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, p := range c.TrustedProxies {
+		cidr := p
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", p)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// scopes are the scopes requested at login, always including openid.
+func (c OIDCConfig) scopes() []string {
+	scopes := []string{"openid"}
+	for _, s := range c.Scopes {
+		if !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
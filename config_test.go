@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigLayers(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "scheduler-config")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.toml")
+	ioutil.WriteFile(file, []byte(`
+[database]
+host = "file-host"
+name = "file-db"
+max_open_conns = 10 # comment
+conn_max_lifetime = "1h"
+`), 0600)
+
+	os.Setenv("APP_DB_NAME", "env-db")
+	defer os.Unsetenv("APP_DB_NAME")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cf := addConfigFlags(fs)
+	fs.Parse([]string{"-config", file, "-db-host", "flag-host"})
+
+	cfg, err := cf.load()
+	if err != nil {
+		t.Fatalf("Could not load config. Error: %v", err)
+	}
+	if cfg.Database.Host != "flag-host" {
+		t.Errorf("Expected flags to override the file. Got host %s", cfg.Database.Host)
+	}
+	if cfg.Database.Name != "env-db" {
+		t.Errorf("Expected env to override the file. Got name %s", cfg.Database.Name)
+	}
+	if cfg.Database.MaxOpenConns != 10 || cfg.Database.ConnMaxLifetime != time.Hour {
+		t.Errorf("Expected file values to be applied. Got %+v", cfg.Database)
+	}
+	if cfg.Database.Port != 5432 {
+		t.Errorf("Expected default port 5432. Got %v", cfg.Database.Port)
+	}
+}
+
+func TestConfigFileArrays(t *testing.T) {
+	cfg := defaultConfig()
+	err := cfg.loadConfigFile(strings.NewReader(`
+[cors]
+allowed_origins = ["https://a.example.com", "https://b.example.com"] # comment
+allowed_headers = []
+`))
+	if err != nil {
+		t.Fatalf("Could not load config. Error: %v", err)
+	}
+	if got := strings.Join(cfg.CORS.AllowedOrigins, " "); got != "https://a.example.com https://b.example.com" {
+		t.Errorf("Expected two allowed origins. Got %v", cfg.CORS.AllowedOrigins)
+	}
+	if len(cfg.CORS.AllowedHeaders) != 0 {
+		t.Errorf("Expected no allowed headers. Got %v", cfg.CORS.AllowedHeaders)
+	}
+}
+
+func TestConfigEnvEmptyList(t *testing.T) {
+	os.Setenv("APP_AUTH_ANONYMOUS_SCOPES", "")
+	defer os.Unsetenv("APP_AUTH_ANONYMOUS_SCOPES")
+
+	cfg := defaultConfig()
+	if err := cfg.loadEnv(); err != nil {
+		t.Fatalf("Could not load config. Error: %v", err)
+	}
+	if len(cfg.Auth.AnonymousScopes) != 0 {
+		t.Errorf("Expected anonymous requests to have no scopes. Got %v", cfg.Auth.AnonymousScopes)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Database.SSLMode = "sometimes"
+	cfg.Database.Port = 0
+
+	errs := cfg.validate()
+	if len(errs) != 2 {
+		t.Errorf("Expected errors for sslmode and port. Got %v", errs)
+	}
+}
+
+func TestTracingConfigValidation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Tracing.Endpoint = "localhost:4318"
+	cfg.Tracing.SampleRatio = 1.5
+
+	errs := cfg.validate()
+	if len(errs) != 2 || errs[0].Field != "tracing.endpoint" || errs[1].Field != "tracing.sample_ratio" {
+		t.Errorf("Expected errors for endpoint and sample ratio. Got %v", errs)
+	}
+}
+
+func TestOIDCConfigValidation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OIDC.Issuer = "https://login.example.com"
+	cfg.OIDC.RedirectURL = "/auth/callback"
+
+	errs := cfg.validate()
+	if len(errs) != 2 || errs[0].Field != "oidc.client_id" || errs[1].Field != "oidc.redirect_url" {
+		t.Errorf("Expected errors for client ID and redirect URL. Got %v", errs)
+	}
+	if scopes := cfg.OIDC.scopes(); strings.Join(scopes, " ") != "openid email profile" {
+		t.Errorf("Expected openid to be requested first. Got %v", scopes)
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.loadConfigFile(strings.NewReader(`
+[rate_limit]
+store = "postgres"
+writes = "20/s"
+auth = 0
+trusted_proxies = ["10.0.0.0/8", "not-an-ip"]
+`)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateLimit.Writes != (rateLimit{Requests: 20, Period: time.Second}) || !cfg.RateLimit.Auth.unlimited() {
+		t.Errorf("Expected writes 20/s and no auth limit. Got %v and %v", cfg.RateLimit.Writes, cfg.RateLimit.Auth)
+	}
+	errs := cfg.validate()
+	if len(errs) != 1 || errs[0].Field != "rate_limit.trusted_proxies" {
+		t.Errorf("Expected an error for trusted proxies. Got %v", errs)
+	}
+}
+
+func TestConnectionString(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Database.User = "app"
+	cfg.Database.Password = "it's secret"
+
+	dsn := cfg.Database.connectionString()
+	if !strings.Contains(dsn, `password='it\'s secret'`) {
+		t.Errorf("Expected the password to be quoted. Got %s", dsn)
+	}
+
+	cfg.Database.DSN = "postgres://localhost/scheduler"
+	if dsn := cfg.Database.connectionString(); dsn != cfg.Database.DSN {
+		t.Errorf("Expected the DSN to be used as is. Got %s", dsn)
+	}
+}
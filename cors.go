@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// cors adds the CORS headers for allowed origins to every response and
+// answers preflight requests, see
+// https://fetch.spec.whatwg.org/#http-cors-protocol
+func (a *App) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cfg := a.Config.CORS
+		origin := req.Header.Get("Origin")
+		h := w.Header()
+		h.Add("Vary", "Origin")
+
+		preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || !cfg.allowsOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if cfg.allowsAnyOrigin() && !cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(cfg.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
+		if containsString(cfg.AllowedHeaders, "*") {
+			if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				h.Set("Access-Control-Allow-Headers", requested)
+			}
+		} else if len(cfg.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+		}
+		if cfg.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// preflight answers OPTIONS requests for any path, so that the cors
+// middleware runs for them. Plain OPTIONS requests get an empty response.
+func (a *App) preflight(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c CORSConfig) allowsAnyOrigin() bool {
+	return containsString(c.AllowedOrigins, "*")
+}
+
+// allowsOrigin matches origin against the allowed origins, which may contain
+// one wildcard, such as https://*.example.com.
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if i := strings.Index(allowed, "*"); i >= 0 {
+			prefix, suffix := strings.ToLower(allowed[:i]), strings.ToLower(allowed[i+1:])
+			o := strings.ToLower(origin)
+			if len(o) > len(prefix)+len(suffix) && strings.HasPrefix(o, prefix) && strings.HasSuffix(o, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
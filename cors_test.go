@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func useCORS(t *testing.T, cfg CORSConfig) {
+	previous := a.Config.CORS
+	a.Config.CORS = cfg
+	t.Cleanup(func() { a.Config.CORS = previous })
+}
+
+func TestPreflight(t *testing.T) {
+	useCORS(t, CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowedMethods:   []string{"GET", "PUT"},
+		AllowedHeaders:   []string{"Content-Type"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+
+	req, _ := http.NewRequest("OPTIONS", "/category/b119178b-2fd2-4a5c-9301-190c341df180", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNoContent, response.Code)
+
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "Content-Type",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+	} {
+		if got := response.Header().Get(header); got != want {
+			t.Errorf("Expected %s to be %q. Got %q", header, want, got)
+		}
+	}
+}
+
+func TestPreflightFromUnknownOrigin(t *testing.T) {
+	useCORS(t, CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowedMethods: []string{"GET"}})
+
+	req, _ := http.NewRequest("OPTIONS", "/categories", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	response := executeRequest(req)
+
+	if got := response.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Expected no Access-Control-Allow-Origin header. Got %q", got)
+	}
+}
+
+func TestCORSHeadersOnRequest(t *testing.T) {
+	clearTables()
+	useCORS(t, CORSConfig{
+		AllowedOrigins: []string{"https://*.example.com"},
+		ExposedHeaders: []string{"X-Request-ID"},
+	})
+
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Origin", "https://staging.example.com")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if got := response.Header().Get("Access-Control-Allow-Origin"); got != "https://staging.example.com" {
+		t.Errorf("Expected the origin to be allowed by the wildcard. Got %q", got)
+	}
+	if got := response.Header().Get("Access-Control-Expose-Headers"); got != "X-Request-ID" {
+		t.Errorf("Expected exposed headers. Got %q", got)
+	}
+	if got := response.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("Expected Vary: Origin. Got %q", got)
+	}
+}
+
+func TestAllowedOriginPatterns(t *testing.T) {
+	cfg := CORSConfig{AllowedOrigins: []string{"https://*.example.com", "http://localhost:3000"}}
+	for origin, want := range map[string]bool{
+		"https://app.example.com":   true,
+		"https://APP.example.com":   true,
+		"https://example.com":       false,
+		"https://app.example.org":   false,
+		"http://app.example.com":    false,
+		"http://localhost:3000":     true,
+		"http://localhost:3001":     false,
+		"https://.example.com.evil": false,
+	} {
+		if got := cfg.allowsOrigin(origin); got != want {
+			t.Errorf("allowsOrigin(%q) = %v, expected %v", origin, got, want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// instrumentedConnector wraps a database driver so that every query, inside a
+// transaction or not, is counted, timed, traced and given a deadline without
+// the models knowing.
+type instrumentedConnector struct {
+	driver.Connector
+	metrics *metrics
+	tracer  *tracer
+	// 0 for no deadline besides the one of the caller's context
+	queryTimeout time.Duration
+}
+
+func (c instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn, metrics: c.metrics, tracer: c.tracer, queryTimeout: c.queryTimeout}, nil
+}
+
+type instrumentedConn struct {
+	driver.Conn
+	metrics      *metrics
+	tracer       *tracer
+	queryTimeout time.Duration
+}
+
+func (c *instrumentedConn) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.queryTimeout)
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, cancel := c.withQueryTimeout(ctx)
+	ctx, s := c.startQuerySpan(ctx, query)
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	c.metrics.observeQuery(ctx, query, time.Since(start), err)
+	finishQuerySpan(s, err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the deadline also covers reading the rows
+	return &timeoutRows{Rows: rows, cancel: cancel}, nil
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, cancel := c.withQueryTimeout(ctx)
+	defer cancel()
+	ctx, s := c.startQuerySpan(ctx, query)
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	c.metrics.observeQuery(ctx, query, time.Since(start), err)
+	finishQuerySpan(s, err)
+	return res, err
+}
+
+// timeoutRows releases the query deadline once the rows are closed.
+type timeoutRows struct {
+	driver.Rows
+	cancel context.CancelFunc
+}
+
+func (r *timeoutRows) Close() error {
+	err := r.Rows.Close()
+	r.cancel()
+	return err
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// startQuerySpan traces a query if it runs on behalf of a traced request or
+// job. Queries without a parent span, such as migrations, are not traced.
+func (c *instrumentedConn) startQuerySpan(ctx context.Context, query string) (context.Context, *span) {
+	if spanFrom(ctx) == nil {
+		return ctx, nil
+	}
+	operation, table := queryLabels(query)
+	return c.tracer.start(ctx, operation+" "+table, spanKindClient,
+		"db.system", "postgresql",
+		"db.operation", operation,
+		"db.sql.table", table,
+		"db.statement", strings.Join(strings.Fields(query), " "),
+	)
+}
+
+func finishQuerySpan(s *span, err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.fail(err.Error())
+	}
+	s.finish()
+}
+
+func (m *metrics) observeQuery(ctx context.Context, query string, d time.Duration, err error) {
+	operation, table := queryLabels(query)
+	if l := loggerFrom(ctx); l.level() <= levelDebug {
+		l.debug("query", "operation", operation, "table", table, "duration_ms", float64(d.Microseconds())/1000, "error", err)
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	m.queries.inc(operation, table, outcome)
+	m.queryDuration.observe(d.Seconds(), operation, table)
+}
+
+var queryTablePattern = regexp.MustCompile(`(?i)\b(?:from|into|update|join)\s+"?(\w+)`)
+
+// the queries are constants, so the labels are computed once per statement
+var queryLabelCache sync.Map
+
+// queryLabels reduces a statement to its operation and first table, such as
+// "select" and "tasks", to keep the number of series small.
+func queryLabels(query string) (string, string) {
+	if labels, ok := queryLabelCache.Load(query); ok {
+		l := labels.([2]string)
+		return l[0], l[1]
+	}
+
+	operation, table := "other", "none"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		operation = strings.ToLower(fields[0])
+	}
+	if m := queryTablePattern.FindStringSubmatch(query); m != nil {
+		table = strings.ToLower(m[1])
+	}
+	queryLabelCache.Store(query, [2]string{operation, table})
+	return operation, table
+}
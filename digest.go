@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// how often digests are sent
+const (
+	// every working day
+	digestDaily = "daily"
+	// on the first working day of every week, weeks starting on Monday
+	digestWeekly = "weekly"
+)
+
+var digestFrequencies = []string{digestDaily, digestWeekly}
+
+// weekdays is indexed by time.Weekday.
+var weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+var defaultWorkingDays = []string{"monday", "tuesday", "wednesday", "thursday", "friday"}
+
+const (
+	defaultDigestSendTime = "08:00"
+	digestBatch           = 20
+	// tasks listed per section, the rest are only counted
+	maxDigestTasks = 50
+)
+
+//go:embed templates/digest.*
+var digestTemplates embed.FS
+
+var (
+	digestText = texttemplate.Must(texttemplate.ParseFS(digestTemplates, "templates/digest.txt"))
+	digestHTML = htmltemplate.Must(htmltemplate.ParseFS(digestTemplates, "templates/digest.html"))
+)
+
+// digestSubscription has a user emailed the overdue, due and recently
+// completed tasks of the categories they can see in a workspace.
+type digestSubscription struct {
+	Frequency string `json:"frequency"`
+	// local HH:MM the digest is sent at
+	Send_Time    string    `json:"send_time"`
+	Time_Zone    string    `json:"time_zone"`
+	Working_Days []string  `json:"working_days"`
+	Next_Send_At time.Time `json:"next_send_at"`
+	// when the last digest was due, whether it was sent or left out for
+	// being empty
+	Last_Digest_At *time.Time `json:"last_digest_at,omitempty"`
+	Created_At     time.Time  `json:"created_at"`
+}
+
+type digestInput struct {
+	Send_Time    string   `json:"send_time"`
+	Time_Zone    string   `json:"time_zone"`
+	Working_Days []string `json:"working_days"`
+}
+
+var (
+	errDigestNotFound     = notFoundError("digest_not_found", "Digest subscription not found")
+	errDigestRequiresUser = forbiddenError("user_required", "Only users can subscribe to digests")
+	errMailDisabled       = notFoundError("mail_disabled", "Email is not enabled on this server")
+)
+
+func (in digestInput) validate() validationErrors {
+	var errs validationErrors
+	if t, err := time.Parse("15:04", in.Send_Time); err != nil || t.Format("15:04") != in.Send_Time {
+		errs.add("send_time", "must be a time of day such as 08:00")
+	}
+	if _, err := time.LoadLocation(in.Time_Zone); err != nil || in.Time_Zone == "" || in.Time_Zone == "Local" {
+		errs.add("time_zone", "must be an IANA time zone such as Europe/Berlin")
+	}
+	if len(in.Working_Days) == 0 {
+		errs.add("working_days", "must have at least one day")
+	}
+	for _, d := range in.Working_Days {
+		errs.oneOf("working_days", d, weekdays)
+	}
+	return errs
+}
+
+// subscription is the subscription to in, with the working days in the
+// order of the week.
+func (in digestInput) subscription(frequency string) digestSubscription {
+	s := digestSubscription{Frequency: frequency, Send_Time: in.Send_Time, Time_Zone: in.Time_Zone}
+	for _, d := range weekdays {
+		if containsString(in.Working_Days, d) {
+			s.Working_Days = append(s.Working_Days, d)
+		}
+	}
+	return s
+}
+
+// next is the first time a digest is due after after.
+func (s digestSubscription) next(after time.Time) time.Time {
+	loc, err := time.LoadLocation(s.Time_Zone)
+	if err != nil {
+		loc = time.UTC
+	}
+	clock, _ := time.Parse("15:04", s.Send_Time)
+	local := after.In(loc)
+	// two weeks cover every weekly digest, even one due later today
+	for i := 0; i <= 14; i++ {
+		t := time.Date(local.Year(), local.Month(), local.Day()+i, clock.Hour(), clock.Minute(), 0, 0, loc)
+		if t.After(after) && s.sendsOn(t.Weekday()) {
+			return t
+		}
+	}
+	// only without working days, which validate refuses
+	return after.AddDate(0, 0, 7)
+}
+
+func (s digestSubscription) sendsOn(day time.Weekday) bool {
+	if s.Frequency == digestWeekly {
+		for _, d := range []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday} {
+			if containsString(s.Working_Days, weekdays[d]) {
+				return d == day
+			}
+		}
+		return false
+	}
+	return containsString(s.Working_Days, weekdays[day])
+}
+
+// Subscriptions belong to the user of ctx in the workspace of ctx.
+
+const digestColumns = "frequency, send_time, time_zone, working_days, next_send_at, last_digest_at, created_at"
+
+func (s *digestSubscription) scan(row rowScanner) error {
+	var lastDigestAt sql.NullTime
+	err := row.Scan(&s.Frequency, &s.Send_Time, &s.Time_Zone, pq.Array(&s.Working_Days), &s.Next_Send_At, &lastDigestAt, &s.Created_At)
+	if err != nil {
+		return err
+	}
+	s.Last_Digest_At = nullTime(lastDigestAt)
+	return nil
+}
+
+// subscribe creates the subscription or replaces its settings, keeping when
+// the last digest was due so completed tasks are not listed twice.
+func (s *digestSubscription) subscribe(ctx context.Context, db queryer) error {
+	err := s.scan(db.QueryRowContext(ctx,
+		`INSERT INTO digest_subscriptions(user_id, workspace_id, frequency, send_time, time_zone, working_days, next_send_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id, workspace_id, frequency) DO UPDATE SET send_time=EXCLUDED.send_time,
+			time_zone=EXCLUDED.time_zone, working_days=EXCLUDED.working_days, next_send_at=EXCLUDED.next_send_at
+		RETURNING `+digestColumns,
+		principalFrom(ctx).userId, workspaceFrom(ctx).id, s.Frequency, s.Send_Time, s.Time_Zone,
+		pq.Array(s.Working_Days), s.Next_Send_At,
+	))
+	return dbError(err)
+}
+
+func (s *digestSubscription) unsubscribe(ctx context.Context, db queryer) error {
+	res, err := db.ExecContext(ctx,
+		"DELETE FROM digest_subscriptions WHERE user_id=$1 AND workspace_id=$2 AND frequency=$3",
+		principalFrom(ctx).userId, workspaceFrom(ctx).id, s.Frequency,
+	)
+	return affectedOrNotFound(res, err, errDigestNotFound)
+}
+
+func getDigestSubscriptions(ctx context.Context, db queryer) ([]digestSubscription, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+digestColumns+` FROM digest_subscriptions WHERE user_id=$1 AND workspace_id=$2
+		ORDER BY frequency`,
+		principalFrom(ctx).userId, workspaceFrom(ctx).id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []digestSubscription{}
+	for rows.Next() {
+		var s digestSubscription
+		if err := s.scan(rows); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+// dueDigest is a due subscription with who and where it is for.
+type dueDigest struct {
+	digestSubscription
+	userId      string
+	email       string
+	name        string
+	workspaceId string
+	workspace   string
+}
+
+// digest is what the templates render.
+type digest struct {
+	Subject   string
+	Name      string
+	Frequency string
+	Workspace string
+	Date      string
+	Sections  []digestSection
+}
+
+type digestSection struct {
+	Title string
+	Tasks []digestTask
+	// tasks left out beyond maxDigestTasks
+	More int
+}
+
+type digestTask struct {
+	Task     string
+	Category string
+	// when it is due or was completed
+	When string
+}
+
+func (s *digestSection) add(t digestTask) {
+	if len(s.Tasks) < maxDigestTasks {
+		s.Tasks = append(s.Tasks, t)
+	} else {
+		s.More++
+	}
+}
+
+// compileDigest lists the tasks of d at now: the ones that were due before
+// today, the ones due today or, for weekly digests, in the coming week, and
+// the ones completed since the last digest. Days are those of the time zone
+// of d. Users see the categories shared with them, admins all categories of
+// the workspace.
+func compileDigest(ctx context.Context, db queryer, d dueDigest, now time.Time) (digest, error) {
+	loc, err := time.LoadLocation(d.Time_Zone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	days, dueTitle := 1, "Due today"
+	if d.Frequency == digestWeekly {
+		days, dueTitle = 7, "Due in the coming week"
+	}
+	end := today.AddDate(0, 0, days)
+	since := now.AddDate(0, 0, -days)
+	if d.Last_Digest_At != nil {
+		since = *d.Last_Digest_At
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`SELECT t.task, c.name, t.complete, t.due_at, t.completed_at
+		FROM tasks t JOIN categories c ON c.category_id = t.category_id
+		WHERE c.workspace_id=$1
+		AND (EXISTS (SELECT 1 FROM workspace_members m WHERE m.workspace_id=$1 AND m.user_id=$2 AND m.role=$3)
+			OR EXISTS (SELECT 1 FROM category_shares s WHERE s.category_id = c.category_id AND s.user_id=$2))
+		AND ((NOT t.complete AND t.due_at < $4) OR (t.complete AND t.completed_at >= $5))
+		ORDER BY COALESCE(t.due_at, t.completed_at), t.task_id`,
+		d.workspaceId, d.userId, workspaceRoleAdmin, end, since,
+	)
+	if err != nil {
+		return digest{}, err
+	}
+	defer rows.Close()
+
+	overdue := digestSection{Title: "Overdue"}
+	due := digestSection{Title: dueTitle}
+	completed := digestSection{Title: "Completed since the last digest"}
+	for rows.Next() {
+		var t digestTask
+		var complete bool
+		var dueAt, completedAt sql.NullTime
+		if err := rows.Scan(&t.Task, &t.Category, &complete, &dueAt, &completedAt); err != nil {
+			return digest{}, err
+		}
+		switch {
+		case complete:
+			t.When = "completed " + completedAt.Time.In(loc).Format("Mon, 02 Jan 15:04")
+			completed.add(t)
+		case dueAt.Time.Before(today):
+			t.When = "due " + dueAt.Time.In(loc).Format("Mon, 02 Jan 15:04")
+			overdue.add(t)
+		default:
+			t.When = "due " + dueAt.Time.In(loc).Format("Mon, 02 Jan 15:04")
+			due.add(t)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return digest{}, err
+	}
+
+	dg := digest{
+		Name:      d.name,
+		Frequency: d.Frequency,
+		Workspace: d.workspace,
+		Date:      local.Format("Mon, 02 Jan 2006"),
+	}
+	dg.Subject = fmt.Sprintf("Your %s digest for %s", dg.Frequency, dg.Date)
+	for _, s := range []digestSection{overdue, due, completed} {
+		if len(s.Tasks) > 0 {
+			dg.Sections = append(dg.Sections, s)
+		}
+	}
+	return dg, nil
+}
+
+// message renders the digest as email to to.
+func (dg digest) message(to string) (mailMessage, error) {
+	var text, html bytes.Buffer
+	if err := digestText.Execute(&text, dg); err != nil {
+		return mailMessage{}, err
+	}
+	if err := digestHTML.Execute(&html, dg); err != nil {
+		return mailMessage{}, err
+	}
+	return mailMessage{to: to, subject: dg.Subject, text: text.String(), html: html.String()}, nil
+}
+
+// digestSender queues the due digests for mailSender, see sendDue.
+type digestSender struct {
+	db      *sql.DB
+	metrics *metrics
+}
+
+func newDigestSender(db *sql.DB, m *metrics) *digestSender {
+	return &digestSender{db: db, metrics: m}
+}
+
+// sendDue queues every due digest. Like reminders, each batch is locked,
+// queued and scheduled again in one transaction, so instances running it at
+// once skip each other's digests and every digest is sent once. Empty
+// digests are not sent.
+func (s *digestSender) sendDue(ctx context.Context) error {
+	for {
+		var due int
+		err := inTransaction(ctx, s.db, func(tx *sql.Tx) error {
+			digests, err := s.lockDue(ctx, tx)
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			for _, d := range digests {
+				dg, err := compileDigest(ctx, tx, d, now)
+				if err != nil {
+					return fmt.Errorf("digest of user %s: %w", d.userId, err)
+				}
+				if len(dg.Sections) > 0 {
+					m, err := dg.message(d.email)
+					if err != nil {
+						return err
+					}
+					if err := queueEmail(ctx, tx, m); err != nil {
+						return err
+					}
+					s.metrics.digestsSent.inc(d.Frequency)
+				}
+				_, err = tx.ExecContext(ctx,
+					`UPDATE digest_subscriptions SET next_send_at=$4, last_digest_at=$5
+					WHERE user_id=$1 AND workspace_id=$2 AND frequency=$3`,
+					d.userId, d.workspaceId, d.Frequency, d.next(now), now,
+				)
+				if err != nil {
+					return err
+				}
+			}
+			due = len(digests)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if due < digestBatch || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (s *digestSender) lockDue(ctx context.Context, tx *sql.Tx) ([]dueDigest, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT s.frequency, s.send_time, s.time_zone, s.working_days, s.next_send_at, s.last_digest_at, s.created_at,
+			s.user_id, u.email, u.name, s.workspace_id, w.name
+		FROM digest_subscriptions s JOIN users u ON u.user_id = s.user_id
+		JOIN workspaces w ON w.workspace_id = s.workspace_id
+		WHERE s.next_send_at <= now()
+		ORDER BY s.next_send_at LIMIT $1
+		FOR UPDATE OF s SKIP LOCKED`,
+		digestBatch,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []dueDigest
+	for rows.Next() {
+		var d dueDigest
+		var lastDigestAt sql.NullTime
+		err := rows.Scan(&d.Frequency, &d.Send_Time, &d.Time_Zone, pq.Array(&d.Working_Days), &d.Next_Send_At,
+			&lastDigestAt, &d.Created_At, &d.userId, &d.email, &d.name, &d.workspaceId, &d.workspace)
+		if err != nil {
+			return nil, err
+		}
+		d.Last_Digest_At = nullTime(lastDigestAt)
+		due = append(due, d)
+	}
+	return due, rows.Err()
+}
+
+func (a *App) getDigestSubscriptions(w http.ResponseWriter, req *http.Request) {
+	if principalFrom(req.Context()).userId == "" {
+		respondWithProblem(w, req, errDigestRequiresUser)
+		return
+	}
+	subscriptions, err := getDigestSubscriptions(req.Context(), a.DB)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, subscriptions)
+}
+
+// subscribeDigest creates or replaces the subscription to the digest of the
+// frequency in the path. Without settings it is sent at 08:00 on weekdays,
+// in the time zone of the workspace.
+func (a *App) subscribeDigest(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if principalFrom(ctx).userId == "" {
+		respondWithProblem(w, req, errDigestRequiresUser)
+		return
+	}
+	if !a.Config.Mail.enabled() {
+		respondWithProblem(w, req, errMailDisabled)
+		return
+	}
+
+	var in digestInput
+	if err := decodeJSONBody(w, req, &in); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if in.Send_Time == "" {
+		in.Send_Time = defaultDigestSendTime
+	}
+	if in.Working_Days == nil {
+		in.Working_Days = defaultWorkingDays
+	}
+	if in.Time_Zone == "" {
+		ws := workspace{Workspace_ID: workspaceFrom(ctx).id}
+		if err := ws.getWorkspace(ctx, a.DB); err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+		in.Time_Zone = ws.Time_Zone
+	}
+	if errs := in.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+
+	s := in.subscription(mux.Vars(req)["frequency"])
+	s.Next_Send_At = s.next(time.Now())
+	if err := s.subscribe(ctx, a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+func (a *App) unsubscribeDigest(w http.ResponseWriter, req *http.Request) {
+	if principalFrom(req.Context()).userId == "" {
+		respondWithProblem(w, req, errDigestRequiresUser)
+		return
+	}
+	s := digestSubscription{Frequency: mux.Vars(req)["frequency"]}
+	if err := s.unsubscribe(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestSchedule(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	weekdays := digestSubscription{Frequency: digestDaily, Send_Time: "08:00", Time_Zone: "Europe/Berlin", Working_Days: defaultWorkingDays}
+	weekly := weekdays
+	weekly.Frequency = digestWeekly
+	weekly.Working_Days = []string{"tuesday", "thursday"}
+
+	tests := []struct {
+		s         digestSubscription
+		after     time.Time
+		expected  time.Time
+		situation string
+	}{
+		{weekdays, time.Date(2026, 3, 2, 7, 0, 0, 0, berlin), time.Date(2026, 3, 2, 8, 0, 0, 0, berlin), "later the same day"},
+		{weekdays, time.Date(2026, 3, 2, 8, 0, 0, 0, berlin), time.Date(2026, 3, 3, 8, 0, 0, 0, berlin), "right after one was due"},
+		{weekdays, time.Date(2026, 3, 27, 9, 0, 0, 0, berlin), time.Date(2026, 3, 30, 8, 0, 0, 0, berlin), "over a weekend with a change to summer time"},
+		{weekly, time.Date(2026, 3, 3, 7, 59, 0, 0, berlin), time.Date(2026, 3, 3, 8, 0, 0, 0, berlin), "on the first working day"},
+		{weekly, time.Date(2026, 3, 3, 9, 0, 0, 0, berlin), time.Date(2026, 3, 10, 8, 0, 0, 0, berlin), "skipping the other working days"},
+	}
+	for _, test := range tests {
+		if next := test.s.next(test.after.UTC()); !next.Equal(test.expected) {
+			t.Errorf("Expected the digest %s at %v. Got %v", test.situation, test.expected, next.In(berlin))
+		}
+	}
+}
+
+func TestDigestInputValidation(t *testing.T) {
+	valid := digestInput{Send_Time: "08:00", Time_Zone: "Europe/Berlin", Working_Days: []string{"monday"}}
+	if errs := valid.validate(); len(errs) > 0 {
+		t.Errorf("Expected %+v to be valid. Got %+v", valid, errs)
+	}
+	tests := []struct {
+		in    digestInput
+		field string
+	}{
+		{digestInput{Send_Time: "8:00", Time_Zone: "UTC", Working_Days: []string{"monday"}}, "send_time"},
+		{digestInput{Send_Time: "24:00", Time_Zone: "UTC", Working_Days: []string{"monday"}}, "send_time"},
+		{digestInput{Send_Time: "08:00", Time_Zone: "Mars/Olympus", Working_Days: []string{"monday"}}, "time_zone"},
+		{digestInput{Send_Time: "08:00", Time_Zone: "UTC", Working_Days: []string{}}, "working_days"},
+		{digestInput{Send_Time: "08:00", Time_Zone: "UTC", Working_Days: []string{"mon"}}, "working_days"},
+	}
+	for _, test := range tests {
+		if errs := test.in.validate(); len(errs) != 1 || errs[0].Field != test.field {
+			t.Errorf("Expected an error on %v for %+v. Got %+v", test.field, test.in, errs)
+		}
+	}
+}
+
+func TestDigestMessage(t *testing.T) {
+	dg := digest{
+		Subject:   "Your daily digest for Mon, 02 Mar 2026",
+		Name:      "Ada",
+		Frequency: digestDaily,
+		Workspace: "Default",
+		Date:      "Mon, 02 Mar 2026",
+		Sections: []digestSection{
+			{Title: "Overdue", Tasks: []digestTask{{Task: "Fix <script>", Category: "Chores", When: "due Fri, 27 Feb 17:00"}}, More: 2},
+		},
+	}
+	m, err := dg.message("ada@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(m.text, "Overdue:\n- Fix <script> (Chores, due Fri, 27 Feb 17:00)\n- and 2 more\n") {
+		t.Errorf("Expected the tasks in the text. Got %q", m.text)
+	}
+	if !strings.Contains(m.html, "Fix &lt;script&gt;") || strings.Contains(m.html, "<script>") {
+		t.Errorf("Expected the task to be escaped in the HTML. Got %q", m.html)
+	}
+}
+
+func TestComposeMultipartEmail(t *testing.T) {
+	m := mailMessage{to: "someone@example.com", subject: "Digest", text: "Plain\n", html: "<p>Rich</p>\n"}
+	msg, err := mail.ReadMessage(bytes.NewReader(composeEmail("scheduler@example.com", m, time.Now())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Expected a multipart/alternative email. Got %q, %v", mediaType, err)
+	}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		// multipart.Reader decodes quoted-printable itself
+		body, _ := ioutil.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Type")+": "+string(body))
+	}
+	expected := []string{"text/plain; charset=utf-8: Plain\r\n", "text/html; charset=utf-8: <p>Rich</p>\r\n"}
+	if len(parts) != 2 || parts[0] != expected[0] || parts[1] != expected[1] {
+		t.Errorf("Expected the text and then the HTML. Got %q", parts)
+	}
+}
+
+func addDigestSubscription(t *testing.T, session *http.Cookie, frequency, body string) digestSubscription {
+	req, _ := http.NewRequest("PUT", "/digests/"+frequency, bytes.NewBufferString(body))
+	req.AddCookie(session)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var s digestSubscription
+	json.Unmarshal(response.Body.Bytes(), &s)
+	return s
+}
+
+func sendDueDigests(t *testing.T) {
+	if err := a.digests.sendDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t)
+	smtp := newFakeSMTPServer(t)
+	useMailSender(t, smtp, 3)
+	userId, session := addSession(t, "ada@example.com")
+
+	shared, hidden := addCategory(), addCategory()
+	shareCategory(context.Background(), a.DB, shared, userId, roleViewer, shareDirect)
+	tasks := addTasksToCategory(shared, 4)
+	hiddenTask := addTaskToCategory(hidden)
+	a.DB.Exec("UPDATE tasks SET task='Overdue', due_at = date_trunc('day', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' - interval '1 hour' WHERE task_id=$1", tasks[0])
+	a.DB.Exec("UPDATE tasks SET task='Due today', due_at = date_trunc('day', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' + interval '23 hours' WHERE task_id=$1", tasks[1])
+	a.DB.Exec("UPDATE tasks SET task='Due next week', due_at = now() + interval '6 days' WHERE task_id=$1", tasks[2])
+	a.DB.Exec("UPDATE tasks SET task='Hidden', due_at = now() - interval '2 days' WHERE task_id=$1", hiddenTask)
+	a.DB.Exec("UPDATE tasks SET task='Done' WHERE task_id=$1", tasks[3])
+	done := task{Task_ID: tasks[3], Category_ID: shared, Complete: true}
+	if err := done.completeTask(context.Background(), a.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	s := addDigestSubscription(t, session, digestDaily, `{"time_zone":"UTC","working_days":["sunday","monday","tuesday","wednesday","thursday","friday","saturday"]}`)
+	if s.Send_Time != defaultDigestSendTime || !s.Next_Send_At.After(time.Now()) {
+		t.Errorf("Expected a digest at 08:00 in the future. Got %+v", s)
+	}
+	sendDueDigests(t)
+	var queued int
+	a.DB.QueryRow("SELECT count(*) FROM email_deliveries").Scan(&queued)
+	if queued != 0 {
+		t.Fatalf("Expected no digest before it is due. Got %v", queued)
+	}
+
+	a.DB.Exec("UPDATE digest_subscriptions SET next_send_at = now() - interval '1 minute'")
+	sendDueDigests(t)
+	sendDueDigests(t)
+	a.DB.QueryRow("SELECT count(*) FROM email_deliveries").Scan(&queued)
+	if queued != 1 {
+		t.Fatalf("Expected 1 digest to be queued. Got %v", queued)
+	}
+
+	if err := a.mail.sendDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	emails := smtp.received()
+	if len(emails) != 1 || emails[0].to != "ada@example.com" {
+		t.Fatalf("Expected the digest to be sent to the user. Got %+v", emails)
+	}
+	msg, _ := mail.ReadMessage(strings.NewReader(emails[0].data))
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	part, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := ioutil.ReadAll(part)
+	for _, expected := range []string{"Overdue:\r\n- Overdue", "Due today:\r\n- Due today", "Completed since the last digest:\r\n- Done"} {
+		if !strings.Contains(string(text), expected) {
+			t.Errorf("Expected %q in the digest. Got %q", expected, text)
+		}
+	}
+	for _, unexpected := range []string{"Due next week", "Hidden"} {
+		if strings.Contains(string(text), unexpected) {
+			t.Errorf("Expected %q not to be in the digest. Got %q", unexpected, text)
+		}
+	}
+
+	// completed tasks are only listed once, and empty digests not at all
+	a.DB.Exec("UPDATE tasks SET complete = true, completed_at = now() - interval '1 day' WHERE task_id IN ($1, $2)", tasks[0], tasks[1])
+	a.DB.Exec("UPDATE digest_subscriptions SET next_send_at = now() - interval '1 minute'")
+	sendDueDigests(t)
+	a.DB.QueryRow("SELECT count(*) FROM email_deliveries").Scan(&queued)
+	if queued != 1 {
+		t.Errorf("Expected no empty digest to be queued. Got %v", queued-1)
+	}
+	var lastDigestAt time.Time
+	a.DB.QueryRow("SELECT last_digest_at FROM digest_subscriptions").Scan(&lastDigestAt)
+	if time.Since(lastDigestAt) > time.Minute {
+		t.Errorf("Expected the empty digest to count as due. Got %v", lastDigestAt)
+	}
+}
+
+func TestDigestSubscriptions(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t)
+	_, session := addSession(t, "ada@example.com")
+
+	req, _ := http.NewRequest("PUT", "/digests/weekly", bytes.NewBufferString(`{}`))
+	req.AddCookie(session)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	useMailSender(t, newFakeSMTPServer(t), 3)
+	s := addDigestSubscription(t, session, digestWeekly, `{}`)
+	if s.Time_Zone != "UTC" || len(s.Working_Days) != 5 || s.Next_Send_At.UTC().Weekday() != time.Monday {
+		t.Errorf("Expected Monday digests in the time zone of the workspace. Got %+v", s)
+	}
+	s = addDigestSubscription(t, session, digestWeekly, `{"send_time":"17:30","working_days":["friday","wednesday"]}`)
+	if s.Send_Time != "17:30" || strings.Join(s.Working_Days, ",") != "wednesday,friday" {
+		t.Errorf("Expected the settings to be replaced. Got %+v", s)
+	}
+
+	req, _ = http.NewRequest("GET", "/digests", nil)
+	req.AddCookie(session)
+	response := executeRequest(req)
+	var subscriptions []digestSubscription
+	json.Unmarshal(response.Body.Bytes(), &subscriptions)
+	if len(subscriptions) != 1 || subscriptions[0].Frequency != digestWeekly {
+		t.Errorf("Expected the weekly subscription. Got %+v", subscriptions)
+	}
+
+	req, _ = http.NewRequest("PUT", "/digests/hourly", bytes.NewBufferString(`{}`))
+	req.AddCookie(session)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", "/digests/daily", bytes.NewBufferString(`{}`))
+	req.Header.Set("Authorization", "Bearer "+addAPIKey("", scopeNotificationsWrite))
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+
+	for _, code := range []int{http.StatusOK, http.StatusNotFound} {
+		req, _ = http.NewRequest("DELETE", "/digests/weekly", nil)
+		req.AddCookie(session)
+		checkResponseCode(t, code, executeRequest(req).Code)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type errorKind int
+
+const (
+	kindInternal errorKind = iota
+	kindBadRequest
+	kindNotFound
+	kindConflict
+	kindValidation
+	kindForbidden
+	kindTooLarge
+	kindFailedDependency
+	kindTimeout
+	kindTooManyRequests
+	kindUnauthorized
+)
+
+// appError is the typed error returned by the data layer and request parsing.
+// Code is a stable, machine readable identifier clients can switch on.
+type appError struct {
+	Kind    errorKind
+	Code    string
+	Message string
+	Fields  validationErrors
+	Err     error
+}
+
+func (e *appError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *appError) Unwrap() error {
+	return e.Err
+}
+
+func badRequestError(code, message string) error {
+	return &appError{Kind: kindBadRequest, Code: code, Message: message}
+}
+
+func notFoundError(code, message string) error {
+	return &appError{Kind: kindNotFound, Code: code, Message: message}
+}
+
+func conflictError(code, message string, err error) error {
+	return &appError{Kind: kindConflict, Code: code, Message: message, Err: err}
+}
+
+func forbiddenError(code, message string) error {
+	return &appError{Kind: kindForbidden, Code: code, Message: message}
+}
+
+func validationError(errs validationErrors) error {
+	return &appError{Kind: kindValidation, Code: "validation_failed", Message: "Validation failed", Fields: errs}
+}
+
+func (k errorKind) status() int {
+	switch k {
+	case kindBadRequest:
+		return http.StatusBadRequest
+	case kindNotFound:
+		return http.StatusNotFound
+	case kindConflict:
+		return http.StatusConflict
+	case kindValidation:
+		return http.StatusUnprocessableEntity
+	case kindForbidden:
+		return http.StatusForbidden
+	case kindTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case kindFailedDependency:
+		return http.StatusFailedDependency
+	case kindTimeout:
+		return http.StatusServiceUnavailable
+	case kindTooManyRequests:
+		return http.StatusTooManyRequests
+	case kindUnauthorized:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// dbError translates constraint violations reported by Postgres into domain
+// errors. Anything else is returned unchanged and treated as internal.
+func dbError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		return conflictError("already_exists", "Resource already exists", err)
+	case "foreign_key_violation":
+		return conflictError("reference_violation", "Referenced resource does not exist", err)
+	}
+	return err
+}
+
+// canceledError reports work aborted because its context was cancelled or
+// timed out, or because Postgres cancelled the query, as a timeout instead of
+// an internal error.
+func canceledError(err error) error {
+	var pqErr *pq.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) ||
+		(errors.As(err, &pqErr) && pqErr.Code.Name() == "query_canceled") {
+		return &appError{Kind: kindTimeout, Code: "timeout", Message: "The request took too long", Err: err}
+	}
+	return err
+}
+
+// affectedOrNotFound returns notFound if a statement did not touch any row.
+func affectedOrNotFound(res sql.Result, err error, notFound error) error {
+	if err != nil {
+		return dbError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// problem is an RFC 7807 problem details body.
+type problem struct {
+	Type           string           `json:"type"`
+	Title          string           `json:"title"`
+	Status         int              `json:"status"`
+	Detail         string           `json:"detail,omitempty"`
+	Instance       string           `json:"instance,omitempty"`
+	Code           string           `json:"code"`
+	Fields         validationErrors `json:"fields,omitempty"`
+	Correlation_ID string           `json:"correlation_id,omitempty"`
+}
+
+// problemFor maps err to a problem. Internal errors are logged under a fresh
+// correlation ID and never echoed to the client.
+func problemFor(req *http.Request, err error) problem {
+	err = canceledError(err)
+	var e *appError
+	if !errors.As(err, &e) || e.Kind == kindInternal {
+		correlationId := requestIDFrom(req.Context())
+		if correlationId == "" {
+			correlationId = uuid.New().String()
+		}
+		loggerFrom(req.Context()).error("internal error", "correlation_id", correlationId, "path", req.URL.Path, "error", err)
+		return problem{
+			Type:           "/problems/internal_error",
+			Title:          http.StatusText(http.StatusInternalServerError),
+			Status:         http.StatusInternalServerError,
+			Detail:         "An internal error occurred",
+			Instance:       req.URL.Path,
+			Code:           "internal_error",
+			Correlation_ID: correlationId,
+		}
+	}
+
+	status := e.Kind.status()
+	return problem{
+		Type:     "/problems/" + e.Code,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   e.Message,
+		Instance: req.URL.Path,
+		Code:     e.Code,
+		Fields:   e.Fields,
+	}
+}
+
+func respondWithProblem(w http.ResponseWriter, req *http.Request, err error) {
+	p := problemFor(req, err)
+	if p.Correlation_ID != "" {
+		w.Header().Set("X-Correlation-ID", p.Correlation_ID)
+	}
+	respondWithContentType(w, p.Status, "application/problem+json", p)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestDbErrorMapsConstraintViolations(t *testing.T) {
+	for code, want := range map[pq.ErrorCode]string{"23505": "already_exists", "23503": "reference_violation"} {
+		err := dbError(&pq.Error{Code: code})
+
+		var e *appError
+		if !errors.As(err, &e) || e.Kind != kindConflict {
+			t.Fatalf("Expected %s to map to a conflict. Got %v", code.Name(), err)
+		}
+		if e.Code != want {
+			t.Errorf("Expected code '%s'. Got %s", want, e.Code)
+		}
+	}
+}
+
+func TestInternalErrorsAreNotEchoed(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	rr := httptest.NewRecorder()
+	respondWithProblem(rr, req, errors.New(`pq: relation "categories" does not exist`))
+
+	checkResponseCode(t, http.StatusInternalServerError, rr.Code)
+
+	p := problemFor(req, errors.New("boom"))
+	if p.Detail == "boom" {
+		t.Errorf("Expected internal error detail to be hidden")
+	}
+	if p.Correlation_ID == "" {
+		t.Errorf("Expected internal error to carry a correlation ID")
+	}
+	if rr.Header().Get("X-Correlation-ID") == "" {
+		t.Errorf("Expected X-Correlation-ID header to be set")
+	}
+}
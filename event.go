@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// types of the events published when categories and tasks change
+const (
+	eventCategoryCreated = "category.created"
+	eventCategoryUpdated = "category.updated"
+	// the tasks of the category are deleted with it without events of their own
+	eventCategoryDeleted = "category.deleted"
+	eventTaskCreated     = "task.created"
+	eventTaskUpdated     = "task.updated"
+	// published in addition to task.updated when a task becomes complete
+	eventTaskCompleted = "task.completed"
+	eventTaskDeleted   = "task.deleted"
+	// a reminder of the task with the webhook channel fired
+	eventTaskReminder = "task.reminder"
+)
+
+var eventTypes = []string{
+	eventCategoryCreated, eventCategoryUpdated, eventCategoryDeleted,
+	eventTaskCreated, eventTaskUpdated, eventTaskCompleted, eventTaskDeleted, eventTaskReminder,
+}
+
+// event is what subscribers receive. Data is the category or task as the
+// API returns it after the change, or before it for deletions.
+type event struct {
+	Event_ID     string      `json:"event_id"`
+	Type         string      `json:"type"`
+	Workspace_ID string      `json:"workspace_id"`
+	Occurred_At  time.Time   `json:"occurred_at"`
+	Data         interface{} `json:"data"`
+}
+
+// eventPatterns lists what a subscription can name to receive eventType:
+// the type itself or its prefix, such as task.*.
+func eventPatterns(eventType string) []string {
+	prefix := strings.SplitN(eventType, ".", 2)[0]
+	return []string{eventType, prefix + ".*"}
+}
+
+func validEventPattern(pattern string) bool {
+	for _, t := range eventTypes {
+		if containsString(eventPatterns(t), pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishEvent records that eventType happened in the workspace of ctx by
+// writing it to the outbox, from where outboxRelay publishes it. Running it
+// with the transaction of the change means sinks are only told about
+// changes that were committed, and about every one of them.
+func publishEvent(ctx context.Context, db queryer, eventType string, data interface{}) error {
+	e := event{
+		Event_ID:     uuid.New().String(),
+		Type:         eventType,
+		Workspace_ID: workspaceFrom(ctx).id,
+		Occurred_At:  time.Now().UTC(),
+		Data:         data,
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO outbox(event_id, event_type, workspace_id, payload) VALUES($1, $2, $3, $4)",
+		e.Event_ID, e.Type, e.Workspace_ID, string(payload))
+	return err
+}
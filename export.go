@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const exportFormatVersion = 1
+
+type exportedCategory struct {
+	category
+	Tasks []task `json:"tasks"`
+}
+
+type export struct {
+	Version     int                `json:"version"`
+	Exported_At time.Time          `json:"exported_at"`
+	Categories  []exportedCategory `json:"categories"`
+}
+
+func exportData(ctx context.Context, db queryer) (export, error) {
+	e := export{Version: exportFormatVersion, Exported_At: time.Now().UTC(), Categories: []exportedCategory{}}
+
+	categories, err := getCategories(ctx, db)
+	if err != nil {
+		return e, err
+	}
+	for _, c := range categories {
+		tasks, err := c.getTasks(ctx, db)
+		if err != nil {
+			return e, err
+		}
+		e.Categories = append(e.Categories, exportedCategory{category: c, Tasks: tasks})
+	}
+	return e, nil
+}
+
+// importData loads an export into the workspace of ctx in a single
+// transaction. Categories keep their IDs and are overwritten if they already
+// exist in the workspace; tasks are always added.
+func importData(ctx context.Context, db *sql.DB, e export) (int, int, error) {
+	if e.Version != exportFormatVersion {
+		return 0, 0, fmt.Errorf("unsupported export version %d", e.Version)
+	}
+
+	var categoryCount, taskCount int
+	err := inTransaction(ctx, db, func(tx *sql.Tx) error {
+		for _, c := range e.Categories {
+			if errs := c.validate(); len(errs) > 0 {
+				return fmt.Errorf("category %s: %v", c.Category_ID, errs)
+			}
+			res, err := tx.ExecContext(ctx,
+				`INSERT INTO categories(category_id, name, description, workspace_id) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (category_id) DO UPDATE SET name=EXCLUDED.name, description=EXCLUDED.description
+				WHERE categories.workspace_id = EXCLUDED.workspace_id`,
+				c.Category_ID, c.Name, c.Description, workspaceFrom(ctx).id,
+			)
+			if err != nil {
+				return err
+			}
+			// the conflicting category is in another workspace
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				return fmt.Errorf("category %s belongs to another workspace", c.Category_ID)
+			}
+			categoryCount++
+
+			for _, t := range c.Tasks {
+				if errs := t.validate(); len(errs) > 0 {
+					return fmt.Errorf("task %d: %v", t.Task_ID, errs)
+				}
+				_, err := tx.ExecContext(ctx,
+					"INSERT INTO tasks(category_id, task, seq, complete, due_at) VALUES ($1, $2, $3, $4, $5)",
+					c.Category_ID, t.Task, t.Seq, t.Complete, t.Due_At,
+				)
+				if err != nil {
+					return err
+				}
+				taskCount++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return categoryCount, taskCount, nil
+}
+
+var seedCategories = []exportedCategory{
+	{
+		category: category{Name: "Groceries", Description: "Things to pick up this week"},
+		Tasks:    []task{{Task: "Milk"}, {Task: "Bread"}, {Task: "Coffee"}},
+	},
+	{
+		category: category{Name: "Chores", Description: "Around the house"},
+		Tasks:    []task{{Task: "Take out the trash"}, {Task: "Water the plants", Complete: true}},
+	},
+}
+
+// seedData fills the database with a small set of sample categories and tasks.
+func seedData(ctx context.Context, db *sql.DB) error {
+	return inTransaction(ctx, db, func(tx *sql.Tx) error {
+		for _, s := range seedCategories {
+			c := s.category
+			if err := c.createCategory(ctx, tx); err != nil {
+				return err
+			}
+			for _, t := range s.Tasks {
+				t.Category_ID = c.Category_ID
+				if err := t.createTask(ctx, tx); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+	addTasksToCategory(categoryId, 3)
+
+	e, err := exportData(context.Background(), a.DB)
+	if err != nil {
+		t.Fatalf("Could not export data. Error: %v", err)
+	}
+	if len(e.Categories) != 1 || len(e.Categories[0].Tasks) != 3 {
+		t.Fatalf("Expected 1 category with 3 tasks. Got %+v", e.Categories)
+	}
+
+	clearTables()
+	categories, tasks, err := importData(context.Background(), a.DB, e)
+	if err != nil {
+		t.Fatalf("Could not import data. Error: %v", err)
+	}
+	if categories != 1 || tasks != 3 {
+		t.Errorf("Expected to import 1 category and 3 tasks. Got %v and %v", categories, tasks)
+	}
+
+	c := category{Category_ID: categoryId}
+	if err := c.getCategory(context.Background(), a.DB); err != nil {
+		t.Errorf("Expected category %v to keep its ID. Error: %v", categoryId, err)
+	}
+}
+
+func TestSeedData(t *testing.T) {
+	clearTables()
+
+	if err := seedData(context.Background(), a.DB); err != nil {
+		t.Fatalf("Could not seed data. Error: %v", err)
+	}
+	categories, _ := getCategories(context.Background(), a.DB)
+	if len(categories) != len(seedCategories) {
+		t.Errorf("Expected %v categories. Got %v", len(seedCategories), len(categories))
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCommand([]string{"explode"}, &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2. Got %v", code)
+	}
+	if !strings.Contains(stderr.String(), "unknown command") {
+		t.Errorf("Expected an unknown command message. Got %s", stderr.String())
+	}
+}
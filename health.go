@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// how long a single readiness check may take
+var readinessCheckTimeout = 2 * time.Second
+
+type checkResult struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func checkPassed(detail string) checkResult { return checkResult{Status: "ok", Detail: detail} }
+func checkFailed(detail string) checkResult { return checkResult{Status: "failing", Detail: detail} }
+
+// drain makes /readyz fail so load balancers stop routing new requests here.
+func (a *App) drain() {
+	atomic.StoreInt32(&a.draining, 1)
+}
+
+func (a *App) isDraining() bool {
+	return atomic.LoadInt32(&a.draining) == 1
+}
+
+// getHealthz reports that the process is alive. It checks nothing else, so
+// the orchestrator does not restart us when a dependency is down.
+func (a *App) getHealthz(w http.ResponseWriter, req *http.Request) {
+	respondWithJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// getReadyz reports whether this instance should receive traffic.
+func (a *App) getReadyz(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	checks := map[string]checkResult{
+		"database":   a.checkDatabase(ctx),
+		"migrations": a.checkMigrations(ctx),
+		"workers":    a.checkWorkers(),
+	}
+	if a.isDraining() {
+		checks["shutdown"] = checkFailed("draining")
+	}
+
+	res := healthResponse{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, c := range checks {
+		if c.Status != "ok" {
+			res.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	respondWithJSON(w, status, res)
+}
+
+// checkDatabase and checkMigrations only log their errors, /readyz is
+// served without authentication.
+func (a *App) checkDatabase(ctx context.Context) checkResult {
+	if err := a.DB.PingContext(ctx); err != nil {
+		loggerFrom(ctx).warn("readiness check failed", "check", "database", "error", err)
+		return checkFailed("database unreachable")
+	}
+	return checkPassed("")
+}
+
+func (a *App) checkMigrations(ctx context.Context) checkResult {
+	expected, err := latestMigrationVersion()
+	if err != nil {
+		loggerFrom(ctx).warn("readiness check failed", "check", "migrations", "error", err)
+		return checkFailed("migrations unreadable")
+	}
+	current, err := currentMigrationVersion(ctx, a.DB)
+	if err != nil {
+		loggerFrom(ctx).warn("readiness check failed", "check", "migrations", "error", err)
+		return checkFailed("schema version unknown")
+	}
+	if current != expected {
+		loggerFrom(ctx).warn("readiness check failed", "check", "migrations", "version", current, "expected", expected)
+		if current < expected {
+			return checkFailed("migrations behind")
+		}
+		return checkFailed("migrations ahead")
+	}
+	return checkPassed(fmt.Sprintf("version %d", current))
+}
+
+func (a *App) checkWorkers() checkResult {
+	var stopped []string
+	for name, running := range a.workers.status() {
+		if !running {
+			stopped = append(stopped, name)
+		}
+	}
+	if len(stopped) > 0 {
+		sort.Strings(stopped)
+		return checkFailed("stopped: " + strings.Join(stopped, ", "))
+	}
+	return checkPassed(strings.Join(a.workers.names(), ", "))
+}
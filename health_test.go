@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var res healthResponse
+	json.Unmarshal(response.Body.Bytes(), &res)
+	if res.Status != "ok" {
+		t.Errorf("Expected status 'ok'. Got %s", res.Status)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var res healthResponse
+	json.Unmarshal(response.Body.Bytes(), &res)
+	for _, name := range []string{"database", "migrations", "workers"} {
+		if c := res.Checks[name]; c.Status != "ok" {
+			t.Errorf("Expected check %s to be 'ok'. Got %q (%s)", name, c.Status, c.Detail)
+		}
+	}
+}
+
+func TestReadyzWhileDraining(t *testing.T) {
+	a.drain()
+	defer atomic.StoreInt32(&a.draining, 0)
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusServiceUnavailable, response.Code)
+
+	var res healthResponse
+	json.Unmarshal(response.Body.Bytes(), &res)
+	if res.Status != "unavailable" {
+		t.Errorf("Expected status 'unavailable'. Got %s", res.Status)
+	}
+	if c := res.Checks["shutdown"]; c.Status != "failing" {
+		t.Errorf("Expected the shutdown check to fail. Got %q", c.Status)
+	}
+}
+
+func TestReadyzHidesErrors(t *testing.T) {
+	db, _ := sql.Open("postgres", "host=127.0.0.1 port=1 user=secret-user dbname=secret-db sslmode=disable connect_timeout=1")
+	defer db.Close()
+	app := &App{DB: db}
+
+	for name, c := range map[string]checkResult{
+		"database":   app.checkDatabase(context.Background()),
+		"migrations": app.checkMigrations(context.Background()),
+	} {
+		if c.Status != "failing" || strings.Contains(c.Detail, "secret") || strings.Contains(c.Detail, "127.0.0.1") {
+			t.Errorf("Expected check %s to fail without details of the error. Got %q (%s)", name, c.Status, c.Detail)
+		}
+	}
+}
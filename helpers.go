@@ -1,60 +1,53 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
 	"testing"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
-const categoriesTableCreation = `CREATE TABLE IF NOT EXISTS categories
-(
-    category_id uuid DEFAULT uuid_generate_v4(),
-    name TEXT NOT NULL,
-	description TEXT NOT NULL,
-    CONSTRAINT categories_pkey PRIMARY KEY (category_id)
-)`
-
-const tasksTableCreation = `CREATE TABLE IF NOT EXISTS tasks
-(
-    task_id SERIAL PRIMARY KEY,
-    category_id uuid references categories,
-    task TEXT NOT NULL,
-	seq SERIAL NOT NULL,
-	complete BOOL NOT NULL
-)`
-
 var a App
 
+// queryer is satisfied by both *sql.DB and *sql.Tx so model methods can run
+// inside or outside of a transaction.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 func loadEnv() {
+	// the .env file is optional, settings may come from the environment
 	err := godotenv.Load()
-	if err != nil {
-		log.Fatalf("Error loading .env file")
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Error loading .env file: %v", err)
 	}
 }
 
-func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	respondWithContentType(w, code, "application/json", payload)
 }
 
-func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+func respondWithContentType(w http.ResponseWriter, code int, contentType string, payload interface{}) {
 	response, _ := json.Marshal(payload)
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(code)
 	w.Write(response)
 }
 
 func ensureTablesExists() {
-	if _, err := a.DB.Exec(categoriesTableCreation); err != nil {
-		log.Fatal(err)
-	}
-	if _, err := a.DB.Exec(tasksTableCreation); err != nil {
+	if _, err := migrateUp(context.Background(), a.DB); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -69,9 +62,67 @@ func clearTasksTable() {
 	a.DB.Exec("ALTER SEQUENCE tasks_seq_seq RESTART WITH 1")
 }
 
+func clearIdempotencyKeysTable() {
+	a.DB.Exec("DELETE FROM idempotency_keys")
+}
+
+func clearUsersTable() {
+	a.DB.Exec("DELETE FROM users")
+}
+
+func clearRateLimitBucketsTable() {
+	a.DB.Exec("DELETE FROM rate_limit_buckets")
+}
+
+func clearAPIKeysTable() {
+	a.DB.Exec("DELETE FROM api_keys")
+}
+
+func clearSharesTables() {
+	a.DB.Exec("DELETE FROM category_group_roles")
+	a.DB.Exec("DELETE FROM category_shares")
+	a.DB.Exec("DELETE FROM sessions")
+}
+
+func clearRemindersTables() {
+	a.DB.Exec("DELETE FROM reminders")
+	a.DB.Exec("DELETE FROM notifications")
+	a.DB.Exec("DELETE FROM email_deliveries")
+}
+
+func clearDigestSubscriptionsTable() {
+	a.DB.Exec("DELETE FROM digest_subscriptions")
+}
+
+func clearOutboxTable() {
+	a.DB.Exec("DELETE FROM outbox")
+}
+
+func clearWebhooksTables() {
+	a.DB.Exec("DELETE FROM webhook_deliveries")
+	a.DB.Exec("DELETE FROM webhooks")
+}
+
+// clearWorkspacesTables keeps the default workspace, which the migrations
+// create.
+func clearWorkspacesTables() {
+	a.DB.Exec("DELETE FROM workspace_members")
+	a.DB.Exec("DELETE FROM workspaces WHERE workspace_id <> $1", defaultWorkspaceId)
+}
+
 func clearTables() {
+	clearRemindersTables()
+	clearDigestSubscriptionsTable()
+	clearOutboxTable()
+	clearWebhooksTables()
+	clearRateLimitBucketsTable()
+	clearSharesTables()
+	clearAPIKeysTable()
+	clearUsersTable()
+	clearIdempotencyKeysTable()
 	clearTasksTable()
 	clearCategoriesTable()
+	clearWorkspacesTables()
 }
 
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
@@ -88,7 +139,7 @@ func checkResponseCode(t *testing.T, expected, actual int) {
 
 func addCategory() string {
 	var c category
-	a.DB.QueryRow("INSERT INTO categories(name, description) VALUES($1, $2) RETURNING category_id", "Test Category", "Test Category Description").Scan(&c.Category_ID)
+	a.DB.QueryRow("INSERT INTO categories(name, description, workspace_id) VALUES($1, $2, $3) RETURNING category_id", "Test Category", "Test Category Description", defaultWorkspaceId).Scan(&c.Category_ID)
 	return c.Category_ID
 }
 
@@ -101,7 +152,7 @@ func addCategories(count int) []string {
 		var c category
 		name := "Category " + strconv.Itoa(i)
 		desc := "Description " + strconv.Itoa(i)
-		a.DB.QueryRow("INSERT INTO categories(name, description) VALUES($1, $2) RETURNING category_id", name, desc).Scan(&c.Category_ID)
+		a.DB.QueryRow("INSERT INTO categories(name, description, workspace_id) VALUES($1, $2, $3) RETURNING category_id", name, desc, defaultWorkspaceId).Scan(&c.Category_ID)
 		categoryIds = append(categoryIds, c.Category_ID)
 	}
 	return categoryIds
@@ -127,12 +178,40 @@ func addTasksToCategory(categoryId string, count int) []int {
 	return taskIds
 }
 
+// addAPIKey creates a key with scopes, personal if userId is set, and
+// returns the key to authenticate with.
+func addAPIKey(userId string, scopes ...string) string {
+	k, err := newAPIKey(apiKeyInput{Name: "Test key", User_ID: userId, Scopes: scopes})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := k.createAPIKey(context.Background(), a.DB); err != nil {
+		log.Fatal(err)
+	}
+	return k.Key
+}
+
 func isValidUUID(id string) bool {
 	_, err := uuid.Parse(id)
 	return err == nil
 }
 
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type")
+func pathCategoryId(req *http.Request) (string, error) {
+	id := mux.Vars(req)["category_id"]
+	if !isValidUUID(id) {
+		return "", badRequestError("invalid_category_id", "Invalid category ID")
+	}
+	return id, nil
+}
+
+func pathTaskIds(req *http.Request) (string, int, error) {
+	categoryId, err := pathCategoryId(req)
+	if err != nil {
+		return "", 0, err
+	}
+	taskId, err := strconv.Atoi(mux.Vars(req)["task_id"])
+	if err != nil {
+		return "", 0, badRequestError("invalid_task_id", "Invalid task ID")
+	}
+	return categoryId, taskId, nil
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// how long a stored response is replayed for before the key can be reused
+var idempotencyKeyTTL = 24 * time.Hour
+
+// how long storing the outcome of a request may take
+var idempotencyStoreTimeout = 5 * time.Second
+
+var (
+	errInvalidIdempotencyKey    = badRequestError("invalid_idempotency_key", "Invalid idempotency key")
+	errIdempotencyKeyReused     = &appError{Kind: kindValidation, Code: "idempotency_key_reused", Message: "Idempotency key reused with a different request"}
+	errIdempotencyKeyInProgress = conflictError("idempotency_key_in_progress", "A request with this idempotency key is still in progress", nil)
+)
+
+type idempotencyKey struct {
+	// who used the key where, see idempotencyScope
+	Scope       string
+	Key         string
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// reserveIdempotencyKey claims the key for a new request. It returns false if
+// an unexpired entry for the key already exists.
+func (k *idempotencyKey) reserveIdempotencyKey(ctx context.Context, db queryer) (bool, error) {
+	if _, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2 AND expires_at < now()", k.Scope, k.Key); err != nil {
+		return false, err
+	}
+	res, err := db.ExecContext(ctx,
+		"INSERT INTO idempotency_keys(scope, key, request_hash, expires_at) VALUES ($1, $2, $3, $4) ON CONFLICT (scope, key) DO NOTHING",
+		k.Scope, k.Key, k.RequestHash, time.Now().Add(idempotencyKeyTTL),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (k *idempotencyKey) getIdempotencyKey(ctx context.Context, db queryer) error {
+	var status sql.NullInt64
+	var contentType sql.NullString
+	err := db.QueryRowContext(ctx,
+		"SELECT request_hash, status, content_type, body FROM idempotency_keys WHERE scope=$1 AND key=$2",
+		k.Scope, k.Key,
+	).Scan(&k.RequestHash, &status, &contentType, &k.Body)
+	k.Status = int(status.Int64)
+	k.ContentType = contentType.String
+	return err
+}
+
+func (k *idempotencyKey) saveIdempotencyKey(ctx context.Context, db queryer) error {
+	_, err := db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status=$1, content_type=$2, body=$3 WHERE scope=$4 AND key=$5",
+		k.Status, k.ContentType, k.Body, k.Scope, k.Key,
+	)
+	return err
+}
+
+func (k *idempotencyKey) deleteIdempotencyKey(ctx context.Context, db queryer) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2", k.Scope, k.Key)
+	return err
+}
+
+func deleteExpiredIdempotencyKeys(ctx context.Context, db queryer) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < now()")
+	return err
+}
+
+// responseCapture passes writes through to the client while keeping a copy of
+// the status and body so they can be stored.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rc *responseCapture) WriteHeader(code int) {
+	rc.status = code
+	rc.ResponseWriter.WriteHeader(code)
+}
+
+func (rc *responseCapture) Write(b []byte) (int, error) {
+	if rc.status == 0 {
+		rc.status = http.StatusOK
+	}
+	rc.body.Write(b)
+	return rc.ResponseWriter.Write(b)
+}
+
+// idempotencyScope keeps the keys of different callers and workspaces apart,
+// so nobody can replay the response to a request of someone else.
+func idempotencyScope(ctx context.Context) string {
+	p := principalFrom(ctx)
+	caller := p.userId
+	if caller == "" && p.apiKey != nil {
+		caller = "api-key:" + p.apiKey.API_Key_ID
+	}
+	return caller + "@" + workspaceFrom(ctx).id
+}
+
+func hashRequest(req *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent wraps a non-idempotent handler so that repeated requests carrying
+// the same Idempotency-Key header replay the first response instead of being
+// executed again.
+func (a *App) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, req)
+			return
+		}
+		if len(key) > 255 {
+			respondWithProblem(w, req, errInvalidIdempotencyKey)
+			return
+		}
+
+		body, err := ioutil.ReadAll(limitBody(w, req.Body, maxBodyBytes))
+		if err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		k := idempotencyKey{Scope: idempotencyScope(req.Context()), Key: key, RequestHash: hashRequest(req, body)}
+		reserved, err := k.reserveIdempotencyKey(req.Context(), a.DB)
+		if err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+
+		if !reserved {
+			stored := idempotencyKey{Scope: k.Scope, Key: key}
+			if err := stored.getIdempotencyKey(req.Context(), a.DB); err != nil {
+				respondWithProblem(w, req, err)
+				return
+			}
+			switch {
+			case stored.RequestHash != k.RequestHash:
+				respondWithProblem(w, req, errIdempotencyKeyReused)
+			case stored.Status == 0:
+				respondWithProblem(w, req, errIdempotencyKeyInProgress)
+			default:
+				w.Header().Set("Content-Type", stored.ContentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		rc := &responseCapture{ResponseWriter: w}
+		next(rc, req)
+
+		// the outcome is stored even if the client has gone away meanwhile,
+		// otherwise the key would stay in progress until it expires
+		ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+		defer cancel()
+
+		// server errors are not stored so that the client can retry them
+		if rc.status == 0 || rc.status >= http.StatusInternalServerError {
+			k.deleteIdempotencyKey(ctx, a.DB)
+			return
+		}
+		k.Status = rc.status
+		k.ContentType = rc.Header().Get("Content-Type")
+		k.Body = rc.body.Bytes()
+		k.saveIdempotencyKey(ctx, a.DB)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestIdempotentCreateCategory(t *testing.T) {
+	clearTables()
+
+	jsonString := []byte(`{"name":"Test category","description": "Test description"}`)
+
+	req, _ := http.NewRequest("POST", "/category", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, "create-category-1")
+	first := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, first.Code)
+
+	req, _ = http.NewRequest("POST", "/category", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, "create-category-1")
+	second := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, second.Code)
+
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("Expected replayed response %s. Got %s", first.Body.String(), second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected replayed response to set the Idempotent-Replayed header")
+	}
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	response := executeRequest(req)
+	var categories []category
+	json.Unmarshal(response.Body.Bytes(), &categories)
+	if len(categories) != 1 {
+		t.Errorf("Expected 1 category to be created. Got %v", len(categories))
+	}
+}
+
+func TestIdempotencyKeyReusedWithDifferentBody(t *testing.T) {
+	clearTables()
+
+	req, _ := http.NewRequest("POST", "/category", bytes.NewBuffer([]byte(`{"name":"First","description":""}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, "create-category-2")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/category", bytes.NewBuffer([]byte(`{"name":"Second","description":""}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, "create-category-2")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+}
+
+func TestIdempotencyKeysAreScopedToCaller(t *testing.T) {
+	clearTables()
+	key := addAPIKey("", scopeCategoriesWrite)
+
+	for _, apiKey := range []string{"", key} {
+		req, _ := http.NewRequest("POST", "/category", bytes.NewBuffer([]byte(`{"name":"Mine","description":""}`)))
+		req.Header.Set(idempotencyKeyHeader, "create-category-3")
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+		if response.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("Expected the response to another caller not to be replayed")
+		}
+	}
+
+	var count int
+	a.DB.QueryRow("SELECT count(*) FROM categories").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 categories to be created. Got %v", count)
+	}
+}
+
+func TestIdempotentCreateWorkspace(t *testing.T) {
+	clearTables()
+	_, cookie := addSession(t, "alice@example.com")
+
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/workspaces", bytes.NewBuffer([]byte(`{"name":"Team A"}`)))
+		req.AddCookie(cookie)
+		req.Header.Set(idempotencyKeyHeader, "create-workspace-1")
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+		bodies = append(bodies, response.Body.String())
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("Expected replayed response %s. Got %s", bodies[0], bodies[1])
+	}
+
+	var count int
+	a.DB.QueryRow("SELECT count(*) FROM workspaces WHERE name='Team A'").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 workspace to be created. Got %v", count)
+	}
+}
+
+func TestIdempotentRequestBodyErrors(t *testing.T) {
+	handler := a.idempotent(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected the handler not to be called")
+	})
+
+	req := httptest.NewRequest("POST", "/category", strings.NewReader(strings.Repeat("x", maxBodyBytes+1)))
+	req.Header.Set(idempotencyKeyHeader, "too-large")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	req = httptest.NewRequest("POST", "/category", iotest.ErrReader(errors.New("connection reset")))
+	req.Header.Set(idempotencyKeyHeader, "broken")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	checkResponseCode(t, http.StatusInternalServerError, rr.Code)
+}
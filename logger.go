@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	if l < levelDebug || l > levelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// logOutput is shared by a logger and everything derived from it with with,
+// so that the level can be changed for all of them at runtime.
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level int32
+}
+
+// logger writes one JSON object per line. Fields are key-value pairs that
+// are added to every line.
+type logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+func newLogger(w io.Writer, level logLevel) *logger {
+	return &logger{out: &logOutput{w: w, level: int32(level)}}
+}
+
+// rootLogger is used whenever no logger is found in the context.
+var rootLogger = newLogger(os.Stderr, levelInfo)
+
+func (l *logger) level() logLevel {
+	return logLevel(atomic.LoadInt32(&l.out.level))
+}
+
+func (l *logger) setLevel(level logLevel) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// with returns a logger that adds the given key-value pairs to every line.
+func (l *logger) with(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &logger{out: l.out, fields: fields}
+}
+
+func (l *logger) debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	if level < l.level() {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeLogField(&buf, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeLogField(&buf, "level", level.String())
+	buf.WriteByte(',')
+	writeLogField(&buf, "msg", msg)
+	for _, fields := range [][]interface{}{l.fields, kv} {
+		for i := 0; i < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			var value interface{} = "MISSING"
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			buf.WriteByte(',')
+			writeLogField(&buf, key, value)
+		}
+	}
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeLogField(buf *bytes.Buffer, key string, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.String()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	k, _ := json.Marshal(key)
+	b, err := json.Marshal(value)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(k)
+	buf.WriteByte(':')
+	buf.Write(b)
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, l *logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the logger of the request or job ctx belongs to, or the
+// root logger.
+func loggerFrom(ctx context.Context) *logger {
+	if l, ok := ctx.Value(loggerKey{}).(*logger); ok {
+		return l
+	}
+	return rootLogger
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLoggerWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, levelInfo).with("request_id", "abc")
+	l.debug("hidden")
+	l.info("served", "status", 200, "error", errors.New("boom"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line below the debug level. Got %d: %s", len(lines), buf.String())
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatalf("Expected a JSON line. Got %s", lines[0])
+	}
+	for key, want := range map[string]interface{}{"level": "info", "msg": "served", "request_id": "abc", "status": 200.0, "error": "boom"} {
+		if line[key] != want {
+			t.Errorf("Expected %s to be %v. Got %v", key, want, line[key])
+		}
+	}
+}
+
+func TestLoggerLevelIsShared(t *testing.T) {
+	var buf bytes.Buffer
+	root := newLogger(&buf, levelInfo)
+	child := root.with("worker", "cleanup")
+	root.setLevel(levelDebug)
+	child.debug("visible")
+
+	if !strings.Contains(buf.String(), `"msg":"visible"`) {
+		t.Errorf("Expected the level change to apply to derived loggers. Got %s", buf.String())
+	}
+}
+
+func captureRequestLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := a.logger
+	a.logger = newLogger(&buf, levelInfo)
+	t.Cleanup(func() { a.logger = previous })
+	return &buf
+}
+
+func TestRequestLog(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+	buf := captureRequestLog(t)
+
+	req, _ := http.NewRequest("GET", "/category/"+categoryId, nil)
+	req.Header.Set(requestIDHeader, "client-id-1")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if id := response.Header().Get(requestIDHeader); id != "client-id-1" {
+		t.Errorf("Expected the request ID to be echoed. Got %q", id)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Expected one JSON line. Got %s", buf.String())
+	}
+	for key, want := range map[string]interface{}{
+		"msg":        "request",
+		"request_id": "client-id-1",
+		"method":     "GET",
+		"route":      "/category/{category_id}",
+		"status":     200.0,
+		"bytes":      float64(response.Body.Len()),
+	} {
+		if line[key] != want {
+			t.Errorf("Expected %s to be %v. Got %v", key, want, line[key])
+		}
+	}
+}
+
+func TestRequestIDIsGeneratedForUnsafeValues(t *testing.T) {
+	captureRequestLog(t)
+
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	req.Header.Set(requestIDHeader, "bad id\nwith newline")
+	response := executeRequest(req)
+
+	if id := response.Header().Get(requestIDHeader); !isValidUUID(id) {
+		t.Errorf("Expected a generated UUID request ID. Got %q", id)
+	}
+}
+
+func TestUpdateLogLevel(t *testing.T) {
+	clearTables()
+	key := addAPIKey("", scopeAdmin)
+	captureRequestLog(t)
+
+	req, _ := http.NewRequest("PUT", "/admin/log-level", bytes.NewBufferString(`{"level":"debug"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	a.Config.Log.AdminEndpoint = true
+	t.Cleanup(func() { a.Config.Log.AdminEndpoint = false })
+
+	req, _ = http.NewRequest("PUT", "/admin/log-level", bytes.NewBufferString(`{"level":"debug"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if a.logger.level() != levelDebug {
+		t.Errorf("Expected the level to be debug. Got %s", a.logger.level())
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/log-level", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	response = executeRequest(req)
+	if body := response.Body.String(); body != `{"level":"debug"}` {
+		t.Errorf("Expected the current level. Got %s", body)
+	}
+
+	req, _ = http.NewRequest("PUT", "/admin/log-level", bytes.NewBufferString(`{"level":"verbose"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/admin/log-level", bytes.NewBufferString(`{"level":"error"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	emailDeliveryBatch  = 20
+	maxEmailErrorLength = 512
+)
+
+// mailMessage is an email to a single recipient. html is an alternative to
+// text, which every email has, if set.
+type mailMessage struct {
+	to      string
+	subject string
+	text    string
+	html    string
+}
+
+// queueEmail stores m to be sent by mailSender, with the transaction of
+// whatever caused it.
+func queueEmail(ctx context.Context, db queryer, m mailMessage) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO email_deliveries(recipient, subject, text_body, html_body) VALUES ($1, $2, $3, $4)",
+		m.to, m.subject, m.text, m.html)
+	return err
+}
+
+// validEmailAddress reports whether address is a bare address that can be
+// used as recipient.
+func validEmailAddress(address string) bool {
+	a, err := mail.ParseAddress(address)
+	return err == nil && a.Address == address
+}
+
+// mailSender sends the queued emails through the SMTP server of MailConfig,
+// see sendDue.
+type mailSender struct {
+	db      *sql.DB
+	cfg     MailConfig
+	metrics *metrics
+}
+
+func newMailSender(db *sql.DB, cfg MailConfig, m *metrics) *mailSender {
+	return &mailSender{db: db, cfg: cfg, metrics: m}
+}
+
+// claimedEmail is an email being sent.
+type claimedEmail struct {
+	id       string
+	message  mailMessage
+	attempts int
+}
+
+// claim takes up to emailDeliveryBatch due emails and counts the attempt.
+// Other senders skip them until the lease expires, which only happens if
+// this one stops before recording the outcome.
+func (s *mailSender) claim(ctx context.Context) ([]claimedEmail, error) {
+	lease := s.cfg.Timeout + time.Minute
+	rows, err := s.db.QueryContext(ctx,
+		`UPDATE email_deliveries d SET attempts = d.attempts + 1, last_attempt_at = now(),
+			next_attempt_at = now() + make_interval(secs => $2)
+		WHERE d.delivery_id IN (
+			SELECT c.delivery_id FROM email_deliveries c
+			WHERE c.status = 'pending' AND c.next_attempt_at <= now()
+			ORDER BY c.next_attempt_at LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING d.delivery_id, d.recipient, d.subject, d.text_body, d.html_body, d.attempts`,
+		emailDeliveryBatch, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []claimedEmail
+	for rows.Next() {
+		var e claimedEmail
+		if err := rows.Scan(&e.id, &e.message.to, &e.message.subject, &e.message.text, &e.message.html, &e.attempts); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, e)
+	}
+	return claimed, rows.Err()
+}
+
+// sendDue sends every due email. It can run on several instances at once,
+// each sending different emails.
+func (s *mailSender) sendDue(ctx context.Context) error {
+	for {
+		claimed, err := s.claim(ctx)
+		if err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		for _, e := range claimed {
+			wg.Add(1)
+			go func(e claimedEmail) {
+				defer wg.Done()
+				s.deliver(ctx, e)
+			}(e)
+		}
+		wg.Wait()
+
+		if len(claimed) < emailDeliveryBatch || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// deliver sends e and records the outcome. Failed emails are retried until
+// they run out of attempts.
+func (s *mailSender) deliver(ctx context.Context, e claimedEmail) {
+	sendCtx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	err := s.send(sendCtx, e.message)
+	cancel()
+	if ctx.Err() != nil {
+		// cut short by shutdown, sent again once the lease expires
+		return
+	}
+
+	status, outcome, lastError := deliverySucceeded, deliverySucceeded, ""
+	var retryIn time.Duration
+	if err != nil {
+		lastError = err.Error()
+		if len(lastError) > maxEmailErrorLength {
+			lastError = lastError[:maxEmailErrorLength]
+		}
+		status, outcome = deliveryFailed, deliveryFailed
+		if e.attempts < s.cfg.MaxAttempts {
+			status, outcome = deliveryPending, "retrying"
+			retryIn = s.cfg.retryDelay(e.attempts)
+		}
+		loggerFrom(ctx).warn("email delivery failed", "delivery_id", e.id, "attempt", e.attempts,
+			"retry_in", retryIn.String(), "error", err)
+	}
+	s.metrics.emailDeliveries.inc(outcome)
+
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE email_deliveries SET status=$2, last_error=$3, next_attempt_at = now() + make_interval(secs => $4)
+		WHERE delivery_id=$1`,
+		e.id, status, lastError, retryIn.Seconds(),
+	)
+	if err != nil {
+		loggerFrom(ctx).error("could not record email delivery", "delivery_id", e.id, "error", err)
+	}
+}
+
+// send hands m to the SMTP server. STARTTLS is used if the server offers it,
+// and net/smtp refuses to send credentials without TLS except to localhost.
+func (s *mailSender) send(ctx context.Context, m mailMessage) error {
+	host, _, err := net.SplitHostPort(s.cfg.SMTPAddr)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.cfg.SMTPAddr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.cfg.SMTPUser != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.cfg.SMTPUser, s.cfg.SMTPPassword, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.cfg.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(m.to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(composeEmail(s.cfg.From, m, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// composeEmail formats m as a plain text message, or a multipart/alternative
+// one if it has HTML. The subject is encoded as needed, which also keeps
+// line breaks out of the header.
+func composeEmail(from string, m mailMessage, now time.Time) []byte {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", uuid.New().String(), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if m.html == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuotedPrintable(&b, m.text)
+		return b.Bytes()
+	}
+
+	mw := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	// the last part is the preferred one
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.text},
+		{"text/html; charset=utf-8", m.html},
+	} {
+		w, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writeQuotedPrintable(w, part.body)
+	}
+	mw.Close()
+	return b.Bytes()
+}
+
+func writeQuotedPrintable(w io.Writer, text string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+	qp.Close()
+}
+
+// retryDelay is how long an email waits after its failed attempt number
+// attempts.
+func (c MailConfig) retryDelay(attempts int) time.Duration {
+	return backoff(c.RetryInterval, c.MaxRetryInterval, attempts)
+}
+
+// enabled reports whether an SMTP server is configured.
+func (c MailConfig) enabled() bool {
+	return c.SMTPAddr != ""
+}
@@ -1,18 +1,376 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 )
 
+const usage = `Usage: scheduler <command> [flags]
+
+Commands:
+  serve                    run the HTTP server (default)
+  migrate up|down|status   manage the database schema
+  seed                     insert sample categories and tasks
+  user create              create a user
+  api-key create           create an API key
+  export                   write the categories and tasks of a workspace as JSON
+  import                   load categories and tasks from an export
+
+Data commands work in the default workspace unless -workspace is given.
+
+Run "scheduler <command> -h" for the flags of a command. Flags override the
+environment variables of the same meaning.
+`
+
 func main() {
 	loadEnv()
-	a := App{}
-	a.Initialize(
-		os.Getenv("HOST"),
-		os.Getenv("APP_DB_PORT"),
-		os.Getenv("APP_DB_USERNAME"),
-		os.Getenv("APP_DB_NAME"),
-	)
-	a.Run(fmt.Sprintf(":%s", os.Getenv("PORT")))
+	os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	cmd := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = serveCommand(args, stderr)
+	case "migrate":
+		err = migrateCommand(args, stdout, stderr)
+	case "seed":
+		err = seedCommand(args, stdout, stderr)
+	case "user":
+		err = userCommand(args, stdout, stderr)
+	case "api-key":
+		err = apiKeyCommand(args, stdout, stderr)
+	case "export":
+		err = exportCommand(args, stdout, stderr)
+	case "import":
+		err = importCommand(args, stdout, stderr)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", cmd, usage)
+		return 2
+	}
+
+	switch err {
+	case nil:
+		return 0
+	case flag.ErrHelp:
+		return 0
+	case errCommandUsage:
+		return 2
+	}
+	fmt.Fprintln(stderr, err)
+	return 1
+}
+
+var errCommandUsage = fmt.Errorf("invalid usage")
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// addWorkspaceFlag adds the -workspace flag of commands that work on the
+// data of one workspace.
+func addWorkspaceFlag(fs *flag.FlagSet) *string {
+	return fs.String("workspace", defaultWorkspaceId, "ID of the workspace to work in")
+}
+
+// inWorkspace returns ctx for working in the workspace with id, which must
+// exist.
+func inWorkspace(ctx context.Context, db queryer, id string) (context.Context, error) {
+	id, err := parseWorkspaceId(id)
+	if err != nil {
+		return nil, err
+	}
+	ws := workspace{Workspace_ID: id}
+	if err := ws.getWorkspace(ctx, db); err != nil {
+		return nil, fmt.Errorf("workspace %s: %w", id, err)
+	}
+	return withWorkspace(ctx, currentWorkspace{id: id}), nil
+}
+
+func serveCommand(args []string, stderr io.Writer) error {
+	fs := newFlagSet("serve", stderr)
+	cf := addConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	a := &App{}
+	a.Initialize(cfg)
+	return a.Run()
+}
+
+func migrateCommand(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("migrate", stderr)
+	cf := addConfigFlags(fs)
+	steps := fs.Int("steps", 1, "number of migrations to revert with down")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: scheduler migrate up|down|status [flags]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return errCommandUsage
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	a := &App{}
+	a.Initialize(cfg)
+	defer a.DB.Close()
+	ctx := context.Background()
+
+	switch action {
+	case "up":
+		versions, err := migrateUp(ctx, a.DB)
+		for _, v := range versions {
+			fmt.Fprintf(stdout, "applied %04d\n", v)
+		}
+		if err == nil && len(versions) == 0 {
+			fmt.Fprintln(stdout, "schema is up to date")
+		}
+		return err
+	case "down":
+		versions, err := migrateDown(ctx, a.DB, *steps)
+		for _, v := range versions {
+			fmt.Fprintf(stdout, "reverted %04d\n", v)
+		}
+		return err
+	case "status":
+		statuses, err := migrationStatuses(ctx, a.DB)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied_At != nil {
+				applied = "applied " + s.Applied_At.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(stdout, "%04d  %-28s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	}
+	fs.Usage()
+	return errCommandUsage
+}
+
+func seedCommand(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("seed", stderr)
+	cf := addConfigFlags(fs)
+	workspaceId := addWorkspaceFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	a := &App{}
+	a.Initialize(cfg)
+	defer a.DB.Close()
+	ctx, err := inWorkspace(context.Background(), a.DB, *workspaceId)
+	if err != nil {
+		return err
+	}
+
+	if err := seedData(ctx, a.DB); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "seeded %d categories\n", len(seedCategories))
+	return nil
+}
+
+func userCommand(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("user create", stderr)
+	cf := addConfigFlags(fs)
+	email := fs.String("email", "", "email address of the user")
+	name := fs.String("name", "", "display name of the user")
+	if len(args) == 0 || args[0] != "create" {
+		fmt.Fprintln(stderr, "Usage: scheduler user create -email <email> -name <name> [flags]")
+		return errCommandUsage
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	u := user{Email: *email, Name: *name}
+	if errs := u.validate(); len(errs) > 0 {
+		return errs
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	a := &App{}
+	a.Initialize(cfg)
+	defer a.DB.Close()
+	ctx := context.Background()
+
+	if err := u.createUser(ctx, a.DB); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "created user %s\n", u.User_ID)
+	return nil
+}
+
+func apiKeyCommand(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("api-key create", stderr)
+	cf := addConfigFlags(fs)
+	name := fs.String("name", "", "what the key is used for")
+	scopes := fs.String("scopes", "", "comma separated scopes: "+strings.Join(allScopes, ", "))
+	userId := fs.String("user", "", "user ID for a personal key, none for a service key")
+	expiresIn := fs.Duration("expires-in", 0, "how long the key is valid, 0 for no expiry")
+	workspaceId := fs.String("workspace", "", "ID of the only workspace the key may use, none for all")
+	if len(args) == 0 || args[0] != "create" {
+		fmt.Fprintln(stderr, "Usage: scheduler api-key create -name <name> -scopes <scopes> [flags]")
+		return errCommandUsage
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	in := apiKeyInput{Name: *name, User_ID: *userId, Workspace_ID: *workspaceId}
+	for _, s := range strings.Split(*scopes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			in.Scopes = append(in.Scopes, s)
+		}
+	}
+	if *expiresIn > 0 {
+		expiresAt := time.Now().Add(*expiresIn)
+		in.Expires_At = &expiresAt
+	}
+	if errs := in.validate(); len(errs) > 0 {
+		return errs
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	a := &App{}
+	a.Initialize(cfg)
+	defer a.DB.Close()
+	ctx := context.Background()
+
+	k, err := newAPIKey(in)
+	if err != nil {
+		return err
+	}
+	if err := k.createAPIKey(ctx, a.DB); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "created API key %s, it is only shown once:\n", k.API_Key_ID)
+	fmt.Fprintln(stdout, k.Key)
+	return nil
+}
+
+func exportCommand(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("export", stderr)
+	cf := addConfigFlags(fs)
+	output := fs.String("o", "", "file to write to instead of stdout")
+	workspaceId := addWorkspaceFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	a := &App{}
+	a.Initialize(cfg)
+	defer a.DB.Close()
+	ctx, err := inWorkspace(context.Background(), a.DB, *workspaceId)
+	if err != nil {
+		return err
+	}
+
+	e, err := exportData(ctx, a.DB)
+	if err != nil {
+		return err
+	}
+
+	w := stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(e)
+}
+
+func importCommand(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("import", stderr)
+	cf := addConfigFlags(fs)
+	input := fs.String("i", "", "file to read from instead of stdin")
+	workspaceId := addWorkspaceFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	r := io.Reader(os.Stdin)
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var e export
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return fmt.Errorf("could not read export: %v", err)
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	a := &App{}
+	a.Initialize(cfg)
+	defer a.DB.Close()
+	ctx, err := inWorkspace(context.Background(), a.DB, *workspaceId)
+	if err != nil {
+		return err
+	}
+
+	categories, tasks, err := importData(ctx, a.DB, e)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "imported %d categories and %d tasks\n", categories, tasks)
+	return nil
 }
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"log"
 	"os"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
 	loadEnv()
-	a.Initialize(
-		os.Getenv("HOST"),
-		os.Getenv("APP_DB_PORT"),
-		os.Getenv("APP_DB_USERNAME"),
-		os.Getenv("APP_TEST_DB_NAME"),
-	)
+	cfg := defaultConfig()
+	if err := cfg.loadEnv(); err != nil {
+		log.Fatal(err)
+	}
+	cfg.Database.Name = os.Getenv("APP_TEST_DB_NAME")
+	// keep the request log out of the test output unless asked for
+	if os.Getenv("APP_LOG_LEVEL") == "" {
+		cfg.Log.Level = "error"
+	}
+	// tests send far more requests than any client should, rate limits are
+	// tested with their own App
+	cfg.RateLimit.Reads, cfg.RateLimit.Writes, cfg.RateLimit.Auth = rateLimit{}, rateLimit{}, rateLimit{}
+	a.Initialize(cfg)
 
 	ensureTablesExists()
 	code := m.Run()
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A minimal implementation of the Prometheus text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// routeVariablePattern matches the variables of a mux path template, such as
+// {category_id:[0-9a-f-]+}, so they can be reduced to {category_id}.
+var routeVariablePattern = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (r *metricsRegistry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *metricsRegistry) writeTo(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		c.writeTo(w)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, n, labelValueEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// seriesKey identifies a combination of label values.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// counterVec is a counter partitioned by labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: map[string]*counterSeries{}}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := seriesKey(values)
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: values}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.values), formatFloat(s.value))
+	}
+}
+
+// histogramVec is a histogram partitioned by labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := seriesKey(values)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values), s.count)
+	}
+}
+
+// valueFunc is a single unlabelled value read at scrape time.
+type valueFunc struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+func (f valueFunc) writeTo(w io.Writer) {
+	writeHeader(w, f.name, f.help, f.kind)
+	fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.fn()))
+}
+
+// metrics holds everything the server reports at /metrics.
+type metrics struct {
+	// first so that it is 64-bit aligned for atomic access
+	inFlight int64
+	registry metricsRegistry
+
+	requests        *counterVec
+	requestDuration *histogramVec
+
+	queries       *counterVec
+	queryDuration *histogramVec
+
+	webhookDeliveries *counterVec
+	outboxPublishes   *counterVec
+	remindersFired    *counterVec
+	emailDeliveries   *counterVec
+	digestsSent       *counterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		requests: newCounterVec("http_requests_total",
+			"Number of HTTP requests by route template, method and status code.",
+			"method", "route", "status"),
+		requestDuration: newHistogramVec("http_request_duration_seconds",
+			"Latency of HTTP requests by route template and method.",
+			defaultLatencyBuckets, "method", "route"),
+		queries: newCounterVec("db_queries_total",
+			"Number of database queries by operation, table and outcome.",
+			"operation", "table", "outcome"),
+		queryDuration: newHistogramVec("db_query_duration_seconds",
+			"Latency of database queries by operation and table.",
+			defaultLatencyBuckets, "operation", "table"),
+		webhookDeliveries: newCounterVec("webhook_deliveries_total",
+			"Number of webhook delivery attempts by outcome: succeeded, retrying or failed.",
+			"outcome"),
+		outboxPublishes: newCounterVec("outbox_publishes_total",
+			"Number of attempts to publish an event by sink and outcome: succeeded or failed.",
+			"sink", "outcome"),
+		remindersFired: newCounterVec("reminders_fired_total",
+			"Number of reminders fired."),
+		emailDeliveries: newCounterVec("email_deliveries_total",
+			"Number of attempts to send an email by outcome: succeeded, retrying or failed.",
+			"outcome"),
+		digestsSent: newCounterVec("digests_sent_total",
+			"Number of digests queued to be sent by frequency: daily or weekly.",
+			"frequency"),
+	}
+	m.registry.register(m.requests)
+	m.registry.register(m.requestDuration)
+	m.registry.register(valueFunc{"http_requests_in_flight", "Number of HTTP requests being served.", "gauge",
+		func() float64 { return float64(atomic.LoadInt64(&m.inFlight)) }})
+	m.registry.register(m.queries)
+	m.registry.register(m.queryDuration)
+	m.registry.register(m.webhookDeliveries)
+	m.registry.register(m.outboxPublishes)
+	m.registry.register(m.remindersFired)
+	m.registry.register(m.emailDeliveries)
+	m.registry.register(m.digestsSent)
+	return m
+}
+
+// statusRecorder remembers the status code and size of the response written
+// by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// instrument records every routed request under its route template, so that
+// /category/{category_id}/task/{task_id} is one series however many IDs exist.
+func (a *App) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := routeTemplate(req)
+
+		atomic.AddInt64(&a.metrics.inFlight, 1)
+		defer atomic.AddInt64(&a.metrics.inFlight, -1)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		a.metrics.requests.inc(req.Method, route, strconv.Itoa(rec.status))
+		a.metrics.requestDuration.observe(time.Since(start).Seconds(), req.Method, route)
+	})
+}
+
+// registerDBStats reports the connection pool statistics of db.
+func (m *metrics) registerDBStats(stats func() sql.DBStats) {
+	for _, f := range []valueFunc{
+		{"db_max_open_connections", "Maximum number of open connections to the database.", "gauge",
+			func() float64 { return float64(stats().MaxOpenConnections) }},
+		{"db_open_connections", "Number of established connections, in use and idle.", "gauge",
+			func() float64 { return float64(stats().OpenConnections) }},
+		{"db_in_use_connections", "Number of connections currently in use.", "gauge",
+			func() float64 { return float64(stats().InUse) }},
+		{"db_idle_connections", "Number of idle connections.", "gauge",
+			func() float64 { return float64(stats().Idle) }},
+		{"db_wait_count_total", "Number of connections waited for.", "counter",
+			func() float64 { return float64(stats().WaitCount) }},
+		{"db_wait_duration_seconds_total", "Time spent waiting for a connection.", "counter",
+			func() float64 { return stats().WaitDuration.Seconds() }},
+		{"db_max_idle_closed_total", "Connections closed because of the idle connection limit.", "counter",
+			func() float64 { return float64(stats().MaxIdleClosed) }},
+		{"db_max_idle_time_closed_total", "Connections closed because of the idle time limit.", "counter",
+			func() float64 { return float64(stats().MaxIdleTimeClosed) }},
+		{"db_max_lifetime_closed_total", "Connections closed because of the connection lifetime limit.", "counter",
+			func() float64 { return float64(stats().MaxLifetimeClosed) }},
+	} {
+		m.registry.register(f)
+	}
+}
+
+func (a *App) getMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+	a.metrics.registry.writeTo(w)
+}
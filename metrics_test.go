@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsByRouteTemplate(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+
+	req, _ := http.NewRequest("GET", "/category/"+categoryId, nil)
+	executeRequest(req)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if ct := response.Header().Get("Content-Type"); ct != metricsContentType {
+		t.Errorf("Expected content type %q. Got %q", metricsContentType, ct)
+	}
+	body := response.Body.String()
+	for _, want := range []string{
+		`http_requests_total{method="GET",route="/category/{category_id}",status="200"}`,
+		`http_request_duration_seconds_count{method="GET",route="/category/{category_id}"}`,
+		`db_queries_total{operation="select",table="categories",outcome="ok"}`,
+		"db_open_connections ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected the metrics to contain %s", want)
+		}
+	}
+	if strings.Contains(body, categoryId) {
+		t.Errorf("Expected no series labelled with the category ID")
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	h := newHistogramVec("latency_seconds", "Latency.", []float64{.1, 1}, "route")
+	h.observe(.05, "/a")
+	h.observe(.5, "/a")
+	h.observe(5, "/a")
+
+	var buf bytes.Buffer
+	h.writeTo(&buf)
+	want := strings.Join([]string{
+		"# HELP latency_seconds Latency.",
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{route="/a",le="0.1"} 1`,
+		`latency_seconds_bucket{route="/a",le="1"} 2`,
+		`latency_seconds_bucket{route="/a",le="+Inf"} 3`,
+		`latency_seconds_sum{route="/a"} 5.55`,
+		`latency_seconds_count{route="/a"} 3`,
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("Expected\n%s\nGot\n%s", want, got)
+	}
+}
+
+func TestQueryLabels(t *testing.T) {
+	tests := []struct {
+		query, operation, table string
+	}{
+		{"SELECT name, description FROM categories WHERE category_id=$1", "select", "categories"},
+		{"INSERT INTO tasks(category_id, task) SELECT $1, $2 WHERE EXISTS (SELECT 1 FROM categories)", "insert", "tasks"},
+		{"UPDATE tasks SET complete=$1 WHERE task_id=$2", "update", "tasks"},
+		{"\n\tDELETE FROM idempotency_keys WHERE expires_at < now()", "delete", "idempotency_keys"},
+		{"CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\"", "create", "none"},
+	}
+	for _, tt := range tests {
+		operation, table := queryLabels(tt.query)
+		if got, want := fmt.Sprint(operation, " ", table), fmt.Sprint(tt.operation, " ", tt.table); got != want {
+			t.Errorf("queryLabels(%q) = %s, expected %s", tt.query, got, want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMigrationsArePaired(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("Could not load migrations. Error: %v", err)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("Expected migration %d to have version %d. Got %d", i, i+1, m.Version)
+		}
+	}
+}
+
+func TestMigrationStatusAfterUp(t *testing.T) {
+	statuses, err := migrationStatuses(context.Background(), a.DB)
+	if err != nil {
+		t.Fatalf("Could not read migration status. Error: %v", err)
+	}
+	for _, s := range statuses {
+		if s.Applied_At == nil {
+			t.Errorf("Expected migration %04d_%s to be applied", s.Version, s.Name)
+		}
+	}
+}
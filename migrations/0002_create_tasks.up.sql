@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS tasks
+(
+    task_id SERIAL PRIMARY KEY,
+    category_id uuid references categories,
+    task TEXT NOT NULL,
+    seq SERIAL NOT NULL,
+    complete BOOL NOT NULL
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    key TEXT PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    status INT,
+    content_type TEXT,
+    body BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    api_key_id uuid DEFAULT uuid_generate_v4(),
+    prefix TEXT NOT NULL,
+    key_hash TEXT NOT NULL,
+    name TEXT NOT NULL,
+    user_id uuid REFERENCES users (user_id) ON DELETE CASCADE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    CONSTRAINT api_keys_pkey PRIMARY KEY (api_key_id),
+    CONSTRAINT api_keys_prefix_key UNIQUE (prefix)
+);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS sessions;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_oidc_identity_key;
+ALTER TABLE users DROP COLUMN IF EXISTS oidc_subject;
+ALTER TABLE users DROP COLUMN IF EXISTS oidc_issuer;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS category_group_roles;
+DROP TABLE IF EXISTS category_shares;
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS category_shares
+(
+    category_id uuid NOT NULL REFERENCES categories (category_id) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    role TEXT NOT NULL,
+    -- direct shares are granted explicitly, group shares follow the IdP
+    -- groups of the user at login
+    source TEXT NOT NULL DEFAULT 'direct',
+    CONSTRAINT category_shares_pkey PRIMARY KEY (category_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS category_group_roles
+(
+    category_id uuid NOT NULL REFERENCES categories (category_id) ON DELETE CASCADE,
+    group_name TEXT NOT NULL,
+    role TEXT NOT NULL,
+    CONSTRAINT category_group_roles_pkey PRIMARY KEY (category_id, group_name)
+);
@@ -0,0 +1,5 @@
+ALTER TABLE api_keys DROP COLUMN IF EXISTS workspace_id;
+DROP INDEX IF EXISTS categories_workspace_id_idx;
+ALTER TABLE categories DROP COLUMN IF EXISTS workspace_id;
+DROP TABLE IF EXISTS workspace_members;
+DROP TABLE IF EXISTS workspaces;
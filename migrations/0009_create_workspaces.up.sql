@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS workspaces
+(
+    workspace_id uuid DEFAULT uuid_generate_v4(),
+    name TEXT NOT NULL,
+    time_zone TEXT NOT NULL DEFAULT 'UTC',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT workspaces_pkey PRIMARY KEY (workspace_id)
+);
+
+-- everything created before workspaces lives in the default workspace
+INSERT INTO workspaces(workspace_id, name) VALUES ('00000000-0000-0000-0000-000000000000', 'Default')
+ON CONFLICT (workspace_id) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS workspace_members
+(
+    workspace_id uuid NOT NULL REFERENCES workspaces (workspace_id) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    role TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT workspace_members_pkey PRIMARY KEY (workspace_id, user_id)
+);
+
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS workspace_id uuid NOT NULL
+    DEFAULT '00000000-0000-0000-0000-000000000000' REFERENCES workspaces (workspace_id) ON DELETE CASCADE;
+ALTER TABLE categories ALTER COLUMN workspace_id DROP DEFAULT;
+CREATE INDEX IF NOT EXISTS categories_workspace_id_idx ON categories (workspace_id);
+
+-- keys bound to a workspace cannot be used in any other
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS workspace_id uuid REFERENCES workspaces (workspace_id) ON DELETE CASCADE;
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    webhook_id uuid DEFAULT uuid_generate_v4(),
+    workspace_id uuid NOT NULL REFERENCES workspaces (workspace_id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    -- deliveries are signed with it, so it is kept as is
+    secret TEXT NOT NULL,
+    -- event types or patterns such as task.*; empty for every event
+    events TEXT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT webhooks_pkey PRIMARY KEY (webhook_id)
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_workspace_id_idx ON webhooks (workspace_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    delivery_id uuid DEFAULT uuid_generate_v4(),
+    webhook_id uuid NOT NULL REFERENCES webhooks (webhook_id) ON DELETE CASCADE,
+    -- the same for every delivery of an event, so receivers can deduplicate
+    event_id uuid NOT NULL,
+    event_type TEXT NOT NULL,
+    -- JSON rather than JSONB keeps the payload byte for byte as published
+    payload JSON NOT NULL,
+    -- pending until delivered or out of attempts
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_attempt_at TIMESTAMPTZ,
+    response_status INTEGER,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT webhook_deliveries_pkey PRIMARY KEY (delivery_id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, created_at);
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS outbox
+(
+    event_id uuid NOT NULL,
+    event_type TEXT NOT NULL,
+    -- no foreign key, events of a deleted workspace are still published
+    workspace_id uuid NOT NULL,
+    -- JSON rather than JSONB keeps the payload byte for byte as published
+    payload JSON NOT NULL,
+    -- names of the sinks that accepted the event, so a retry skips them
+    published_to TEXT[] NOT NULL DEFAULT '{}',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- set once every sink accepted the event
+    published_at TIMESTAMPTZ,
+    CONSTRAINT outbox_pkey PRIMARY KEY (event_id)
+);
+
+CREATE INDEX IF NOT EXISTS outbox_due_idx ON outbox (next_attempt_at) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_published_at_idx ON outbox (published_at) WHERE published_at IS NOT NULL;
+
+-- looked up when the outbox hands an event to the webhooks again
+CREATE INDEX IF NOT EXISTS webhook_deliveries_event_id_idx ON webhook_deliveries (event_id);
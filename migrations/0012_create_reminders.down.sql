@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS email_deliveries;
+DROP TABLE IF EXISTS notifications;
+DROP TABLE IF EXISTS reminders;
+ALTER TABLE tasks DROP COLUMN IF EXISTS due_at;
@@ -0,0 +1,58 @@
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS due_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS reminders
+(
+    reminder_id uuid DEFAULT uuid_generate_v4(),
+    task_id INTEGER NOT NULL REFERENCES tasks (task_id) ON DELETE CASCADE,
+    -- who set it, empty for anonymous requests and service keys
+    user_id uuid REFERENCES users (user_id) ON DELETE CASCADE,
+    -- fires at remind_at, or before_due_seconds before the task is due
+    remind_at TIMESTAMPTZ,
+    before_due_seconds INTEGER,
+    channels TEXT[] NOT NULL,
+    -- where email goes, the address of the user if empty
+    email TEXT NOT NULL DEFAULT '',
+    fired_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT reminders_pkey PRIMARY KEY (reminder_id),
+    CONSTRAINT reminders_time_check CHECK ((remind_at IS NULL) <> (before_due_seconds IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS reminders_task_id_idx ON reminders (task_id);
+CREATE INDEX IF NOT EXISTS reminders_unfired_idx ON reminders (created_at) WHERE fired_at IS NULL;
+
+-- the in-app inbox of users
+CREATE TABLE IF NOT EXISTS notifications
+(
+    notification_id uuid DEFAULT uuid_generate_v4(),
+    user_id uuid NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    workspace_id uuid NOT NULL REFERENCES workspaces (workspace_id) ON DELETE CASCADE,
+    -- what it is about, no foreign keys so it outlives the task
+    category_id uuid,
+    task_id INTEGER,
+    title TEXT NOT NULL,
+    body TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    read_at TIMESTAMPTZ,
+    CONSTRAINT notifications_pkey PRIMARY KEY (notification_id)
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, workspace_id, created_at);
+
+CREATE TABLE IF NOT EXISTS email_deliveries
+(
+    delivery_id uuid DEFAULT uuid_generate_v4(),
+    recipient TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    text_body TEXT NOT NULL,
+    -- pending until sent or out of attempts
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_attempt_at TIMESTAMPTZ,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT email_deliveries_pkey PRIMARY KEY (delivery_id)
+);
+
+CREATE INDEX IF NOT EXISTS email_deliveries_due_idx ON email_deliveries (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS digest_subscriptions;
+ALTER TABLE email_deliveries DROP COLUMN IF EXISTS html_body;
+ALTER TABLE tasks DROP COLUMN IF EXISTS completed_at;
@@ -0,0 +1,24 @@
+-- when the task became complete, NULL while incomplete and for tasks that
+-- were complete before
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+
+ALTER TABLE email_deliveries ADD COLUMN IF NOT EXISTS html_body TEXT NOT NULL DEFAULT '';
+
+-- emails summarizing the tasks of a workspace a user can see
+CREATE TABLE IF NOT EXISTS digest_subscriptions
+(
+    user_id uuid NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    workspace_id uuid NOT NULL REFERENCES workspaces (workspace_id) ON DELETE CASCADE,
+    frequency TEXT NOT NULL,
+    -- local HH:MM in time_zone, on working_days only
+    send_time TEXT NOT NULL,
+    time_zone TEXT NOT NULL,
+    working_days TEXT[] NOT NULL,
+    next_send_at TIMESTAMPTZ NOT NULL,
+    -- when the last digest was due, whether sent or left out for being empty
+    last_digest_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT digest_subscriptions_pkey PRIMARY KEY (user_id, workspace_id, frequency)
+);
+
+CREATE INDEX IF NOT EXISTS digest_subscriptions_due_idx ON digest_subscriptions (next_send_at);
@@ -0,0 +1,2 @@
+ALTER TABLE api_keys DROP CONSTRAINT IF EXISTS api_keys_key_hash_key;
+ALTER TABLE api_keys ADD CONSTRAINT api_keys_prefix_key UNIQUE (prefix);
@@ -0,0 +1,4 @@
+-- prefixes only identify keys for people and may collide, keys are looked
+-- up by their hash
+ALTER TABLE api_keys DROP CONSTRAINT IF EXISTS api_keys_prefix_key;
+ALTER TABLE api_keys ADD CONSTRAINT api_keys_key_hash_key UNIQUE (key_hash);
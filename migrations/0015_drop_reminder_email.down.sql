@@ -0,0 +1 @@
+ALTER TABLE reminders ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT '';
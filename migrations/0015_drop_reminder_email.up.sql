@@ -0,0 +1,2 @@
+-- reminders only email the user who set them
+ALTER TABLE reminders DROP COLUMN IF EXISTS email;
@@ -0,0 +1,4 @@
+DELETE FROM idempotency_keys WHERE scope <> '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD CONSTRAINT idempotency_keys_pkey PRIMARY KEY (key);
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS scope;
@@ -0,0 +1,5 @@
+-- keys are only unique per caller and workspace, keys stored before have
+-- no scope and are left to expire
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD CONSTRAINT idempotency_keys_pkey PRIMARY KEY (scope, key);
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// subjectPublisher is a connection to a message broker with NATS-like
+// subjects. id identifies the message for brokers that deduplicate.
+type subjectPublisher interface {
+	publish(ctx context.Context, subject, id string, data []byte) error
+}
+
+// natsSink publishes events on the subject <prefix>.<event type>, such as
+// scheduler.task.created.
+type natsSink struct {
+	conn   subjectPublisher
+	prefix string
+}
+
+func (s natsSink) name() string { return "nats" }
+
+func (s natsSink) publish(ctx context.Context, e outboxEvent) error {
+	return s.conn.publish(ctx, s.prefix+"."+e.eventType, e.id, e.payload)
+}
+
+const natsDefaultPort = "4222"
+
+// natsConn publishes to a NATS server with the core protocol, see
+// https://docs.nats.io/reference/reference-protocols/nats-protocol. Every
+// publish waits for the server to answer a PING, so an error-free publish
+// was received. Messages carry their ID in the Nats-Msg-Id header, which
+// JetStream deduplicates by, if the server supports headers.
+type natsConn struct {
+	addr     string
+	user     string
+	password string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	headers bool
+}
+
+// natsInfo is the part of the INFO the server greets clients with that
+// natsConn needs.
+type natsInfo struct {
+	Headers     bool `json:"headers"`
+	TLSRequired bool `json:"tls_required"`
+}
+
+// newNATSConn parses a nats://[user:password@]host[:port] URL. It connects on
+// the first publish.
+func newNATSConn(rawurl string) (*natsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, errors.New("must be a nats://host:port URL")
+	}
+	c := &natsConn{addr: u.Host}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), natsDefaultPort)
+	}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	return c, nil
+}
+
+func (c *natsConn) publish(ctx context.Context, subject, id string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(ctx); err != nil {
+			return err
+		}
+	}
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+
+	var msg bytes.Buffer
+	if c.headers {
+		header := "NATS/1.0\r\nNats-Msg-Id: " + id + "\r\n\r\n"
+		fmt.Fprintf(&msg, "HPUB %s %d %d\r\n%s", subject, len(header), len(header)+len(data), header)
+	} else {
+		fmt.Fprintf(&msg, "PUB %s %d\r\n", subject, len(data))
+	}
+	msg.Write(data)
+	msg.WriteString("\r\nPING\r\n")
+
+	if _, err := c.conn.Write(msg.Bytes()); err != nil {
+		c.closeLocked()
+		return err
+	}
+	if err := c.awaitPong(); err != nil {
+		c.closeLocked()
+		return err
+	}
+	return nil
+}
+
+// connect opens the connection and introduces the client.
+func (c *natsConn) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	line, err := c.readLine()
+	if err != nil {
+		c.closeLocked()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		c.closeLocked()
+		return fmt.Errorf("unexpected greeting from NATS server: %q", line)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		c.closeLocked()
+		return fmt.Errorf("invalid INFO from NATS server: %w", err)
+	}
+	if info.TLSRequired {
+		c.closeLocked()
+		return errors.New("NATS server requires TLS, which is not supported")
+	}
+	c.headers = info.Headers
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "scheduler",
+		"lang":     "go",
+		"protocol": 1,
+		"headers":  c.headers,
+	}
+	if c.user != "" {
+		options["user"], options["pass"] = c.user, c.password
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		c.closeLocked()
+		return err
+	}
+	// authentication errors are reported before the PONG
+	if err := c.awaitPong(); err != nil {
+		c.closeLocked()
+		return err
+	}
+	return nil
+}
+
+// awaitPong reads until the server answers the last PING.
+func (c *natsConn) awaitPong() error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := c.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *natsConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+}
+
+func (c *natsConn) closeLocked() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.r = nil, nil
+	}
+}
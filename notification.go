@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultNotificationsLimit = 50
+	maxNotificationsLimit     = 500
+)
+
+// notification is an entry of the inbox of a user in a workspace.
+type notification struct {
+	Notification_ID string     `json:"notification_id"`
+	Category_ID     string     `json:"category_id,omitempty"`
+	Task_ID         int        `json:"task_id,omitempty"`
+	Title           string     `json:"title"`
+	Body            string     `json:"body"`
+	Created_At      time.Time  `json:"created_at"`
+	Read_At         *time.Time `json:"read_at,omitempty"`
+}
+
+var (
+	errNotificationNotFound = notFoundError("notification_not_found", "Notification not found")
+	errInboxRequiresUser    = forbiddenError("user_required", "Only users have an inbox")
+)
+
+const notificationColumns = "notification_id, COALESCE(category_id::text, ''), COALESCE(task_id, 0), title, body, created_at, read_at"
+
+func (n *notification) scan(row rowScanner) error {
+	var readAt sql.NullTime
+	if err := row.Scan(&n.Notification_ID, &n.Category_ID, &n.Task_ID, &n.Title, &n.Body, &n.Created_At, &readAt); err != nil {
+		return err
+	}
+	n.Read_At = nullTime(readAt)
+	return nil
+}
+
+func (n *notification) createNotification(ctx context.Context, db queryer, userId, workspaceId string) error {
+	return n.scan(db.QueryRowContext(ctx,
+		`INSERT INTO notifications(user_id, workspace_id, category_id, task_id, title, body)
+		VALUES ($1, $2, NULLIF($3, '')::uuid, NULLIF($4, 0), $5, $6)
+		RETURNING `+notificationColumns,
+		userId, workspaceId, n.Category_ID, n.Task_ID, n.Title, n.Body,
+	))
+}
+
+// getNotifications lists the inbox of userId in the workspace of ctx, newest
+// first.
+func getNotifications(ctx context.Context, db queryer, userId string, unreadOnly bool, limit int) ([]notification, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+notificationColumns+` FROM notifications
+		WHERE user_id=$1 AND workspace_id=$2 AND (NOT $3 OR read_at IS NULL)
+		ORDER BY created_at DESC LIMIT $4`,
+		userId, workspaceFrom(ctx).id, unreadOnly, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []notification{}
+	for rows.Next() {
+		var n notification
+		if err := n.scan(rows); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// markRead marks the notification as read, keeping the time it was first
+// read.
+func (n *notification) markRead(ctx context.Context, db queryer, userId string) error {
+	err := n.scan(db.QueryRowContext(ctx,
+		`UPDATE notifications SET read_at = COALESCE(read_at, now())
+		WHERE notification_id=$1 AND user_id=$2 AND workspace_id=$3
+		RETURNING `+notificationColumns,
+		n.Notification_ID, userId, workspaceFrom(ctx).id,
+	))
+	if err == sql.ErrNoRows {
+		return errNotificationNotFound
+	}
+	return err
+}
+
+func pathNotificationId(req *http.Request) (string, error) {
+	id := mux.Vars(req)["notification_id"]
+	if !isValidUUID(id) {
+		return "", badRequestError("invalid_notification_id", "Invalid notification ID")
+	}
+	return id, nil
+}
+
+// getNotifications is the inbox of the user, newest first. unread=true
+// leaves out what was read and limit caps the length.
+func (a *App) getNotifications(w http.ResponseWriter, req *http.Request) {
+	userId := principalFrom(req.Context()).userId
+	if userId == "" {
+		respondWithProblem(w, req, errInboxRequiresUser)
+		return
+	}
+
+	q := req.URL.Query()
+	unreadOnly := false
+	if u := q.Get("unread"); u != "" {
+		var err error
+		if unreadOnly, err = strconv.ParseBool(u); err != nil {
+			respondWithProblem(w, req, badRequestError("invalid_unread", "Unread must be true or false"))
+			return
+		}
+	}
+	limit := defaultNotificationsLimit
+	if l := q.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxNotificationsLimit {
+			respondWithProblem(w, req, badRequestError("invalid_limit", fmt.Sprintf("Limit must be between 1 and %d", maxNotificationsLimit)))
+			return
+		}
+	}
+
+	notifications, err := getNotifications(req.Context(), a.DB, userId, unreadOnly, limit)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, notifications)
+}
+
+func (a *App) markNotificationRead(w http.ResponseWriter, req *http.Request) {
+	userId := principalFrom(req.Context()).userId
+	if userId == "" {
+		respondWithProblem(w, req, errInboxRequiresUser)
+		return
+	}
+	id, err := pathNotificationId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	n := notification{Notification_ID: id}
+	if err := n.markRead(req.Context(), a.DB, userId); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, n)
+}
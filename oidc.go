@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const loginCookie = "scheduler_login"
+
+// how long a user has to complete the login at the identity provider
+var loginTimeout = 10 * time.Minute
+
+var (
+	errOIDCDisabled = notFoundError("oidc_disabled", "Single sign-on is not configured")
+	errLoginFailed  = &appError{Kind: kindUnauthorized, Code: "login_failed", Message: "Login failed, please try again"}
+)
+
+// oidcDiscovery is the part of the provider metadata at
+// /.well-known/openid-configuration that is needed here.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	NotBefore     int64    `json:"nbf"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	// read from OIDCConfig.GroupsClaim
+	Groups []string `json:"-"`
+}
+
+// oidcProvider signs users in with the authorization code flow and PKCE.
+// The provider metadata is discovered on first use.
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      *keySet
+}
+
+func newOIDCProvider(cfg OIDCConfig) *oidcProvider {
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, *keySet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, p.keys, nil
+	}
+
+	var d oidcDiscovery
+	if err := getJSON(ctx, p.client, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, nil, fmt.Errorf("discovering %s: %w", p.cfg.Issuer, err)
+	}
+	if d.Issuer != p.cfg.Issuer {
+		return nil, nil, fmt.Errorf("discovering %s: metadata is for issuer %s", p.cfg.Issuer, d.Issuer)
+	}
+	p.discovery = &d
+	p.keys = newKeySet(d.JWKSURI, p.client)
+	return p.discovery, p.keys, nil
+}
+
+func (p *oidcProvider) authCodeURL(d *oidcDiscovery, state, nonce, verifier string) string {
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.scopes(), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// exchange redeems an authorization code for the ID token.
+func (p *oidcProvider) exchange(ctx context.Context, d *oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: %s: %s %s", res.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: no id_token in response")
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the signature and the claims of an ID token as in
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func (p *oidcProvider) verifyIDToken(ctx context.Context, keys *keySet, raw, nonce string, now time.Time) (*idTokenClaims, error) {
+	var payload json.RawMessage
+	if err := verifyJWT(ctx, keys, raw, &payload); err != nil {
+		return nil, err
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+
+	switch {
+	case claims.Issuer != p.cfg.Issuer:
+		return nil, fmt.Errorf("%w: issued by %s", errInvalidToken, claims.Issuer)
+	case !containsString(claims.Audience, p.cfg.ClientID):
+		return nil, fmt.Errorf("%w: not issued for this client", errInvalidToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", errInvalidToken)
+	case now.After(time.Unix(claims.Expiry, 0).Add(jwtClockSkew)):
+		return nil, fmt.Errorf("%w: expired", errInvalidToken)
+	case claims.NotBefore != 0 && now.Add(jwtClockSkew).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce mismatch", errInvalidToken)
+	}
+
+	var extra map[string]interface{}
+	json.Unmarshal(payload, &extra)
+	switch groups := extra[p.cfg.GroupsClaim].(type) {
+	case string:
+		claims.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				claims.Groups = append(claims.Groups, s)
+			}
+		}
+	}
+	return &claims, nil
+}
+
+// provisionUser finds or creates the user for the identity in claims. A
+// user created before single sign-on is linked by a verified email address.
+func provisionUser(ctx context.Context, db queryer, claims *idTokenClaims) (*user, error) {
+	u := &user{Email: claims.Email, Name: claims.Name}
+	if u.Name == "" {
+		u.Name = claims.Email
+	}
+
+	err := db.QueryRowContext(ctx,
+		"UPDATE users SET email=$3, name=$4 WHERE oidc_issuer=$1 AND oidc_subject=$2 RETURNING user_id",
+		claims.Issuer, claims.Subject, u.Email, u.Name,
+	).Scan(&u.User_ID)
+	if err != sql.ErrNoRows {
+		return u, dbError(err)
+	}
+
+	if claims.EmailVerified {
+		err = db.QueryRowContext(ctx,
+			"UPDATE users SET oidc_issuer=$1, oidc_subject=$2, name=$4 WHERE email=$3 AND oidc_subject IS NULL RETURNING user_id",
+			claims.Issuer, claims.Subject, u.Email, u.Name,
+		).Scan(&u.User_ID)
+		if err != sql.ErrNoRows {
+			return u, dbError(err)
+		}
+	}
+
+	err = db.QueryRowContext(ctx,
+		"INSERT INTO users(email, name, oidc_issuer, oidc_subject) VALUES ($1, $2, $3, $4) RETURNING user_id",
+		u.Email, u.Name, claims.Issuer, claims.Subject,
+	).Scan(&u.User_ID)
+	return u, dbError(err)
+}
+
+// loginState travels in a cookie from /auth/login to /auth/callback.
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// safeReturnPath only allows redirects to paths on this server.
+func safeReturnPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+func (a *App) secureCookies() bool {
+	return strings.HasPrefix(a.Config.OIDC.RedirectURL, "https://")
+}
+
+// login sends the user to the identity provider.
+func (a *App) login(w http.ResponseWriter, req *http.Request) {
+	if a.oidc == nil {
+		respondWithProblem(w, req, errOIDCDisabled)
+		return
+	}
+	d, _, err := a.oidc.discover(req.Context())
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	var s loginState
+	for _, v := range []*string{&s.State, &s.Nonce, &s.Verifier} {
+		if *v, err = randomToken(); err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+	}
+	s.ReturnTo = safeReturnPath(req.URL.Query().Get("return_to"))
+	value, _ := json.Marshal(s)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/auth/",
+		MaxAge:   int(loginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   a.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, a.oidc.authCodeURL(d, s.State, s.Nonce, s.Verifier), http.StatusFound)
+}
+
+// callback completes the login: it redeems the code, provisions the user,
+// updates their group shares and starts a session.
+func (a *App) callback(w http.ResponseWriter, req *http.Request) {
+	if a.oidc == nil {
+		respondWithProblem(w, req, errOIDCDisabled)
+		return
+	}
+	ctx := req.Context()
+	l := loggerFrom(ctx)
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/auth/", MaxAge: -1, HttpOnly: true, Secure: a.secureCookies()})
+
+	var s loginState
+	cookie, err := req.Cookie(loginCookie)
+	if err == nil {
+		err = decodeSegment(cookie.Value, &s)
+	}
+	q := req.URL.Query()
+	if err != nil || s.State == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(s.State)) != 1 {
+		l.warn("login failed", "error", "state mismatch")
+		respondUnauthorized(w, req, errLoginFailed)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		l.warn("login failed", "error", e, "description", q.Get("error_description"))
+		respondUnauthorized(w, req, errLoginFailed)
+		return
+	}
+
+	d, keys, err := a.oidc.discover(ctx)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	raw, err := a.oidc.exchange(ctx, d, q.Get("code"), s.Verifier)
+	if err != nil {
+		l.warn("login failed", "error", err)
+		respondUnauthorized(w, req, errLoginFailed)
+		return
+	}
+	claims, err := a.oidc.verifyIDToken(ctx, keys, raw, s.Nonce, time.Now())
+	if err == nil && claims.Email == "" {
+		err = fmt.Errorf("no email claim for %s", claims.Subject)
+	}
+	if err != nil {
+		l.warn("login failed", "error", err)
+		respondUnauthorized(w, req, errLoginFailed)
+		return
+	}
+
+	var u *user
+	var token string
+	err = inTransaction(ctx, a.DB, func(tx *sql.Tx) error {
+		var err error
+		if u, err = provisionUser(ctx, tx, claims); err != nil {
+			return err
+		}
+		if err := syncGroupShares(ctx, tx, u.User_ID, claims.Groups); err != nil {
+			return err
+		}
+		token, err = createSession(ctx, tx, u.User_ID, a.Config.Auth.SessionTTL)
+		return err
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	setRequestUser(ctx, u.User_ID)
+	l.info("user logged in", "user", u.User_ID, "groups", strings.Join(claims.Groups, ","))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(a.Config.Auth.SessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   a.secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, s.ReturnTo, http.StatusSeeOther)
+}
+
+// logout ends the session of the request, if any.
+func (a *App) logout(w http.ResponseWriter, req *http.Request) {
+	if cookie, err := req.Cookie(sessionCookie); err == nil {
+		if err := deleteSession(req.Context(), a.DB, cookie.Value); err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: a.secureCookies()})
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
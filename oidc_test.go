@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OpenID Connect provider that logs in whoever it is told
+// to. It checks the PKCE verifier like a real provider would.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu      sync.Mutex
+	claims  map[string]interface{}
+	pending map[string]url.Values
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, pending: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		respondWithJSON(w, http.StatusOK, oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "test",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		code, _ := randomToken()
+		m.mu.Lock()
+		m.pending[code] = q
+		m.mu.Unlock()
+		http.Redirect(w, req, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		m.mu.Lock()
+		q, ok := m.pending[req.PostForm.Get("code")]
+		delete(m.pending, req.PostForm.Get("code"))
+		m.mu.Unlock()
+		if !ok || pkceChallenge(req.PostForm.Get("code_verifier")) != q.Get("code_challenge") {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := m.idClaims(q.Get("client_id"), q.Get("nonce"))
+		respondWithJSON(w, http.StatusOK, map[string]string{"id_token": m.sign(t, claims), "token_type": "Bearer"})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// logInAs sets the claims of the next ID tokens.
+func (m *mockIssuer) logInAs(claims map[string]interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims = claims
+}
+
+func (m *mockIssuer) idClaims(clientId, nonce string) map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	claims := map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   clientId,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	return claims
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	return signJWT(t, m.key, "test", claims)
+}
+
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testOIDCConfig(issuer string) OIDCConfig {
+	return OIDCConfig{
+		Issuer:      issuer,
+		ClientID:    "scheduler",
+		RedirectURL: "http://scheduler.test/auth/callback",
+		GroupsClaim: "groups",
+	}
+}
+
+func useOIDC(t *testing.T, issuer string) {
+	previous, previousProvider := a.Config.OIDC, a.oidc
+	a.Config.OIDC = testOIDCConfig(issuer)
+	a.oidc = newOIDCProvider(a.Config.OIDC)
+	t.Cleanup(func() { a.Config.OIDC, a.oidc = previous, previousProvider })
+}
+
+// logIn runs the login flow against the mock issuer and returns the
+// session cookie.
+func logIn(t *testing.T, returnTo string) *http.Cookie {
+	req, _ := http.NewRequest("GET", "/auth/login?return_to="+url.QueryEscape(returnTo), nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusFound, response.Code)
+	state := findCookie(response.Result().Cookies(), loginCookie)
+	if state == nil {
+		t.Fatal("Expected a login cookie")
+	}
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := noRedirects.Get(response.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	callback, _ := url.Parse(res.Header.Get("Location"))
+
+	req, _ = http.NewRequest("GET", "/auth/callback?"+callback.RawQuery, nil)
+	req.AddCookie(state)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusSeeOther, response.Code)
+	if location := response.Header().Get("Location"); location != returnTo {
+		t.Errorf("Expected to return to %s. Got %s", returnTo, location)
+	}
+	session := findCookie(response.Result().Cookies(), sessionCookie)
+	if session == nil {
+		t.Fatal("Expected a session cookie")
+	}
+	return session
+}
+
+func findCookie(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, c := range cookies {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	clearTables()
+	issuer := newMockIssuer(t)
+	useOIDC(t, issuer.URL)
+	useAnonymousScopes(t)
+
+	shared := category{Name: "Platform"}
+	shared.createCategory(context.Background(), a.DB)
+	shared.setGroupRole(context.Background(), a.DB, groupRole{Group: "engineering", Role: roleEditor})
+	addCategory()
+
+	issuer.logInAs(map[string]interface{}{
+		"sub":            "ada",
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"name":           "Ada",
+		"groups":         []string{"engineering"},
+	})
+	session := logIn(t, "/categories")
+
+	var u user
+	if err := a.DB.QueryRow("SELECT user_id, name FROM users WHERE oidc_subject='ada'").Scan(&u.User_ID, &u.Name); err != nil || u.Name != "Ada" {
+		t.Fatalf("Expected the user to be created. Got %+v, %v", u, err)
+	}
+
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	req.AddCookie(session)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var categories []category
+	json.Unmarshal(response.Body.Bytes(), &categories)
+	if len(categories) != 1 || categories[0].Category_ID != shared.Category_ID {
+		t.Errorf("Expected only the category shared with engineering. Got %+v", categories)
+	}
+
+	req, _ = http.NewRequest("PUT", "/category/"+shared.Category_ID, strings.NewReader(`{"name":"Platform","description":"Edited"}`))
+	req.AddCookie(session)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("DELETE", "/category/"+shared.Category_ID, nil)
+	req.AddCookie(session)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/auth/logout", nil)
+	req.AddCookie(session)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.AddCookie(session)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+}
+
+func TestLoginLinksExistingUser(t *testing.T) {
+	clearTables()
+	issuer := newMockIssuer(t)
+	useOIDC(t, issuer.URL)
+	existing := user{Email: "grace@example.com", Name: "Grace"}
+	existing.createUser(context.Background(), a.DB)
+
+	issuer.logInAs(map[string]interface{}{"sub": "grace", "email": "grace@example.com", "email_verified": true})
+	logIn(t, "/")
+	issuer.logInAs(map[string]interface{}{"sub": "grace", "email": "grace@example.com", "email_verified": true, "groups": []string{}})
+	logIn(t, "/")
+
+	var count int
+	a.DB.QueryRow("SELECT count(*) FROM users WHERE oidc_subject='grace' AND user_id=$1", existing.User_ID).Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected the existing user to be linked once")
+	}
+}
+
+func TestLoginRejectsForgedState(t *testing.T) {
+	clearTables()
+	issuer := newMockIssuer(t)
+	useOIDC(t, issuer.URL)
+
+	req, _ := http.NewRequest("GET", "/auth/login", nil)
+	state := findCookie(executeRequest(req).Result().Cookies(), loginCookie)
+
+	req, _ = http.NewRequest("GET", "/auth/callback?code=stolen&state=forged", nil)
+	req.AddCookie(state)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	if findCookie(response.Result().Cookies(), sessionCookie) != nil {
+		t.Errorf("Expected no session to be started")
+	}
+}
+
+func TestLoginDisabled(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/auth/login", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "oidc_disabled" {
+		t.Errorf("Expected code 'oidc_disabled'. Got '%v'", p.Code)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	issuer := newMockIssuer(t)
+	p := newOIDCProvider(testOIDCConfig(issuer.URL))
+	keys := newKeySet(issuer.URL+"/jwks", http.DefaultClient)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	now := time.Now()
+
+	valid := func(change func(map[string]interface{})) map[string]interface{} {
+		claims := issuer.idClaims("scheduler", "n0nce")
+		claims["sub"] = "ada"
+		claims["groups"] = []string{"engineering", "ops"}
+		if change != nil {
+			change(claims)
+		}
+		return claims
+	}
+
+	claims, err := p.verifyIDToken(context.Background(), keys, issuer.sign(t, valid(nil)), "n0nce", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "ada" || len(claims.Groups) != 2 {
+		t.Errorf("Expected subject and groups to be read. Got %+v", claims)
+	}
+
+	for name, token := range map[string]string{
+		"wrong audience": issuer.sign(t, valid(func(c map[string]interface{}) { c["aud"] = []string{"someone-else"} })),
+		"wrong issuer":   issuer.sign(t, valid(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })),
+		"expired":        issuer.sign(t, valid(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() })),
+		"not yet valid":  issuer.sign(t, valid(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() })),
+		"wrong nonce":    issuer.sign(t, valid(func(c map[string]interface{}) { c["nonce"] = "replayed" })),
+		"no subject":     issuer.sign(t, valid(func(c map[string]interface{}) { delete(c, "sub") })),
+		"wrong key":      signJWT(t, other, "test", valid(nil)),
+		"malformed":      "not.a.token",
+	} {
+		if _, err := p.verifyIDToken(context.Background(), keys, token, "n0nce", now); !errors.Is(err, errInvalidToken) {
+			t.Errorf("%s: expected an invalid token. Got %v", name, err)
+		}
+	}
+}
+
+func TestSafeReturnPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/categories":            "/categories",
+		"":                       "/",
+		"https://evil.example":   "/",
+		"//evil.example":         "/",
+		"/\\evil.example":        "/",
+		"categories":             "/",
+		"/category/1?tab=shares": "/category/1?tab=shares",
+	} {
+		if got := safeReturnPath(path); got != expected {
+			t.Errorf("Expected %q for %q. Got %q", expected, path, got)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage renders openapi.json in the browser. It does not load any
+// third-party code, so the docs cannot be tampered with through a CDN.
+//
+//go:embed docs.html
+var docsPage []byte
+
+func (a *App) getOpenAPISpec(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+func (a *App) getDocs(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(docsPage)
+}
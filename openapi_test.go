@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// routes which are not part of the API itself
+var undocumentedRoutes = map[string]bool{
+	"/openapi.json":    true,
+	"/docs":            true,
+	"/healthz":         true,
+	"/readyz":          true,
+	"/metrics":         true,
+	"/admin/log-level": true,
+}
+
+func loadSpec(t *testing.T) map[string]interface{} {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("Could not parse openapi.json. Error: %v", err)
+	}
+	return spec
+}
+
+// resolve follows a local "#/a/b" reference within the spec.
+func resolve(t *testing.T, spec map[string]interface{}, node map[string]interface{}) map[string]interface{} {
+	ref, ok := node["$ref"].(string)
+	if !ok {
+		return node
+	}
+	var cur interface{} = spec
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			t.Fatalf("Could not resolve %s", ref)
+		}
+		cur = m[part]
+	}
+	m, ok := cur.(map[string]interface{})
+	if !ok {
+		t.Fatalf("Could not resolve %s", ref)
+	}
+	return resolve(t, spec, m)
+}
+
+// validateSchema reports every place where value does not match schema.
+func validateSchema(t *testing.T, spec, schema map[string]interface{}, value interface{}, path string) []string {
+	schema = resolve(t, spec, schema)
+	var errs []string
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected object", path)}
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := obj[r.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required property %s", path, r))
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for k, v := range obj {
+			prop, ok := props[k].(map[string]interface{})
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: undocumented property %s", path, k))
+				continue
+			}
+			errs = append(errs, validateSchema(t, spec, prop, v, path+"."+k)...)
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected array", path)}
+		}
+		items := schema["items"].(map[string]interface{})
+		for i, v := range arr {
+			errs = append(errs, validateSchema(t, spec, items, v, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected string", path))
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			errs = append(errs, fmt.Sprintf("%s: expected integer", path))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected boolean", path))
+		}
+	}
+	return errs
+}
+
+func TestOpenAPIDocumentsAllRoutes(t *testing.T) {
+	spec := loadSpec(t)
+	paths := spec["paths"].(map[string]interface{})
+
+	registered := map[string]bool{}
+	a.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || undocumentedRoutes[tmpl] {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		path := routeVariablePattern.ReplaceAllString(tmpl, "{$1}")
+		for _, m := range methods {
+			method := strings.ToLower(m)
+			registered[method+" "+path] = true
+
+			item, ok := paths[path].(map[string]interface{})
+			if !ok || item[method] == nil {
+				t.Errorf("Route %s %s is not documented in openapi.json", m, path)
+			}
+		}
+		return nil
+	})
+
+	for path, item := range paths {
+		for method, op := range item.(map[string]interface{}) {
+			if method == "parameters" {
+				continue
+			}
+			if !registered[method+" "+path] {
+				t.Errorf("Operation %s %s is documented but not registered", strings.ToUpper(method), path)
+			}
+
+			responses := op.(map[string]interface{})["responses"].(map[string]interface{})
+			for status, r := range responses {
+				response := resolve(t, spec, r.(map[string]interface{}))
+				content, _ := response["content"].(map[string]interface{})
+				for contentType, c := range content {
+					if _, ok := c.(map[string]interface{})["schema"]; !ok {
+						t.Errorf("Response %s of %s %s has no schema for %s", status, method, path, contentType)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestOpenAPIResponsesMatchSpec(t *testing.T) {
+	spec := loadSpec(t)
+	paths := spec["paths"].(map[string]interface{})
+
+	clearTables()
+	categoryId := addCategory()
+	taskId := addTaskToCategory(categoryId)
+	missingId := "b119178b-2fd2-4a5c-9301-190c341df180"
+
+	// the other resources are used by a user who administers a workspace
+	userId, _ := addSession(t, "spec@example.com")
+	memberId, _ := addSession(t, "member@example.com")
+	key := addAPIKey(userId, allScopes...)
+	useMailSender(t, newFakeSMTPServer(t), 3)
+	workspaceId := addWorkspace(t, "Spec")
+	ws := workspace{Workspace_ID: workspaceId}
+	if err := ws.setMember(context.Background(), a.DB, &workspaceMember{User_ID: userId, Role: workspaceRoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	var wsCategoryId string
+	a.DB.QueryRow("INSERT INTO categories(name, description, workspace_id) VALUES('Spec', '', $1) RETURNING category_id", workspaceId).Scan(&wsCategoryId)
+	wsTaskId := addTaskToCategory(wsCategoryId)
+	n := notification{Title: "Spec", Body: "Spec"}
+	if err := n.createNotification(context.Background(), a.DB, userId, workspaceId); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "/webhooks", bytes.NewBufferString(`{"url":"https://example.com/hook"}`))
+	req.Header.Set(workspaceHeader, workspaceId)
+	req.Header.Set("Authorization", "Bearer "+key)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var wh webhook
+	json.Unmarshal(response.Body.Bytes(), &wh)
+	remindersURL := fmt.Sprintf("/category/%v/task/%v/reminders", wsCategoryId, wsTaskId)
+
+	cases := []struct {
+		method string
+		path   string
+		url    string
+		body   string
+		asUser bool
+	}{
+		{"GET", "/categories", "/categories", "", false},
+		{"POST", "/category", "/category", `{"name":"Spec category","description":""}`, false},
+		{"POST", "/category", "/category", `{"name":""}`, false},
+		{"GET", "/category/{category_id}", "/category/" + categoryId, "", false},
+		{"GET", "/category/{category_id}", "/category/" + missingId, "", false},
+		{"PUT", "/category/{category_id}", "/category/" + categoryId, `{"name":"Renamed","description":"Changed"}`, false},
+		{"GET", "/category/{category_id}/tasks", fmt.Sprintf("/category/%v/tasks", categoryId), "", false},
+		{"POST", "/category/{category_id}/task", fmt.Sprintf("/category/%v/task", categoryId), `{"task":"Spec task"}`, false},
+		{"POST", "/category/{category_id}/task", fmt.Sprintf("/category/%v/task", missingId), `{"task":"Spec task"}`, false},
+		{"GET", "/category/{category_id}/task/{task_id}", fmt.Sprintf("/category/%v/task/%v", categoryId, taskId), "", false},
+		{"PUT", "/category/{category_id}/task/{task_id}", fmt.Sprintf("/category/%v/task/%v", categoryId, taskId), `{"task":"Updated","complete":true}`, false},
+		{"POST", "/category/{category_id}/tasks:batch", fmt.Sprintf("/category/%v/tasks:batch", categoryId), `{"operations":[{"op":"create","task":"Batch task"}]}`, false},
+		{"POST", "/category/{category_id}/tasks:batch", fmt.Sprintf("/category/%v/tasks:batch", categoryId), `{"operations":[{"op":"delete","task_id":999}]}`, false},
+		{"DELETE", "/category/{category_id}/task/{task_id}", fmt.Sprintf("/category/%v/task/%v", categoryId, taskId), "", false},
+		{"DELETE", "/category/{category_id}", "/category/" + categoryId, "", false},
+
+		{"GET", "/category/{category_id}/group-roles", "/category/" + wsCategoryId + "/group-roles", "", true},
+		{"PUT", "/category/{category_id}/group-roles/{group}", "/category/" + wsCategoryId + "/group-roles/engineering", `{"role":"editor"}`, true},
+		{"PUT", "/category/{category_id}/group-roles/{group}", "/category/" + wsCategoryId + "/group-roles/engineering", `{"role":"emperor"}`, true},
+		{"DELETE", "/category/{category_id}/group-roles/{group}", "/category/" + missingId + "/group-roles/engineering", "", true},
+		{"POST", "/category/{category_id}/task/{task_id}/reminders", remindersURL, `{"remind_at":"2100-01-01T00:00:00Z","channels":["inbox"]}`, true},
+		{"POST", "/category/{category_id}/task/{task_id}/reminders", remindersURL, `{"channels":[]}`, true},
+		{"GET", "/category/{category_id}/task/{task_id}/reminders", remindersURL, "", true},
+		{"GET", "/notifications", "/notifications", "", true},
+		{"POST", "/notifications/{notification_id}:read", "/notifications/" + n.Notification_ID + ":read", "", true},
+		{"POST", "/notifications/{notification_id}:read", "/notifications/" + missingId + ":read", "", true},
+		{"PUT", "/digests/{frequency}", "/digests/weekly", `{}`, true},
+		{"PUT", "/digests/{frequency}", "/digests/daily", `{"send_time":"25:00"}`, true},
+		{"GET", "/digests", "/digests", "", true},
+		{"DELETE", "/digests/{frequency}", "/digests/daily", "", true},
+		{"GET", "/workspaces", "/workspaces", "", true},
+		{"POST", "/workspaces", "/workspaces", `{"name":"Spec workspace"}`, true},
+		{"POST", "/workspaces", "/workspaces", `{"name":""}`, true},
+		{"GET", "/workspaces/{workspace_id}", "/workspaces/" + workspaceId, "", true},
+		{"GET", "/workspaces/{workspace_id}", "/workspaces/" + missingId, "", true},
+		{"PUT", "/workspaces/{workspace_id}/members/{user_id}", "/workspaces/" + workspaceId + "/members/" + memberId, `{"role":"member"}`, true},
+		{"PUT", "/workspaces/{workspace_id}/members/{user_id}", "/workspaces/" + workspaceId + "/members/" + memberId, `{"role":"emperor"}`, true},
+		{"GET", "/workspaces/{workspace_id}/members", "/workspaces/" + workspaceId + "/members", "", true},
+		{"DELETE", "/workspaces/{workspace_id}/members/{user_id}", "/workspaces/" + workspaceId + "/members/" + userId, "", true},
+		{"GET", "/webhooks", "/webhooks", "", true},
+		{"POST", "/webhooks", "/webhooks", `{"url":"ftp://example.com"}`, true},
+		{"GET", "/webhooks/{webhook_id}", "/webhooks/" + missingId, "", true},
+		{"GET", "/webhooks/{webhook_id}/deliveries", "/webhooks/" + wh.Webhook_ID + "/deliveries", "", true},
+		{"POST", "/webhooks/{webhook_id}/deliveries/{delivery_id}:redeliver", "/webhooks/" + wh.Webhook_ID + "/deliveries/" + missingId + ":redeliver", "", true},
+		{"POST", "/api-keys", "/api-keys", `{"name":"Spec","scopes":["categories:read"]}`, true},
+		{"POST", "/api-keys", "/api-keys", `{"name":"Spec","scopes":["everything"]}`, true},
+		{"GET", "/api-keys", "/api-keys", "", true},
+		{"GET", "/api-keys/{api_key_id}", "/api-keys/" + missingId, "", true},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, c.url, bytes.NewBufferString(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		if c.asUser {
+			req.Header.Set(workspaceHeader, workspaceId)
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		response := executeRequest(req)
+
+		op := paths[c.path].(map[string]interface{})[strings.ToLower(c.method)].(map[string]interface{})
+		r, ok := op["responses"].(map[string]interface{})[strconv.Itoa(response.Code)]
+		if !ok {
+			t.Errorf("%s %s: status %d is not documented", c.method, c.url, response.Code)
+			continue
+		}
+
+		contentType, _, _ := mime.ParseMediaType(response.Header().Get("Content-Type"))
+		content, _ := resolve(t, spec, r.(map[string]interface{}))["content"].(map[string]interface{})
+		media, ok := content[contentType].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s %s: content type %s is not documented for status %d", c.method, c.url, contentType, response.Code)
+			continue
+		}
+
+		var body interface{}
+		json.Unmarshal(response.Body.Bytes(), &body)
+		for _, e := range validateSchema(t, spec, media["schema"].(map[string]interface{}), body, "body") {
+			t.Errorf("%s %s: %s", c.method, c.url, e)
+		}
+	}
+}
+
+func TestDocsLoadNoThirdPartyCode(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/docs", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if strings.Contains(response.Body.String(), "<script src=") {
+		t.Errorf("Expected the docs to embed all of their scripts")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Events are written to the outbox with the transaction of the change they
+// describe, see publishEvent, and handed from there to every sink by
+// outboxRelay. A sink that fails is retried until it accepts the event, and
+// one that accepted it may get it again if the relay stops before recording
+// that, so sinks must deduplicate by event ID. Events are not ordered.
+
+const (
+	outboxBatch           = 50
+	maxOutboxErrorLength  = 512
+	outboxCleanupInterval = time.Hour
+)
+
+// outboxEvent is an event as the relay hands it to sinks: its payload is the
+// event marshalled by publishEvent.
+type outboxEvent struct {
+	id          string
+	eventType   string
+	workspaceId string
+	payload     []byte
+	attempts    int
+	publishedTo []string
+}
+
+// eventSink is somewhere events are published to.
+type eventSink interface {
+	// name identifies the sink in the outbox, so it must not change
+	name() string
+	publish(ctx context.Context, e outboxEvent) error
+}
+
+// outboxRelay publishes the events of the outbox to its sinks.
+type outboxRelay struct {
+	db      *sql.DB
+	cfg     OutboxConfig
+	sinks   []eventSink
+	metrics *metrics
+}
+
+func newOutboxRelay(db *sql.DB, cfg OutboxConfig, m *metrics, sinks ...eventSink) *outboxRelay {
+	return &outboxRelay{db: db, cfg: cfg, sinks: sinks, metrics: m}
+}
+
+// claim leases up to outboxBatch due events. Other relays skip them until
+// the lease expires, which only happens if this one stops before recording
+// the outcome.
+func (r *outboxRelay) claim(ctx context.Context) ([]outboxEvent, error) {
+	lease := time.Duration(len(r.sinks))*r.cfg.Timeout + time.Minute
+	rows, err := r.db.QueryContext(ctx,
+		`UPDATE outbox o SET attempts = o.attempts + 1, next_attempt_at = now() + make_interval(secs => $2)
+		WHERE o.event_id IN (
+			SELECT c.event_id FROM outbox c
+			WHERE c.published_at IS NULL AND c.next_attempt_at <= now()
+			ORDER BY c.next_attempt_at LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING o.event_id, o.event_type, o.workspace_id, o.payload, o.attempts, o.published_to`,
+		outboxBatch, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []outboxEvent
+	for rows.Next() {
+		var e outboxEvent
+		if err := rows.Scan(&e.id, &e.eventType, &e.workspaceId, &e.payload, &e.attempts, pq.Array(&e.publishedTo)); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, e)
+	}
+	return claimed, rows.Err()
+}
+
+// relayDue publishes every due event. It can run on several instances at
+// once, each publishing different events.
+func (r *outboxRelay) relayDue(ctx context.Context) error {
+	for {
+		claimed, err := r.claim(ctx)
+		if err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		for _, e := range claimed {
+			wg.Add(1)
+			go func(e outboxEvent) {
+				defer wg.Done()
+				r.relay(ctx, e)
+			}(e)
+		}
+		wg.Wait()
+
+		if len(claimed) < outboxBatch || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// relay hands e to every sink that has not accepted it yet and records which
+// did. e is published once all of them have.
+func (r *outboxRelay) relay(ctx context.Context, e outboxEvent) {
+	var lastError string
+	for _, s := range r.sinks {
+		if containsString(e.publishedTo, s.name()) {
+			continue
+		}
+		if err := r.publish(ctx, s, e); err != nil {
+			if ctx.Err() != nil {
+				// cut short by shutdown, published again once the lease expires
+				return
+			}
+			r.metrics.outboxPublishes.inc(s.name(), "failed")
+			loggerFrom(ctx).warn("could not publish event", "event_id", e.id, "event_type", e.eventType,
+				"sink", s.name(), "attempt", e.attempts, "error", err)
+			lastError = fmt.Sprintf("%s: %v", s.name(), err)
+			if len(lastError) > maxOutboxErrorLength {
+				lastError = lastError[:maxOutboxErrorLength]
+			}
+			continue
+		}
+		r.metrics.outboxPublishes.inc(s.name(), "succeeded")
+		e.publishedTo = append(e.publishedTo, s.name())
+	}
+
+	published := lastError == ""
+	var retryIn time.Duration
+	if !published {
+		retryIn = r.cfg.retryDelay(e.attempts)
+	}
+	_, err := r.db.ExecContext(ctx,
+		`UPDATE outbox SET published_to=$2, last_error=$3,
+			published_at = CASE WHEN $4::boolean THEN now() END,
+			next_attempt_at = now() + make_interval(secs => $5)
+		WHERE event_id=$1`,
+		e.id, pq.Array(e.publishedTo), lastError, published, retryIn.Seconds(),
+	)
+	if err != nil {
+		loggerFrom(ctx).error("could not record published event", "event_id", e.id, "error", err)
+	}
+}
+
+// retryDelay is how long an event waits after its failed attempt number
+// attempts.
+func (c OutboxConfig) retryDelay(attempts int) time.Duration {
+	return backoff(c.RetryInterval, c.MaxRetryInterval, attempts)
+}
+
+func (r *outboxRelay) publish(ctx context.Context, s eventSink, e outboxEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.Timeout)
+	defer cancel()
+	return s.publish(ctx, e)
+}
+
+// deletePublishedEvents deletes the events published more than retention
+// ago.
+func deletePublishedEvents(ctx context.Context, db queryer, retention time.Duration) error {
+	_, err := db.ExecContext(ctx,
+		"DELETE FROM outbox WHERE published_at < now() - make_interval(secs => $1)", retention.Seconds())
+	return err
+}
+
+// eventHandler is called by eventBus with the events matching its pattern.
+type eventHandler func(ctx context.Context, e outboxEvent) error
+
+// eventBus is the sink for handlers within this process. If one of them
+// fails, the event is handed to every handler again later.
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers []busSubscription
+}
+
+type busSubscription struct {
+	pattern string
+	handle  eventHandler
+}
+
+// subscribe calls handle with every event matching pattern, which is an
+// event type, a prefix such as task.* or empty for every event.
+func (b *eventBus) subscribe(pattern string, handle eventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, busSubscription{pattern, handle})
+}
+
+func (b *eventBus) name() string { return "bus" }
+
+func (b *eventBus) publish(ctx context.Context, e outboxEvent) error {
+	b.mu.RLock()
+	handlers := append([]busSubscription(nil), b.handlers...)
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		if h.pattern != "" && !containsString(eventPatterns(e.eventType), h.pattern) {
+			continue
+		}
+		if err := h.handle(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink records the events it accepts. It fails the first failures
+// attempts.
+type recordingSink struct {
+	sinkName string
+	failures int
+
+	mu     sync.Mutex
+	events []outboxEvent
+}
+
+func (s *recordingSink) name() string { return s.sinkName }
+
+func (s *recordingSink) publish(ctx context.Context, e outboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) received() []outboxEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]outboxEvent(nil), s.events...)
+}
+
+func relayDue(t *testing.T) {
+	if err := a.outbox.relayDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxPublishesCommittedChanges(t *testing.T) {
+	clearTables()
+	sink := &recordingSink{sinkName: "recording"}
+	relay := newOutboxRelay(a.DB, a.Config.Outbox, a.metrics, sink)
+
+	req, _ := http.NewRequest("POST", "/category", bytes.NewBufferString(`{"name":"Chores"}`))
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	var eventType string
+	a.DB.QueryRow("SELECT event_type FROM outbox WHERE published_at IS NULL").Scan(&eventType)
+	if eventType != eventCategoryCreated {
+		t.Fatalf("Expected an unpublished %v event in the outbox. Got '%v'", eventCategoryCreated, eventType)
+	}
+
+	if err := relay.relayDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events := sink.received()
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event to be published. Got %v", len(events))
+	}
+	var e event
+	json.Unmarshal(events[0].payload, &e)
+	if e.Type != eventCategoryCreated || e.Workspace_ID != defaultWorkspaceId || e.Event_ID != events[0].id {
+		t.Errorf("Expected the category.created event of the default workspace. Got %+v", e)
+	}
+
+	var unpublished int
+	a.DB.QueryRow("SELECT count(*) FROM outbox WHERE published_at IS NULL").Scan(&unpublished)
+	if unpublished != 0 {
+		t.Errorf("Expected the event to be marked as published. Got %v unpublished", unpublished)
+	}
+
+	if err := relay.relayDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sink.received()); n != 1 {
+		t.Errorf("Expected published events not to be published again. Got %v", n)
+	}
+}
+
+func TestOutboxRetriesOnlyFailedSinks(t *testing.T) {
+	clearTables()
+	healthy := &recordingSink{sinkName: "healthy"}
+	flaky := &recordingSink{sinkName: "flaky", failures: 1}
+	relay := newOutboxRelay(a.DB, a.Config.Outbox, a.metrics, healthy, flaky)
+	addCategory()
+
+	if err := relay.relayDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(healthy.received()) != 1 || len(flaky.received()) != 0 {
+		t.Fatalf("Expected only the healthy sink to accept the event. Got %v and %v",
+			len(healthy.received()), len(flaky.received()))
+	}
+	var lastError string
+	var published bool
+	a.DB.QueryRow("SELECT last_error, published_at IS NOT NULL FROM outbox").Scan(&lastError, &published)
+	if published || !strings.HasPrefix(lastError, "flaky:") {
+		t.Errorf("Expected an unpublished event failed by the flaky sink. Got published %v, error '%v'", published, lastError)
+	}
+
+	// not due before the retry interval passed
+	if err := relay.relayDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(flaky.received()); n != 0 {
+		t.Errorf("Expected the retry to wait. Got %v events", n)
+	}
+
+	a.DB.Exec("UPDATE outbox SET next_attempt_at = now()")
+	if err := relay.relayDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(healthy.received()) != 1 || len(flaky.received()) != 1 {
+		t.Errorf("Expected the retry to reach only the flaky sink. Got %v and %v",
+			len(healthy.received()), len(flaky.received()))
+	}
+	var attempts int
+	a.DB.QueryRow("SELECT attempts, published_at IS NOT NULL FROM outbox").Scan(&attempts, &published)
+	if !published || attempts != 2 {
+		t.Errorf("Expected the event to be published after 2 attempts. Got published %v after %v", published, attempts)
+	}
+}
+
+func TestDeletePublishedEvents(t *testing.T) {
+	clearTables()
+	addCategory()
+	relayDue(t)
+	addCategory()
+	a.DB.Exec("UPDATE outbox SET published_at = now() - interval '2 hours' WHERE published_at IS NOT NULL")
+
+	if err := deletePublishedEvents(context.Background(), a.DB, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var published, unpublished int
+	a.DB.QueryRow("SELECT count(*) FILTER (WHERE published_at IS NOT NULL), count(*) FILTER (WHERE published_at IS NULL) FROM outbox").
+		Scan(&published, &unpublished)
+	if published != 0 || unpublished != 1 {
+		t.Errorf("Expected only the unpublished event to be kept. Got %v published, %v unpublished", published, unpublished)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	var bus eventBus
+	var calls []string
+	for _, pattern := range []string{"", "task.*", eventTaskCompleted} {
+		pattern := pattern
+		bus.subscribe(pattern, func(ctx context.Context, e outboxEvent) error {
+			calls = append(calls, pattern)
+			return nil
+		})
+	}
+
+	bus.publish(context.Background(), outboxEvent{eventType: eventTaskCompleted})
+	if got := strings.Join(calls, ","); got != ",task.*,task.completed" {
+		t.Errorf("Expected every handler to see task.completed. Got '%v'", got)
+	}
+
+	calls = nil
+	bus.publish(context.Background(), outboxEvent{eventType: eventCategoryCreated})
+	if len(calls) != 1 || calls[0] != "" {
+		t.Errorf("Expected only the handler of every event to see category.created. Got %q", calls)
+	}
+
+	failure := errors.New("index unavailable")
+	bus.subscribe(eventCategoryCreated, func(ctx context.Context, e outboxEvent) error { return failure })
+	if err := bus.publish(context.Background(), outboxEvent{eventType: eventCategoryCreated}); err != failure {
+		t.Errorf("Expected the error of the failing handler. Got %v", err)
+	}
+}
+
+// fakeNATSServer speaks enough of the NATS protocol to record what is
+// published to it. If err is set, it answers PINGs with it instead.
+type fakeNATSServer struct {
+	net.Listener
+	headers bool
+
+	mu       sync.Mutex
+	err      string
+	connects []string
+	messages []natsMessage
+}
+
+type natsMessage struct {
+	subject, header, data string
+}
+
+func newFakeNATSServer(t *testing.T, headers bool) *fakeNATSServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNATSServer{Listener: ln, headers: headers}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeNATSServer) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte(`INFO {"server_id":"fake","headers":` + strconv.FormatBool(s.headers) + "}\r\n"))
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		switch fields[0] {
+		case "CONNECT":
+			s.connects = append(s.connects, strings.TrimSpace(strings.TrimPrefix(line, "CONNECT")))
+		case "PING":
+			if s.err != "" {
+				conn.Write([]byte("-ERR '" + s.err + "'\r\n"))
+			} else {
+				conn.Write([]byte("PONG\r\n"))
+			}
+		case "PUB", "HPUB":
+			headerLen := 0
+			if fields[0] == "HPUB" {
+				headerLen, _ = strconv.Atoi(fields[2])
+			}
+			total, _ := strconv.Atoi(fields[len(fields)-1])
+			msg := make([]byte, total+2)
+			io.ReadFull(r, msg)
+			s.messages = append(s.messages, natsMessage{fields[1], string(msg[:headerLen]), string(msg[headerLen:total])})
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *fakeNATSServer) setErr(err string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func TestNATSSink(t *testing.T) {
+	server := newFakeNATSServer(t, true)
+	conn, err := newNATSConn("nats://relay:secret@" + server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.close()
+	sink := natsSink{conn: conn, prefix: "scheduler"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e := outboxEvent{id: "0f8e4c1e-5c5e-4a8e-9d6a-3f1c2b7d9e10", eventType: eventTaskCreated, payload: []byte(`{"type":"task.created"}`)}
+	if err := sink.publish(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.publish(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	connects, messages := server.connects, server.messages
+	server.mu.Unlock()
+	if len(connects) != 1 || !strings.Contains(connects[0], `"user":"relay"`) || !strings.Contains(connects[0], `"pass":"secret"`) {
+		t.Errorf("Expected one connection with the credentials of the URL. Got %q", connects)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages. Got %v", len(messages))
+	}
+	m := messages[0]
+	if m.subject != "scheduler.task.created" || m.data != string(e.payload) {
+		t.Errorf("Expected the payload on scheduler.task.created. Got %+v", m)
+	}
+	if !strings.Contains(m.header, "Nats-Msg-Id: "+e.id+"\r\n") {
+		t.Errorf("Expected the event ID as message ID. Got header %q", m.header)
+	}
+
+	server.setErr("Authorization Violation")
+	if err := sink.publish(ctx, e); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Errorf("Expected the error of the server. Got %v", err)
+	}
+}
+
+func TestNATSWithoutHeaders(t *testing.T) {
+	server := newFakeNATSServer(t, false)
+	conn, _ := newNATSConn("nats://" + server.Addr().String())
+	defer conn.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.publish(ctx, "scheduler.task.deleted", "id", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 1 || server.messages[0].header != "" || server.messages[0].data != "{}" {
+		t.Errorf("Expected a plain PUB. Got %+v", server.messages)
+	}
+	if strings.Contains(server.connects[0], `"user"`) {
+		t.Errorf("Expected no credentials. Got %v", server.connects[0])
+	}
+}
+
+func TestNATSURL(t *testing.T) {
+	conn, err := newNATSConn("nats://nats.internal")
+	if err != nil || conn.addr != "nats.internal:4222" {
+		t.Errorf("Expected the default port. Got %v, %v", conn, err)
+	}
+	for _, rawurl := range []string{"http://nats.internal:4222", "nats://", "localhost:4222"} {
+		if _, err := newNATSConn(rawurl); err == nil {
+			t.Errorf("Expected %q to be refused", rawurl)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit allows Requests per Period, refilled continuously, with bursts of
+// up to Requests. The zero value means unlimited.
+type rateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+var rateLimitUnits = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+// parseRateLimit reads limits such as 100/m. An empty string or 0 disables
+// the limit.
+func parseRateLimit(s string) (rateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return rateLimit{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return rateLimit{}, fmt.Errorf("expected requests/period such as 100/m")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n < 0 {
+		return rateLimit{}, fmt.Errorf("invalid number of requests %q", parts[0])
+	}
+	unit := strings.TrimSpace(parts[1])
+	period, ok := rateLimitUnits[unit]
+	if !ok {
+		if period, err = time.ParseDuration(unit); err != nil || period <= 0 {
+			return rateLimit{}, fmt.Errorf("invalid period %q", unit)
+		}
+	}
+	return rateLimit{Requests: n, Period: period}, nil
+}
+
+func (l rateLimit) String() string {
+	if l.unlimited() {
+		return "0"
+	}
+	for unit, d := range rateLimitUnits {
+		if l.Period == d {
+			return fmt.Sprintf("%d/%s", l.Requests, unit)
+		}
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+func (l rateLimit) unlimited() bool {
+	return l.Requests <= 0 || l.Period <= 0
+}
+
+// tokensPerSecond is how fast an empty bucket refills.
+func (l rateLimit) tokensPerSecond() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+type rateLimitResult struct {
+	allowed   bool
+	remaining float64
+}
+
+// retryAfter is how long until the next request is allowed.
+func (r rateLimitResult) retryAfter(l rateLimit) time.Duration {
+	if r.remaining >= 1 {
+		return 0
+	}
+	return time.Duration((1 - r.remaining) / l.tokensPerSecond() * float64(time.Second))
+}
+
+// reset is how long until the bucket is full again.
+func (r rateLimitResult) reset(l rateLimit) time.Duration {
+	return time.Duration((float64(l.Requests) - r.remaining) / l.tokensPerSecond() * float64(time.Second))
+}
+
+// rateLimitStore keeps one token bucket per key.
+type rateLimitStore interface {
+	take(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error)
+	// peek is take without taking a token
+	peek(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// when the bucket is full again and can be forgotten
+	full time.Time
+}
+
+// memoryRateLimitStore keeps the buckets of a single instance in memory.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+func (s *memoryRateLimitStore) take(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Requests), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+now.Sub(b.updated).Seconds()*limit.tokensPerSecond())
+	b.updated = now
+
+	res := rateLimitResult{allowed: b.tokens >= 1}
+	if res.allowed {
+		b.tokens--
+	}
+	res.remaining = b.tokens
+	b.full = now.Add(res.reset(limit))
+	return res, nil
+}
+
+func (s *memoryRateLimitStore) peek(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := rateLimitResult{remaining: float64(limit.Requests)}
+	if b, ok := s.buckets[key]; ok {
+		res.remaining = math.Min(res.remaining, b.tokens+s.now().Sub(b.updated).Seconds()*limit.tokensPerSecond())
+	}
+	res.allowed = res.remaining >= 1
+	return res, nil
+}
+
+// sweep forgets buckets that are full again, since a new bucket is the same.
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if now.After(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// postgresRateLimitStore shares the buckets between all instances. Refilling
+// and taking a token happen in a single statement, so concurrent requests
+// cannot both take the last token.
+type postgresRateLimitStore struct {
+	db *sql.DB
+}
+
+func (s *postgresRateLimitStore) take(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error) {
+	var r rateLimitResult
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+		VALUES ($1, $2::double precision - 1, true, now())
+		ON CONFLICT (key) DO UPDATE SET
+			allowed = LEAST($2::double precision, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * $3::double precision) >= 1,
+			tokens = LEAST($2::double precision, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * $3::double precision)
+				- CASE WHEN LEAST($2::double precision, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * $3::double precision) >= 1 THEN 1 ELSE 0 END,
+			updated_at = now()
+		RETURNING allowed, tokens`,
+		key, float64(limit.Requests), limit.tokensPerSecond(),
+	).Scan(&r.allowed, &r.remaining)
+	return r, err
+}
+
+func (s *postgresRateLimitStore) peek(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error) {
+	var r rateLimitResult
+	err := s.db.QueryRowContext(ctx,
+		`SELECT LEAST($2::double precision, tokens + EXTRACT(EPOCH FROM now() - updated_at) * $3::double precision)
+		FROM rate_limit_buckets WHERE key=$1`,
+		key, float64(limit.Requests), limit.tokensPerSecond(),
+	).Scan(&r.remaining)
+	if err == sql.ErrNoRows {
+		r.remaining, err = float64(limit.Requests), nil
+	}
+	r.allowed = r.remaining >= 1
+	return r, err
+}
+
+var rateLimitCleanupInterval = 10 * time.Minute
+
+// deleteIdleRateLimitBuckets removes buckets unused for longer than idle.
+func deleteIdleRateLimitBuckets(ctx context.Context, db queryer, idle time.Duration) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM rate_limit_buckets WHERE updated_at < $1", time.Now().Add(-idle))
+	return err
+}
+
+var errRateLimited = &appError{Kind: kindTooManyRequests, Code: "rate_limited", Message: "Too many requests, retry later"}
+
+// probes and scrapes come from infrastructure and are never limited
+var unlimitedRoutes = []string{"/healthz", "/readyz", "/metrics"}
+
+// rateLimitGroup puts a request into the reads, writes or auth group, each
+// of which has its own limit. It is empty for unlimited routes.
+func rateLimitGroup(req *http.Request) string {
+	route := routeTemplate(req)
+	if containsString(unlimitedRoutes, route) {
+		return ""
+	}
+	if strings.HasPrefix(route, "/auth/") {
+		return "auth"
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return "reads"
+	}
+	return "writes"
+}
+
+// rateLimitKey identifies who is limited: the user if the request is
+// authenticated, its client IP otherwise.
+func (a *App) rateLimitKey(req *http.Request) string {
+	if info := requestInfoFrom(req.Context()); info != nil {
+		if user := info.userName(); user != "" {
+			return "user:" + user
+		}
+	}
+	return "ip:" + clientIP(req, a.trustedProxies)
+}
+
+// rateLimited answers with 429 once a client has used up its requests. The
+// RateLimit headers follow
+// https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+func (a *App) rateLimited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		group := rateLimitGroup(req)
+		limit := a.Config.RateLimit.limit(group)
+		if group == "" || limit.unlimited() {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		res, err := a.rateLimits.take(req.Context(), group+":"+a.rateLimitKey(req), limit)
+		if err != nil {
+			// better to serve unthrottled than not at all
+			loggerFrom(req.Context()).warn("rate limit store failed", "error", err)
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, int(limit.Period.Seconds())))
+		h.Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+		h.Set("RateLimit-Remaining", strconv.Itoa(int(math.Max(0, math.Floor(res.remaining)))))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.reset(limit))))
+		if !res.allowed {
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.retryAfter(limit))))
+			respondWithProblem(w, req, errRateLimited)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Invalid API keys are rejected before rateLimited runs, so failed attempts
+// are limited on their own: every client IP may present invalid keys as often
+// as the auth limit allows. Clients out of attempts are rejected before their
+// key is even looked up, so keys cannot be guessed faster than that.
+
+func (a *App) authFailuresKey(req *http.Request) string {
+	return "auth-failures:ip:" + clientIP(req, a.trustedProxies)
+}
+
+// tooManyAuthFailures reports whether the client of req has run out of
+// attempts, and then sets Retry-After.
+func (a *App) tooManyAuthFailures(w http.ResponseWriter, req *http.Request) bool {
+	limit := a.Config.RateLimit.Auth
+	if limit.unlimited() {
+		return false
+	}
+	res, err := a.rateLimits.peek(req.Context(), a.authFailuresKey(req), limit)
+	if err != nil {
+		loggerFrom(req.Context()).warn("rate limit store failed", "error", err)
+		return false
+	}
+	if res.allowed {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.retryAfter(limit))))
+	return true
+}
+
+// recordAuthFailure uses up one attempt of the client of req.
+func (a *App) recordAuthFailure(req *http.Request) {
+	limit := a.Config.RateLimit.Auth
+	if limit.unlimited() {
+		return
+	}
+	if _, err := a.rateLimits.take(req.Context(), a.authFailuresKey(req), limit); err != nil {
+		loggerFrom(req.Context()).warn("rate limit store failed", "error", err)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is only
+// believed for hops added by trusted proxies.
+func clientIP(req *http.Request, trusted []*net.IPNet) string {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !ipIn(ip, trusted) {
+		return ip
+	}
+
+	hops := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !ipIn(hop, trusted) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip
+}
+
+func ipIn(ip string, networks []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func useRateLimits(t *testing.T, cfg RateLimitConfig, store rateLimitStore) {
+	previousConfig, previousStore, previousProxies := a.Config.RateLimit, a.rateLimits, a.trustedProxies
+	a.Config.RateLimit = cfg
+	a.rateLimits = store
+	a.trustedProxies, _ = cfg.trustedNetworks()
+	t.Cleanup(func() {
+		a.Config.RateLimit, a.rateLimits, a.trustedProxies = previousConfig, previousStore, previousProxies
+	})
+}
+
+func TestParseRateLimit(t *testing.T) {
+	for input, want := range map[string]rateLimit{
+		"100/m": {Requests: 100, Period: time.Minute},
+		"5/s":   {Requests: 5, Period: time.Second},
+		"10/2h": {Requests: 10, Period: 2 * time.Hour},
+		"0":     {},
+		"":      {},
+	} {
+		got, err := parseRateLimit(input)
+		if err != nil || got != want {
+			t.Errorf("parseRateLimit(%q) = %v, %v. Expected %v", input, got, err, want)
+		}
+	}
+	for _, input := range []string{"100", "x/m", "10/fortnight", "-1/m"} {
+		if _, err := parseRateLimit(input); err == nil {
+			t.Errorf("Expected parseRateLimit(%q) to fail", input)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	limit := rateLimit{Requests: 2, Period: time.Minute}
+
+	for i := 0; i < 2; i++ {
+		if res, _ := store.take(context.Background(), "ip:192.0.2.1", limit); !res.allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	res, _ := store.take(context.Background(), "ip:192.0.2.1", limit)
+	if res.allowed {
+		t.Fatalf("Expected the third request to be limited")
+	}
+	if got := res.retryAfter(limit); got != 30*time.Second {
+		t.Errorf("Expected to retry after 30s. Got %v", got)
+	}
+	if res, _ := store.take(context.Background(), "ip:192.0.2.2", limit); !res.allowed {
+		t.Errorf("Expected other clients not to be limited")
+	}
+
+	now = now.Add(30 * time.Second)
+	if res, _ := store.take(context.Background(), "ip:192.0.2.1", limit); !res.allowed {
+		t.Errorf("Expected a token to be refilled after 30s")
+	}
+
+	now = now.Add(2 * time.Minute)
+	store.take(context.Background(), "ip:192.0.2.3", limit)
+	if _, ok := store.buckets["ip:192.0.2.1"]; ok {
+		t.Errorf("Expected full buckets to be swept")
+	}
+}
+
+func TestMemoryRateLimitStorePeek(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	limit := rateLimit{Requests: 1, Period: time.Minute}
+
+	for i := 0; i < 2; i++ {
+		if res, _ := store.peek(context.Background(), "ip:192.0.2.1", limit); !res.allowed || res.remaining != 1 {
+			t.Fatalf("Expected peeking not to take a token. Got %+v", res)
+		}
+	}
+	store.take(context.Background(), "ip:192.0.2.1", limit)
+	if res, _ := store.peek(context.Background(), "ip:192.0.2.1", limit); res.allowed {
+		t.Errorf("Expected an empty bucket to not allow requests")
+	}
+	now = now.Add(time.Minute)
+	if res, _ := store.peek(context.Background(), "ip:192.0.2.1", limit); !res.allowed {
+		t.Errorf("Expected the bucket to be refilled after a minute")
+	}
+}
+
+func TestPostgresRateLimitStore(t *testing.T) {
+	clearTables()
+	store := &postgresRateLimitStore{db: a.DB}
+	limit := rateLimit{Requests: 2, Period: time.Hour}
+
+	for i := 0; i < 2; i++ {
+		res, err := store.take(context.Background(), "ip:192.0.2.1", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+	res, err := store.take(context.Background(), "ip:192.0.2.1", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.allowed {
+		t.Errorf("Expected the third request to be limited")
+	}
+	if res.remaining >= 1 {
+		t.Errorf("Expected less than one token to remain. Got %v", res.remaining)
+	}
+
+	if err := deleteIdleRateLimitBuckets(context.Background(), a.DB, 0); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := store.take(context.Background(), "ip:192.0.2.1", limit); !res.allowed {
+		t.Errorf("Expected a deleted bucket to start full")
+	}
+}
+
+func TestRateLimitedResponse(t *testing.T) {
+	clearTables()
+	useRateLimits(t, RateLimitConfig{
+		Reads:  rateLimit{Requests: 1, Period: time.Minute},
+		Writes: rateLimit{Requests: 5, Period: time.Minute},
+	}, newMemoryRateLimitStore())
+
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if got := response.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("Expected RateLimit-Remaining to be 0. Got %q", got)
+	}
+
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	for header, want := range map[string]string{
+		"RateLimit-Limit":     "1",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "60",
+		"Retry-After":         "60",
+	} {
+		if got := response.Header().Get(header); got != want {
+			t.Errorf("Expected %s to be %q. Got %q", header, want, got)
+		}
+	}
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "rate_limited" {
+		t.Errorf("Expected code 'rate_limited'. Got '%v'", p.Code)
+	}
+
+	// writes and probes are limited separately
+	req, _ = http.NewRequest("DELETE", "/category/b119178b-2fd2-4a5c-9301-190c341df180", nil)
+	if response := executeRequest(req); response.Code == http.StatusTooManyRequests {
+		t.Errorf("Expected writes not to be limited by reads")
+	}
+	req, _ = http.NewRequest("GET", "/healthz", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+}
+
+func TestRateLimitedPerClientIP(t *testing.T) {
+	clearTables()
+	useRateLimits(t, RateLimitConfig{
+		Reads:          rateLimit{Requests: 1, Period: time.Minute},
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}, newMemoryRateLimitStore())
+
+	for i, client := range []string{"198.51.100.1", "198.51.100.2"} {
+		req, _ := http.NewRequest("GET", "/categories", nil)
+		req.RemoteAddr = "10.0.0.1:" + strconv.Itoa(40000+i)
+		req.Header.Set("X-Forwarded-For", client)
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+}
+
+func TestInvalidAPIKeysAreLimitedPerClientIP(t *testing.T) {
+	clearTables()
+	useRateLimits(t, RateLimitConfig{Auth: rateLimit{Requests: 2, Period: time.Minute}}, newMemoryRateLimitStore())
+	key := addAPIKey("", scopeCategoriesRead)
+
+	for _, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req, _ := http.NewRequest("GET", "/categories", nil)
+		req.RemoteAddr = "198.51.100.1:1234"
+		req.Header.Set("Authorization", "Bearer "+key[:len(key)-1]+"x")
+		checkResponseCode(t, want, executeRequest(req).Code)
+	}
+
+	// not even valid keys are checked for a client out of attempts
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set("Authorization", "Bearer "+key)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	if response.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected to retry after 30s. Got %q", response.Header().Get("Retry-After"))
+	}
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.RemoteAddr = "198.51.100.2:1234"
+	req.Header.Set("Authorization", "Bearer "+key)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}}.trustedNetworks()
+	tests := []struct {
+		remoteAddr, forwardedFor, want string
+	}{
+		{"198.51.100.7:1234", "", "198.51.100.7"},
+		// untrusted peers cannot choose their address
+		{"198.51.100.7:1234", "203.0.113.9", "198.51.100.7"},
+		{"10.0.0.1:1234", "203.0.113.9", "203.0.113.9"},
+		// only the hops added by trusted proxies are believed
+		{"10.0.0.1:1234", "1.2.3.4, 203.0.113.9, 192.0.2.1", "203.0.113.9"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if got := clientIP(req, trusted); got != test.want {
+			t.Errorf("clientIP(%s, %q) = %s. Expected %s", test.remoteAddr, test.forwardedFor, got, test.want)
+		}
+	}
+}
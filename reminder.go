@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// channels a reminder can notify through
+const (
+	// the inbox of the user who set the reminder
+	channelInbox = "inbox"
+	// the address of the user who set the reminder
+	channelEmail = "email"
+	// a task.reminder event for the webhooks of the workspace
+	channelWebhook = "webhook"
+)
+
+var reminderChannels = []string{channelInbox, channelEmail, channelWebhook}
+
+const (
+	reminderBatch    = 50
+	maxBeforeDue     = 366 * 24 * time.Hour
+	maxTaskReminders = 20
+)
+
+// reminder fires once, at Remind_At or Before_Due_Seconds before the task is
+// due. Reminders of complete tasks do not fire unless the task is reopened,
+// and offsets only once the task has a due date.
+type reminder struct {
+	Reminder_ID        string     `json:"reminder_id"`
+	Task_ID            int        `json:"task_id"`
+	Remind_At          *time.Time `json:"remind_at,omitempty"`
+	Before_Due_Seconds *int       `json:"before_due_seconds,omitempty"`
+	Channels           []string   `json:"channels"`
+	// when it fires, unknown while an offset's task has no due date
+	Fire_At    *time.Time `json:"fire_at,omitempty"`
+	Fired_At   *time.Time `json:"fired_at,omitempty"`
+	Created_At time.Time  `json:"created_at"`
+}
+
+type reminderInput struct {
+	Remind_At          *time.Time `json:"remind_at"`
+	Before_Due_Seconds *int       `json:"before_due_seconds"`
+	Channels           []string   `json:"channels"`
+}
+
+var (
+	errReminderNotFound = notFoundError("reminder_not_found", "Reminder not found")
+	errTooManyReminders = conflictError("too_many_reminders", fmt.Sprintf("A task can have at most %d reminders of the same user", maxTaskReminders), nil)
+)
+
+// validate checks in for a reminder set by userId, empty if not a user.
+func (in reminderInput) validate(now time.Time, userId string, mail MailConfig) validationErrors {
+	var errs validationErrors
+	switch {
+	case in.Remind_At == nil && in.Before_Due_Seconds == nil:
+		errs.add("remind_at", "either remind_at or before_due_seconds is required")
+	case in.Remind_At != nil && in.Before_Due_Seconds != nil:
+		errs.add("remind_at", "must not be combined with before_due_seconds")
+	case in.Remind_At != nil && !in.Remind_At.After(now):
+		errs.add("remind_at", "must be in the future")
+	case in.Before_Due_Seconds != nil:
+		errs.min("before_due_seconds", *in.Before_Due_Seconds, 0)
+		if time.Duration(*in.Before_Due_Seconds)*time.Second > maxBeforeDue {
+			errs.add("before_due_seconds", fmt.Sprintf("must be at most %d", int(maxBeforeDue.Seconds())))
+		}
+	}
+
+	if len(in.Channels) == 0 {
+		errs.add("channels", "is required")
+	}
+	for _, c := range in.Channels {
+		errs.oneOf("channels", c, reminderChannels)
+	}
+	if containsString(in.Channels, channelInbox) && userId == "" {
+		errs.add("channels", "inbox is only available to users")
+	}
+	// email only goes to the address of the user, so the server cannot be
+	// made to send it anywhere else
+	if containsString(in.Channels, channelEmail) {
+		switch {
+		case !mail.enabled():
+			errs.add("channels", "email is not enabled on this server")
+		case userId == "":
+			errs.add("channels", "email is only available to users")
+		}
+	}
+	return errs
+}
+
+func (in reminderInput) reminder(taskId int) reminder {
+	var channels []string
+	for _, c := range in.Channels {
+		if !containsString(channels, c) {
+			channels = append(channels, c)
+		}
+	}
+	return reminder{
+		Task_ID:            taskId,
+		Remind_At:          in.Remind_At,
+		Before_Due_Seconds: in.Before_Due_Seconds,
+		Channels:           channels,
+	}
+}
+
+// Reminders are personal: everyone sees and deletes only the ones they set,
+// where anonymous requests and service keys share the reminders without a
+// user. Every query is restricted to the task in the workspace of ctx.
+
+func reminderOwner(ctx context.Context) sql.NullString {
+	userId := principalFrom(ctx).userId
+	return sql.NullString{String: userId, Valid: userId != ""}
+}
+
+const reminderColumns = `r.reminder_id, r.task_id, r.remind_at, r.before_due_seconds, r.channels,
+	COALESCE(r.remind_at, t.due_at - make_interval(secs => r.before_due_seconds)), r.fired_at, r.created_at`
+
+const reminderJoins = `reminders r JOIN tasks t ON t.task_id = r.task_id
+	JOIN categories c ON c.category_id = t.category_id`
+
+func (r *reminder) scan(row rowScanner) error {
+	var beforeDue sql.NullInt64
+	var remindAt, fireAt, firedAt sql.NullTime
+	err := row.Scan(&r.Reminder_ID, &r.Task_ID, &remindAt, &beforeDue, pq.Array(&r.Channels),
+		&fireAt, &firedAt, &r.Created_At)
+	if err != nil {
+		return err
+	}
+	r.Remind_At, r.Fire_At, r.Fired_At = nullTime(remindAt), nullTime(fireAt), nullTime(firedAt)
+	if beforeDue.Valid {
+		seconds := int(beforeDue.Int64)
+		r.Before_Due_Seconds = &seconds
+	}
+	return nil
+}
+
+func (r *reminder) createReminder(ctx context.Context, db queryer, categoryId string) error {
+	owner := reminderOwner(ctx)
+	var count int
+	err := db.QueryRowContext(ctx,
+		`SELECT count(r.reminder_id) FROM tasks t JOIN categories c ON c.category_id = t.category_id
+		LEFT JOIN reminders r ON r.task_id = t.task_id AND r.user_id IS NOT DISTINCT FROM $4
+		WHERE t.task_id=$1 AND t.category_id=$2 AND c.workspace_id=$3
+		GROUP BY t.task_id`,
+		r.Task_ID, categoryId, workspaceFrom(ctx).id, owner,
+	).Scan(&count)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if count >= maxTaskReminders {
+		return errTooManyReminders
+	}
+
+	err = db.QueryRowContext(ctx,
+		`INSERT INTO reminders(task_id, user_id, remind_at, before_due_seconds, channels)
+		VALUES ($1, $2, $3, $4, $5) RETURNING reminder_id`,
+		r.Task_ID, owner, r.Remind_At, r.Before_Due_Seconds, pq.Array(r.Channels),
+	).Scan(&r.Reminder_ID)
+	if err != nil {
+		return dbError(err)
+	}
+	return r.getReminder(ctx, db, categoryId)
+}
+
+func (r *reminder) getReminder(ctx context.Context, db queryer, categoryId string) error {
+	err := r.scan(db.QueryRowContext(ctx,
+		`SELECT `+reminderColumns+` FROM `+reminderJoins+`
+		WHERE r.reminder_id=$1 AND r.task_id=$2 AND t.category_id=$3 AND c.workspace_id=$4
+		AND r.user_id IS NOT DISTINCT FROM $5`,
+		r.Reminder_ID, r.Task_ID, categoryId, workspaceFrom(ctx).id, reminderOwner(ctx),
+	))
+	if err == sql.ErrNoRows {
+		return errReminderNotFound
+	}
+	return err
+}
+
+func (r *reminder) deleteReminder(ctx context.Context, db queryer, categoryId string) error {
+	res, err := db.ExecContext(ctx,
+		`DELETE FROM reminders r USING tasks t, categories c
+		WHERE t.task_id = r.task_id AND c.category_id = t.category_id
+		AND r.reminder_id=$1 AND r.task_id=$2 AND t.category_id=$3 AND c.workspace_id=$4
+		AND r.user_id IS NOT DISTINCT FROM $5`,
+		r.Reminder_ID, r.Task_ID, categoryId, workspaceFrom(ctx).id, reminderOwner(ctx),
+	)
+	return affectedOrNotFound(res, err, errReminderNotFound)
+}
+
+func (t *task) getReminders(ctx context.Context, db queryer) ([]reminder, error) {
+	if err := t.getTask(ctx, db); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+reminderColumns+` FROM `+reminderJoins+`
+		WHERE r.task_id=$1 AND t.category_id=$2 AND c.workspace_id=$3 AND r.user_id IS NOT DISTINCT FROM $4
+		ORDER BY r.created_at`,
+		t.Task_ID, t.Category_ID, workspaceFrom(ctx).id, reminderOwner(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reminders := []reminder{}
+	for rows.Next() {
+		var r reminder
+		if err := r.scan(rows); err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, r)
+	}
+	return reminders, rows.Err()
+}
+
+// firedReminder is a due reminder with what its channels need to know.
+type firedReminder struct {
+	id          string
+	userId      string
+	channels    []string
+	email       string
+	workspaceId string
+	categoryId  string
+	category    string
+	task        task
+	// of the workspace, due dates are shown in it
+	timeZone string
+}
+
+// notificationChannel tells someone about a fired reminder. notify runs in
+// the transaction that marks the reminder as fired, so what it writes with
+// db is written exactly once. Channels reaching outside the database queue
+// their messages there and send them from a worker of their own.
+type notificationChannel interface {
+	name() string
+	notify(ctx context.Context, db queryer, r firedReminder) error
+}
+
+// reminderScheduler fires due reminders, see fireDue.
+type reminderScheduler struct {
+	db       *sql.DB
+	channels []notificationChannel
+	metrics  *metrics
+}
+
+func newReminderScheduler(db *sql.DB, m *metrics, channels ...notificationChannel) *reminderScheduler {
+	return &reminderScheduler{db: db, channels: channels, metrics: m}
+}
+
+// fireDue fires every due reminder. Each batch is locked, notified and
+// marked as fired in one transaction, so instances running it at once skip
+// each other's reminders and every reminder fires exactly once.
+func (s *reminderScheduler) fireDue(ctx context.Context) error {
+	for {
+		var fired int
+		err := inTransaction(ctx, s.db, func(tx *sql.Tx) error {
+			due, err := s.lockDue(ctx, tx)
+			if err != nil {
+				return err
+			}
+			ids := make([]string, len(due))
+			for i, r := range due {
+				ids[i] = r.id
+				for _, c := range s.channels {
+					if !containsString(r.channels, c.name()) {
+						continue
+					}
+					if err := c.notify(ctx, tx, r); err != nil {
+						return fmt.Errorf("%s notification of reminder %s: %w", c.name(), r.id, err)
+					}
+				}
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE reminders SET fired_at = now() WHERE reminder_id = ANY($1)", pq.Array(ids)); err != nil {
+				return err
+			}
+			fired = len(due)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		s.metrics.remindersFired.add(float64(fired))
+		if fired < reminderBatch || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (s *reminderScheduler) lockDue(ctx context.Context, tx *sql.Tx) ([]firedReminder, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT r.reminder_id, COALESCE(r.user_id::text, ''), r.channels, COALESCE(u.email, ''),
+			c.workspace_id, c.category_id, c.name, t.task_id, t.task, t.seq, t.complete, t.due_at, w.time_zone
+		FROM `+reminderJoins+` JOIN workspaces w ON w.workspace_id = c.workspace_id
+		LEFT JOIN users u ON u.user_id = r.user_id
+		WHERE r.fired_at IS NULL AND NOT t.complete
+		AND COALESCE(r.remind_at, t.due_at - make_interval(secs => r.before_due_seconds)) <= now()
+		ORDER BY r.created_at LIMIT $1
+		FOR UPDATE OF r SKIP LOCKED`,
+		reminderBatch,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []firedReminder
+	for rows.Next() {
+		var r firedReminder
+		err := rows.Scan(&r.id, &r.userId, pq.Array(&r.channels), &r.email, &r.workspaceId, &r.categoryId, &r.category,
+			&r.task.Task_ID, &r.task.Task, &r.task.Seq, &r.task.Complete, &r.task.Due_At, &r.timeZone)
+		if err != nil {
+			return nil, err
+		}
+		r.task.Category_ID = r.categoryId
+		due = append(due, r)
+	}
+	return due, rows.Err()
+}
+
+// reminderText is the title and body of the notifications of r.
+func reminderText(r firedReminder) (string, string) {
+	title := "Reminder: " + r.task.Task
+	body := fmt.Sprintf("%s in %s", r.task.Task, r.category)
+	if r.task.Due_At != nil {
+		loc, err := time.LoadLocation(r.timeZone)
+		if err != nil {
+			loc = time.UTC
+		}
+		body += " is due " + r.task.Due_At.In(loc).Format("Mon, 02 Jan 2006 15:04 MST")
+	}
+	return title, body + "."
+}
+
+// inboxChannel adds a notification to the inbox of the user who set the
+// reminder.
+type inboxChannel struct{}
+
+func (inboxChannel) name() string { return channelInbox }
+
+func (inboxChannel) notify(ctx context.Context, db queryer, r firedReminder) error {
+	if r.userId == "" {
+		return nil
+	}
+	title, body := reminderText(r)
+	n := notification{Category_ID: r.categoryId, Task_ID: r.task.Task_ID, Title: title, Body: body}
+	return n.createNotification(ctx, db, r.userId, r.workspaceId)
+}
+
+// emailChannel queues an email for mailSender.
+type emailChannel struct{}
+
+func (emailChannel) name() string { return channelEmail }
+
+func (emailChannel) notify(ctx context.Context, db queryer, r firedReminder) error {
+	if r.email == "" {
+		return nil
+	}
+	title, body := reminderText(r)
+	return queueEmail(ctx, db, mailMessage{to: r.email, subject: title, text: body + "\n"})
+}
+
+// webhookChannel publishes a task.reminder event, which reaches the webhooks
+// through the outbox like any other event.
+type webhookChannel struct{}
+
+func (webhookChannel) name() string { return channelWebhook }
+
+// reminderEvent is the data of task.reminder.
+type reminderEvent struct {
+	Reminder_ID string `json:"reminder_id"`
+	Task        task   `json:"task"`
+}
+
+func (webhookChannel) notify(ctx context.Context, db queryer, r firedReminder) error {
+	ctx = withWorkspace(ctx, currentWorkspace{id: r.workspaceId})
+	return publishEvent(ctx, db, eventTaskReminder, reminderEvent{Reminder_ID: r.id, Task: r.task})
+}
+
+func pathReminderId(req *http.Request) (string, error) {
+	id := mux.Vars(req)["reminder_id"]
+	if !isValidUUID(id) {
+		return "", badRequestError("invalid_reminder_id", "Invalid reminder ID")
+	}
+	return id, nil
+}
+
+func (a *App) getReminders(w http.ResponseWriter, req *http.Request) {
+	categoryId, taskId, err := pathTaskIds(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	t := task{Task_ID: taskId, Category_ID: categoryId}
+	reminders, err := t.getReminders(req.Context(), a.DB)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, reminders)
+}
+
+func (a *App) createReminder(w http.ResponseWriter, req *http.Request) {
+	categoryId, taskId, err := pathTaskIds(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	var in reminderInput
+	if err := decodeJSONBody(w, req, &in); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	ctx := req.Context()
+	if errs := in.validate(time.Now(), principalFrom(ctx).userId, a.Config.Mail); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+
+	r := in.reminder(taskId)
+	if err := r.createReminder(ctx, a.DB, categoryId); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, r)
+}
+
+func (a *App) deleteReminder(w http.ResponseWriter, req *http.Request) {
+	categoryId, taskId, err := pathTaskIds(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	id, err := pathReminderId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	r := reminder{Reminder_ID: id, Task_ID: taskId}
+	if err := r.deleteReminder(req.Context(), a.DB, categoryId); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer accepts emails without TLS or authentication and records
+// them. It refuses the first failures recipients.
+type fakeSMTPServer struct {
+	net.Listener
+
+	mu       sync.Mutex
+	failures int
+	messages []smtpMessage
+}
+
+type smtpMessage struct {
+	from, to string
+	data     string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{Listener: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP")
+
+	var m smtpMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			m = smtpMessage{from: strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")}
+			reply("250 OK")
+		case "RCPT":
+			s.mu.Lock()
+			refuse := s.failures > 0
+			if refuse {
+				s.failures--
+			}
+			s.mu.Unlock()
+			if refuse {
+				reply("550 mailbox unavailable")
+				continue
+			}
+			m.to = strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>")
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			m.data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, m)
+			s.mu.Unlock()
+			reply("250 OK")
+		case "RSET", "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) setFailures(failures int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = failures
+}
+
+func (s *fakeSMTPServer) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+// useMailSender enables mail, sent to server, and makes emails fail after
+// maxAttempts.
+func useMailSender(t *testing.T, server *fakeSMTPServer, maxAttempts int) {
+	previousConfig, previous := a.Config.Mail, a.mail
+	cfg := a.Config.Mail
+	cfg.SMTPAddr = server.Addr().String()
+	cfg.From = "scheduler@example.com"
+	cfg.MaxAttempts = maxAttempts
+	a.Config.Mail = cfg
+	a.mail = newMailSender(a.DB, cfg, a.metrics)
+	t.Cleanup(func() { a.Config.Mail, a.mail = previousConfig, previous })
+}
+
+func fireDue(t *testing.T) {
+	if err := a.reminders.fireDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sendDue(t *testing.T) {
+	if err := a.mail.sendDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addReminder(t *testing.T, categoryId string, taskId int, session *http.Cookie, body string) reminder {
+	req, _ := http.NewRequest("POST", "/category/"+categoryId+"/task/"+strconv.Itoa(taskId)+"/reminders", bytes.NewBufferString(body))
+	if session != nil {
+		req.AddCookie(session)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var r reminder
+	json.Unmarshal(response.Body.Bytes(), &r)
+	return r
+}
+
+func TestReminderFiresOnceOnEveryChannel(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t)
+	smtp := newFakeSMTPServer(t)
+	useMailSender(t, smtp, 3)
+	userId, session := addSession(t, "owner@example.com")
+	categoryId := addCategory()
+
+	dueAt := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	req, _ := http.NewRequest("POST", "/category/"+categoryId+"/task",
+		bytes.NewBufferString(`{"task":"File taxes","due_at":"`+dueAt.Format(time.RFC3339)+`"}`))
+	req.AddCookie(session)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var tsk task
+	json.Unmarshal(response.Body.Bytes(), &tsk)
+	if tsk.Due_At == nil || !tsk.Due_At.Equal(dueAt) {
+		t.Fatalf("Expected the task to be due at %v. Got %v", dueAt, tsk.Due_At)
+	}
+
+	r := addReminder(t, categoryId, tsk.Task_ID, session, `{"before_due_seconds":3600,"channels":["inbox","email","webhook","inbox"]}`)
+	if len(r.Channels) != 3 || r.Fire_At == nil || !r.Fire_At.Equal(dueAt.Add(-time.Hour)) {
+		t.Errorf("Expected 3 channels and to fire an hour before the task is due. Got %+v", r)
+	}
+
+	// instances firing at once fire every reminder once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := a.reminders.fireDue(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	fireDue(t)
+
+	notifications, err := getNotifications(withWorkspace(context.Background(), currentWorkspace{id: defaultWorkspaceId}), a.DB, userId, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 1 || notifications[0].Task_ID != tsk.Task_ID || notifications[0].Title != "Reminder: File taxes" {
+		t.Errorf("Expected 1 notification of the task. Got %+v", notifications)
+	}
+
+	var events int
+	a.DB.QueryRow("SELECT count(*) FROM outbox WHERE event_type=$1", eventTaskReminder).Scan(&events)
+	if events != 1 {
+		t.Errorf("Expected 1 %v event. Got %v", eventTaskReminder, events)
+	}
+
+	sendDue(t)
+	emails := smtp.received()
+	if len(emails) != 1 || emails[0].to != "owner@example.com" || emails[0].from != "scheduler@example.com" {
+		t.Fatalf("Expected 1 email to the user. Got %+v", emails)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(emails[0].data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if msg.Header.Get("Subject") != "Reminder: File taxes" || !strings.Contains(string(body), "File taxes in ") {
+		t.Errorf("Expected the reminder in the email. Got subject %q, body %q", msg.Header.Get("Subject"), body)
+	}
+
+	req, _ = http.NewRequest("GET", "/category/"+categoryId+"/task/"+strconv.Itoa(tsk.Task_ID)+"/reminders", nil)
+	req.AddCookie(session)
+	response = executeRequest(req)
+	var reminders []reminder
+	json.Unmarshal(response.Body.Bytes(), &reminders)
+	if len(reminders) != 1 || reminders[0].Fired_At == nil {
+		t.Errorf("Expected the reminder to be fired. Got %+v", reminders)
+	}
+}
+
+func TestRemindersOfCompleteTasksDoNotFire(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+	taskId := addTaskToCategory(categoryId)
+	addReminder(t, categoryId, taskId, nil,
+		`{"remind_at":"`+time.Now().Add(time.Hour).Format(time.RFC3339)+`","channels":["webhook"]}`)
+	a.DB.Exec("UPDATE reminders SET remind_at = now() - interval '1 minute'")
+	a.DB.Exec("UPDATE tasks SET complete = true WHERE task_id=$1", taskId)
+
+	fireDue(t)
+	var fired bool
+	a.DB.QueryRow("SELECT fired_at IS NOT NULL FROM reminders").Scan(&fired)
+	if fired {
+		t.Errorf("Expected the reminder of the complete task not to fire")
+	}
+
+	a.DB.Exec("UPDATE tasks SET complete = false WHERE task_id=$1", taskId)
+	fireDue(t)
+	a.DB.QueryRow("SELECT fired_at IS NOT NULL FROM reminders").Scan(&fired)
+	if !fired {
+		t.Errorf("Expected the reminder to fire once the task is reopened")
+	}
+}
+
+func TestRemindersArePersonal(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t)
+	_, owner := addSession(t, "owner@example.com")
+	_, other := addSession(t, "other@example.com")
+	categoryId := addCategory()
+	taskId := addTaskToCategory(categoryId)
+	r := addReminder(t, categoryId, taskId, owner, `{"before_due_seconds":0,"channels":["inbox"]}`)
+	if r.Fire_At != nil {
+		t.Errorf("Expected no fire time while the task has no due date. Got %v", r.Fire_At)
+	}
+
+	url := "/category/" + categoryId + "/task/" + strconv.Itoa(taskId) + "/reminders"
+	req, _ := http.NewRequest("GET", url, nil)
+	req.AddCookie(other)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if body := strings.TrimSpace(response.Body.String()); body != "[]" {
+		t.Errorf("Expected the reminders of others to be hidden. Got %v", body)
+	}
+
+	req, _ = http.NewRequest("DELETE", url+"/"+r.Reminder_ID, nil)
+	req.AddCookie(other)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	req, _ = http.NewRequest("DELETE", url+"/"+r.Reminder_ID, nil)
+	req.AddCookie(owner)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	// only users have an inbox
+	req, _ = http.NewRequest("POST", url, bytes.NewBufferString(`{"before_due_seconds":0,"channels":["inbox"]}`))
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+}
+
+func TestReminderValidation(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	seconds := func(s int) *int { return &s }
+	mailEnabled := MailConfig{SMTPAddr: "localhost:25", From: "scheduler@example.com"}
+
+	tests := []struct {
+		in     reminderInput
+		userId string
+		mail   MailConfig
+		field  string
+	}{
+		{reminderInput{Channels: []string{channelWebhook}}, "", MailConfig{}, "remind_at"},
+		{reminderInput{Remind_At: &future, Before_Due_Seconds: seconds(60), Channels: []string{channelWebhook}}, "", MailConfig{}, "remind_at"},
+		{reminderInput{Remind_At: &past, Channels: []string{channelWebhook}}, "", MailConfig{}, "remind_at"},
+		{reminderInput{Before_Due_Seconds: seconds(-1), Channels: []string{channelWebhook}}, "", MailConfig{}, "before_due_seconds"},
+		{reminderInput{Before_Due_Seconds: seconds(int(maxBeforeDue.Seconds()) + 1), Channels: []string{channelWebhook}}, "", MailConfig{}, "before_due_seconds"},
+		{reminderInput{Remind_At: &future}, "", MailConfig{}, "channels"},
+		{reminderInput{Remind_At: &future, Channels: []string{"sms"}}, "", MailConfig{}, "channels"},
+		{reminderInput{Remind_At: &future, Channels: []string{channelInbox}}, "", MailConfig{}, "channels"},
+		{reminderInput{Remind_At: &future, Channels: []string{channelEmail}}, "user", MailConfig{}, "channels"},
+		{reminderInput{Remind_At: &future, Channels: []string{channelEmail}}, "", mailEnabled, "channels"},
+	}
+	for _, test := range tests {
+		errs := test.in.validate(now, test.userId, test.mail)
+		if len(errs) != 1 || errs[0].Field != test.field {
+			t.Errorf("Expected an error on %v for %+v. Got %+v", test.field, test.in, errs)
+		}
+	}
+
+	valid := []reminderInput{
+		{Remind_At: &future, Channels: []string{channelInbox, channelEmail}},
+		{Before_Due_Seconds: seconds(0), Channels: []string{channelEmail}},
+	}
+	for _, in := range valid {
+		if errs := in.validate(now, "user", mailEnabled); len(errs) > 0 {
+			t.Errorf("Expected %+v to be valid. Got %+v", in, errs)
+		}
+	}
+}
+
+func TestNotificationInbox(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t)
+	userId, session := addSession(t, "owner@example.com")
+	_, other := addSession(t, "other@example.com")
+	for _, title := range []string{"First", "Second"} {
+		n := notification{Title: title, Body: title}
+		if err := n.createNotification(context.Background(), a.DB, userId, defaultWorkspaceId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/notifications", nil)
+	req.AddCookie(session)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var notifications []notification
+	json.Unmarshal(response.Body.Bytes(), &notifications)
+	if len(notifications) != 2 || notifications[0].Title != "Second" {
+		t.Fatalf("Expected 2 notifications, newest first. Got %+v", notifications)
+	}
+
+	url := "/notifications/" + notifications[0].Notification_ID + ":read"
+	req, _ = http.NewRequest("POST", url, nil)
+	req.AddCookie(other)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+	req, _ = http.NewRequest("POST", url, nil)
+	req.AddCookie(session)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var n notification
+	json.Unmarshal(response.Body.Bytes(), &n)
+	if n.Read_At == nil {
+		t.Errorf("Expected the notification to be read")
+	}
+
+	req, _ = http.NewRequest("GET", "/notifications?unread=true", nil)
+	req.AddCookie(session)
+	response = executeRequest(req)
+	notifications = nil
+	json.Unmarshal(response.Body.Bytes(), &notifications)
+	if len(notifications) != 1 || notifications[0].Title != "First" {
+		t.Errorf("Expected only the unread notification. Got %+v", notifications)
+	}
+
+	req, _ = http.NewRequest("GET", "/notifications?limit=0", nil)
+	req.AddCookie(session)
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/notifications", nil)
+	req.Header.Set("Authorization", "Bearer "+addAPIKey("", scopeNotificationsRead))
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+}
+
+func TestEmailRetries(t *testing.T) {
+	clearTables()
+	smtp := newFakeSMTPServer(t)
+	smtp.setFailures(2)
+	useMailSender(t, smtp, 2)
+	for _, to := range []string{"first@example.com", "second@example.com"} {
+		if err := queueEmail(context.Background(), a.DB, mailMessage{to: to, subject: "Hello", text: "Hello\n"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sendDue(t)
+	a.DB.Exec("UPDATE email_deliveries SET next_attempt_at = now()")
+	sendDue(t)
+
+	if n := len(smtp.received()); n != 2 {
+		t.Errorf("Expected both emails to be sent in the end. Got %v", n)
+	}
+	var succeeded, attempts int
+	a.DB.QueryRow("SELECT count(*) FILTER (WHERE status = 'succeeded'), sum(attempts) FROM email_deliveries").Scan(&succeeded, &attempts)
+	if succeeded != 2 || attempts != 4 {
+		t.Errorf("Expected 2 sent emails after 4 attempts. Got %v after %v", succeeded, attempts)
+	}
+}
+
+func TestComposeEmail(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := mailMessage{to: "someone@example.com", subject: "Reminder: Grüße\r\nBcc: evil@example.com", text: "Line one\nLine two\n"}
+	msg, err := mail.ReadMessage(bytes.NewReader(composeEmail("scheduler@example.com", m, now)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Errorf("Expected no header to be injected through the subject")
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != m.subject {
+		t.Errorf("Expected the subject to be encoded. Got %q, %v", subject, err)
+	}
+	if !strings.HasSuffix(msg.Header.Get("Message-Id"), "@example.com>") {
+		t.Errorf("Expected a Message-ID at the domain of the sender. Got %v", msg.Header.Get("Message-Id"))
+	}
+	if date, _ := msg.Header.Date(); !date.Equal(now) {
+		t.Errorf("Expected the date %v. Got %v", now, date)
+	}
+	body, _ := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if string(body) != "Line one\r\nLine two\r\n" {
+		t.Errorf("Expected CRLF line endings. Got %q", body)
+	}
+}
+
+func TestMailSend(t *testing.T) {
+	smtp := newFakeSMTPServer(t)
+	s := newMailSender(nil, MailConfig{SMTPAddr: smtp.Addr().String(), From: "scheduler@example.com"}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.send(ctx, mailMessage{to: "someone@example.com", subject: "Hello", text: ".leading dot\n"}); err != nil {
+		t.Fatal(err)
+	}
+	emails := smtp.received()
+	if len(emails) != 1 || emails[0].to != "someone@example.com" || !strings.Contains(emails[0].data, "\r\n.leading dot") {
+		t.Errorf("Expected the email to arrive with its leading dot. Got %+v", emails)
+	}
+
+	smtp.setFailures(1)
+	if err := s.send(ctx, mailMessage{to: "someone@example.com", subject: "Hello", text: "Hello"}); err == nil || !strings.Contains(err.Error(), "550") {
+		t.Errorf("Expected the refusal of the server. Got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// request IDs from clients are only accepted if they are safe to log
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestInfo is what is known about the current request beyond the
+// *http.Request itself. The user is filled in once the request is
+// authenticated.
+type requestInfo struct {
+	id string
+
+	mu   sync.Mutex
+	user string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+func requestIDFrom(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// setRequestUser records who made the request for the request log.
+func setRequestUser(ctx context.Context, user string) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.mu.Lock()
+		info.user = user
+		info.mu.Unlock()
+	}
+}
+
+func (info *requestInfo) userName() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.user
+}
+
+// routeTemplate is the mux template the request matched with the variable
+// patterns removed, such as /category/{category_id}.
+func routeTemplate(req *http.Request) string {
+	if r := mux.CurrentRoute(req); r != nil {
+		if tmpl, err := r.GetPathTemplate(); err == nil {
+			return routeVariablePattern.ReplaceAllString(tmpl, "{$1}")
+		}
+	}
+	return "unknown"
+}
+
+// logRequests assigns every request an ID, taken from the X-Request-ID header
+// if the client sent a usable one, and logs one line per request once it is
+// served. Handlers find a logger carrying the ID with loggerFrom.
+func (a *App) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := req.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{id: id}
+		l := a.logger.with("request_id", id)
+		if s := spanFrom(req.Context()); s != nil {
+			l = l.with("trace_id", s.sc.traceID.String())
+		}
+		ctx := context.WithValue(req.Context(), requestInfoKey{}, info)
+		req = req.WithContext(withLogger(ctx, l))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		kv := []interface{}{
+			"method", req.Method,
+			"route", routeTemplate(req),
+			"status", rec.status,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"bytes", rec.bytes,
+		}
+		if user := info.userName(); user != "" {
+			kv = append(kv, "user", user)
+		}
+		if rec.status >= http.StatusInternalServerError {
+			l.error("request", kv...)
+		} else {
+			l.info("request", kv...)
+		}
+	})
+}
+
+type logLevelPayload struct {
+	Level string `json:"level"`
+}
+
+func (p logLevelPayload) validate() validationErrors {
+	var errs validationErrors
+	errs.oneOf("level", p.Level, logLevelNames)
+	return errs
+}
+
+// adminEndpoint hides next unless log.admin_endpoint is set, answering like
+// for any unknown path.
+func (a *App) adminEndpoint(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !a.Config.Log.AdminEndpoint {
+			http.NotFound(w, req)
+			return
+		}
+		next(w, req)
+	}
+}
+
+func (a *App) getLogLevel(w http.ResponseWriter, req *http.Request) {
+	respondWithJSON(w, http.StatusOK, logLevelPayload{Level: a.logger.level().String()})
+}
+
+// updateLogLevel changes the level of every logger of the server without a
+// restart.
+func (a *App) updateLogLevel(w http.ResponseWriter, req *http.Request) {
+	var p logLevelPayload
+	if err := decodeJSONBody(w, req, &p); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := p.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+
+	level, _ := parseLogLevel(p.Level)
+	previous := a.logger.level()
+	a.logger.setLevel(level)
+	loggerFrom(req.Context()).warn("log level changed", "from", previous, "to", level)
+	respondWithJSON(w, http.StatusOK, p)
+}
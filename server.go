@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how often expired idempotency keys are purged
+var idempotencyKeyCleanupInterval = time.Hour
+
+// Run serves the API until SIGINT or SIGTERM is received, then drains
+// in-flight requests, stops the background workers and closes the database.
+func (a *App) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return a.serve(ctx)
+}
+
+func (a *App) serve(ctx context.Context) error {
+	cfg := a.Config.Server
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           a.Router,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	if cfg.TLSCertFile != "" {
+		certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate}
+		ln = tls.NewListener(ln, srv.TLSConfig)
+	}
+
+	a.startWorkers()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		a.logger.info("listening", "addr", ln.Addr().String(), "tls", srv.TLSConfig != nil)
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		a.drain()
+		a.logger.info("shutting down", "drain_delay", cfg.DrainDelay, "shutdown_timeout", cfg.ShutdownTimeout)
+		select {
+		case err = <-serveErr:
+		case <-time.After(cfg.DrainDelay):
+		}
+	}
+
+	if shutdownErr := a.shutdown(srv); err == nil {
+		err = shutdownErr
+	}
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
+
+// limitRequestTime gives every request a deadline, after which the queries it
+// still runs are cancelled.
+func (a *App) limitRequestTime(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		timeout := a.Config.Server.RequestTimeout
+		if timeout <= 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func (a *App) startWorkers() {
+	a.workers.start("idempotency-key-cleanup", func(ctx context.Context) {
+		every(ctx, "idempotency-key-cleanup", idempotencyKeyCleanupInterval, func(ctx context.Context) error {
+			return deleteExpiredIdempotencyKeys(ctx, a.DB)
+		})
+	})
+	a.workers.start("session-cleanup", func(ctx context.Context) {
+		every(ctx, "session-cleanup", sessionCleanupInterval, func(ctx context.Context) error {
+			return deleteExpiredSessions(ctx, a.DB)
+		})
+	})
+	a.workers.start("outbox-relay", func(ctx context.Context) {
+		every(ctx, "outbox-relay", a.Config.Outbox.PollInterval, a.outbox.relayDue)
+	})
+	a.workers.start("outbox-cleanup", func(ctx context.Context) {
+		every(ctx, "outbox-cleanup", outboxCleanupInterval, func(ctx context.Context) error {
+			return deletePublishedEvents(ctx, a.DB, a.Config.Outbox.Retention)
+		})
+	})
+	a.workers.start("reminders", func(ctx context.Context) {
+		every(ctx, "reminders", a.Config.Reminders.PollInterval, a.reminders.fireDue)
+	})
+	if a.Config.Mail.enabled() {
+		a.workers.start("email-delivery", func(ctx context.Context) {
+			every(ctx, "email-delivery", a.Config.Mail.PollInterval, a.mail.sendDue)
+		})
+		a.workers.start("digests", func(ctx context.Context) {
+			every(ctx, "digests", a.Config.Digests.PollInterval, a.digests.sendDue)
+		})
+	}
+	a.workers.start("webhook-delivery", func(ctx context.Context) {
+		every(ctx, "webhook-delivery", a.Config.Webhooks.PollInterval, a.webhooks.deliverDue)
+	})
+	if _, ok := a.rateLimits.(*postgresRateLimitStore); ok {
+		a.workers.start("rate-limit-cleanup", func(ctx context.Context) {
+			every(ctx, "rate-limit-cleanup", rateLimitCleanupInterval, func(ctx context.Context) error {
+				return deleteIdleRateLimitBuckets(ctx, a.DB, a.Config.RateLimit.longestPeriod())
+			})
+		})
+	}
+	if e := a.tracer.exporter; e != nil {
+		a.workers.start("trace-exporter", func(ctx context.Context) {
+			every(ctx, "trace-exporter", a.Config.Tracing.ExportInterval, e.flush)
+		})
+	}
+}
+
+// shutdown gives in-flight requests and workers until the shutdown timeout to
+// finish before the database is closed.
+func (a *App) shutdown(srv *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.Config.Server.ShutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if workerErr := a.workers.stop(ctx); err == nil {
+		err = workerErr
+	}
+	if e := a.tracer.exporter; e != nil {
+		// spans of the requests that were drained
+		if flushErr := e.flush(ctx); flushErr != nil {
+			a.logger.warn("could not export the last spans", "error", flushErr)
+		}
+	}
+	if a.nats != nil {
+		a.nats.close()
+	}
+	if dbErr := a.DB.Close(); err == nil {
+		err = dbErr
+	}
+	return err
+}
+
+// certReloader serves the certificate at certFile and reloads it whenever the
+// file changes, so certificates can be rotated without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && !info.ModTime().After(r.modTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// keep serving the old certificate while a rotation is in progress
+			rootLogger.warn("could not reload TLS certificate", "error", err)
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	r.cert = &cert
+	r.modTime = info.ModTime()
+	return r.cert, nil
+}
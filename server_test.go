@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWorkerGroupStop(t *testing.T) {
+	var g workerGroup
+	g.start("ticker", func(ctx context.Context) {
+		every(ctx, "ticker", time.Millisecond, func(ctx context.Context) error { return nil })
+	})
+	if !g.status()["ticker"] {
+		t.Fatalf("Expected worker ticker to be running")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := g.stop(ctx); err != nil {
+		t.Fatalf("Expected workers to stop. Got %v", err)
+	}
+	if g.status()["ticker"] {
+		t.Errorf("Expected worker ticker to be stopped")
+	}
+}
+
+func TestWorkerGroupStopTimeout(t *testing.T) {
+	var g workerGroup
+	block := make(chan struct{})
+	defer close(block)
+	g.start("stuck", func(ctx context.Context) { <-block })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v. Got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := testCertName(t, r); cn != "first" {
+		t.Errorf("Expected certificate first. Got %s", cn)
+	}
+
+	writeTestCert(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if cn := testCertName(t, r); cn != "second" {
+		t.Errorf("Expected certificate second after rotation. Got %s", cn)
+	}
+
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if cn := testCertName(t, r); cn != "second" {
+		t.Errorf("Expected the previous certificate to be kept on a bad reload. Got %s", cn)
+	}
+}
+
+func testCertName(t *testing.T, r *certReloader) string {
+	cert, err := r.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func writeTestCert(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const sessionCookie = "scheduler_session"
+
+var sessionCleanupInterval = time.Hour
+
+// createSession starts a session for userId and returns its token. Only a
+// hash of the token is stored.
+func createSession(ctx context.Context, db queryer, userId string, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO sessions(token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hashToken(token), userId, time.Now().Add(ttl),
+	)
+	return token, err
+}
+
+// sessionUser returns the user of an unexpired session, or "" if there is
+// none for token.
+func sessionUser(ctx context.Context, db queryer, token string) (string, error) {
+	var userId string
+	err := db.QueryRowContext(ctx,
+		"SELECT user_id FROM sessions WHERE token_hash=$1 AND expires_at > now()",
+		hashToken(token),
+	).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return userId, err
+}
+
+func deleteSession(ctx context.Context, db queryer, token string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash=$1", hashToken(token))
+	return err
+}
+
+func deleteExpiredSessions(ctx context.Context, db queryer) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < now()")
+	return err
+}
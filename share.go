@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// roles a user can have on a category, each including the ones before it
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleOwner  = "owner"
+)
+
+var categoryRoles = []string{roleViewer, roleEditor, roleOwner}
+
+// where a share comes from
+const (
+	shareDirect = "direct"
+	shareGroup  = "group"
+)
+
+const maxGroupNameLength = 255
+
+// groupRole grants the members of an identity provider group a role on a
+// category. Shares are updated when a member logs in.
+type groupRole struct {
+	Group string `json:"group"`
+	Role  string `json:"role"`
+}
+
+type groupRoleInput struct {
+	Role string `json:"role"`
+}
+
+var errGroupRoleNotFound = notFoundError("group_role_not_found", "Group role not found")
+
+func roleRank(role string) int {
+	for i, r := range categoryRoles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// authorizeCategory checks that the principal of ctx has at least role on
+// the category. Only principals acting for a user are restricted, anonymous
+// requests and service keys are governed by their scopes alone, and admins
+// of the workspace own all of its categories. Categories of other
+// workspaces, and for users the ones not shared with them, are reported as
+// not found.
+func authorizeCategory(ctx context.Context, db queryer, categoryId, role string) error {
+	p := principalFrom(ctx)
+	ws := workspaceFrom(ctx)
+	if p.userId == "" || ws.role == workspaceRoleAdmin {
+		var exists int
+		err := db.QueryRowContext(ctx,
+			"SELECT 1 FROM categories WHERE category_id=$1 AND workspace_id=$2",
+			categoryId, ws.id,
+		).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return errCategoryNotFound
+		}
+		return err
+	}
+
+	var has string
+	err := db.QueryRowContext(ctx,
+		`SELECT s.role FROM category_shares s JOIN categories c ON c.category_id = s.category_id
+		WHERE s.category_id=$1 AND s.user_id=$2 AND c.workspace_id=$3`,
+		categoryId, p.userId, ws.id,
+	).Scan(&has)
+	if err == sql.ErrNoRows {
+		return errCategoryNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if roleRank(has) < roleRank(role) {
+		return forbiddenError("insufficient_role", fmt.Sprintf("Requires the %s role on the category", role))
+	}
+	return nil
+}
+
+// requireCategoryRole only lets requests through whose user has at least
+// role on the category in the path.
+func (a *App) requireCategoryRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, err := pathCategoryId(req)
+		if err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+		if err := authorizeCategory(req.Context(), a.DB, id, role); err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+		next(w, req)
+	}
+}
+
+func shareCategory(ctx context.Context, db queryer, categoryId, userId, role, source string) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO category_shares(category_id, user_id, role, source) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (category_id, user_id) DO UPDATE SET role=EXCLUDED.role, source=EXCLUDED.source`,
+		categoryId, userId, role, source,
+	)
+	return dbError(err)
+}
+
+// syncGroupShares replaces the group shares of a user with the ones granted
+// to groups, taking the highest role where several groups match a category.
+// Direct shares are left alone.
+func syncGroupShares(ctx context.Context, db queryer, userId string, groups []string) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM category_shares WHERE user_id=$1 AND source=$2", userId, shareGroup); err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO category_shares(category_id, user_id, role, source)
+		SELECT category_id, $1, ($3::text[])[MAX(array_position($3::text[], role))], $2
+		FROM category_group_roles WHERE group_name = ANY($4)
+		GROUP BY category_id
+		ON CONFLICT (category_id, user_id) DO NOTHING`,
+		userId, shareGroup, pq.Array(categoryRoles), pq.Array(groups),
+	)
+	return err
+}
+
+// Group roles are restricted to the category in the workspace of ctx, like
+// the category itself.
+
+func (c *category) getGroupRoles(ctx context.Context, db queryer) ([]groupRole, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT group_name, role FROM category_group_roles
+		WHERE category_id=$1 AND category_id IN (SELECT category_id FROM categories WHERE workspace_id=$2)
+		ORDER BY group_name`,
+		c.Category_ID, workspaceFrom(ctx).id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []groupRole{}
+	for rows.Next() {
+		var r groupRole
+		if err := rows.Scan(&r.Group, &r.Role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+func (c *category) setGroupRole(ctx context.Context, db queryer, r groupRole) error {
+	res, err := db.ExecContext(ctx,
+		`INSERT INTO category_group_roles(category_id, group_name, role)
+		SELECT category_id, $2, $3 FROM categories WHERE category_id=$1 AND workspace_id=$4
+		ON CONFLICT (category_id, group_name) DO UPDATE SET role=EXCLUDED.role`,
+		c.Category_ID, r.Group, r.Role, workspaceFrom(ctx).id,
+	)
+	return affectedOrNotFound(res, err, errCategoryNotFound)
+}
+
+func (c *category) deleteGroupRole(ctx context.Context, db queryer, group string) error {
+	res, err := db.ExecContext(ctx,
+		`DELETE FROM category_group_roles WHERE category_id=$1 AND group_name=$2
+		AND category_id IN (SELECT category_id FROM categories WHERE workspace_id=$3)`,
+		c.Category_ID, group, workspaceFrom(ctx).id,
+	)
+	return affectedOrNotFound(res, err, errGroupRoleNotFound)
+}
+
+func (r groupRole) validate() validationErrors {
+	var errs validationErrors
+	errs.required("group", r.Group)
+	errs.maxLength("group", r.Group, maxGroupNameLength)
+	errs.oneOf("role", r.Role, categoryRoles)
+	return errs
+}
+
+func (a *App) getGroupRoles(w http.ResponseWriter, req *http.Request) {
+	id, err := pathCategoryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	c := category{Category_ID: id}
+	if err := c.getCategory(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	roles, err := c.getGroupRoles(req.Context(), a.DB)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, roles)
+}
+
+// setGroupRole grants a group a role on the category. Members get it the
+// next time they log in.
+func (a *App) setGroupRole(w http.ResponseWriter, req *http.Request) {
+	id, err := pathCategoryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	var in groupRoleInput
+	if err := decodeJSONBody(w, req, &in); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	r := groupRole{Group: mux.Vars(req)["group"], Role: in.Role}
+	if errs := r.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+
+	c := category{Category_ID: id}
+	if err := c.setGroupRole(req.Context(), a.DB, r); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, r)
+}
+
+func (a *App) deleteGroupRole(w http.ResponseWriter, req *http.Request) {
+	id, err := pathCategoryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	c := category{Category_ID: id}
+	if err := c.deleteGroupRole(req.Context(), a.DB, mux.Vars(req)["group"]); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
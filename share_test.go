@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// addSession creates a user with a session and returns the session cookie.
+func addSession(t *testing.T, email string) (string, *http.Cookie) {
+	u := user{Email: email, Name: email}
+	if err := u.createUser(context.Background(), a.DB); err != nil {
+		t.Fatal(err)
+	}
+	token, err := createSession(context.Background(), a.DB, u.User_ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.User_ID, &http.Cookie{Name: sessionCookie, Value: token}
+}
+
+func TestCategoryRoles(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t)
+	_, owner := addSession(t, "owner@example.com")
+	viewerId, viewer := addSession(t, "viewer@example.com")
+	_, stranger := addSession(t, "stranger@example.com")
+
+	req, _ := http.NewRequest("POST", "/category", bytes.NewBufferString(`{"name":"Roadmap","description":"Q3"}`))
+	req.AddCookie(owner)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var c category
+	json.Unmarshal(response.Body.Bytes(), &c)
+	shareCategory(context.Background(), a.DB, c.Category_ID, viewerId, roleViewer, shareDirect)
+
+	req, _ = http.NewRequest("GET", "/category/"+c.Category_ID, nil)
+	req.AddCookie(viewer)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", "/category/"+c.Category_ID, bytes.NewBufferString(`{"name":"Mine","description":"Now"}`))
+	req.AddCookie(viewer)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "insufficient_role" {
+		t.Errorf("Expected code 'insufficient_role'. Got '%v'", p.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/category/"+c.Category_ID, nil)
+	req.AddCookie(stranger)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("DELETE", "/category/"+c.Category_ID, nil)
+	req.AddCookie(owner)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+}
+
+func TestServiceKeysIgnoreCategoryRoles(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+	key := addAPIKey("", scopeCategoriesRead)
+
+	req, _ := http.NewRequest("GET", "/category/"+categoryId, nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+}
+
+func TestGroupRoles(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+
+	req, _ := http.NewRequest("PUT", "/category/"+categoryId+"/group-roles/engineering", bytes.NewBufferString(`{"role":"editor"}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	req, _ = http.NewRequest("PUT", "/category/"+categoryId+"/group-roles/ops", bytes.NewBufferString(`{"role":"viewer"}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	req, _ = http.NewRequest("PUT", "/category/"+categoryId+"/group-roles/ops", bytes.NewBufferString(`{"role":"admin"}`))
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+
+	userId, session := addSession(t, "ada@example.com")
+	if err := syncGroupShares(context.Background(), a.DB, userId, []string{"ops", "engineering"}); err != nil {
+		t.Fatal(err)
+	}
+	var role string
+	a.DB.QueryRow("SELECT role FROM category_shares WHERE category_id=$1 AND user_id=$2", categoryId, userId).Scan(&role)
+	if role != roleEditor {
+		t.Errorf("Expected the highest group role 'editor'. Got '%v'", role)
+	}
+
+	req, _ = http.NewRequest("GET", "/category/"+categoryId+"/group-roles", nil)
+	req.AddCookie(session)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("DELETE", "/category/"+categoryId+"/group-roles/engineering", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	req, _ = http.NewRequest("GET", "/category/"+categoryId+"/group-roles", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var roles []groupRole
+	json.Unmarshal(response.Body.Bytes(), &roles)
+	if len(roles) != 1 || roles[0] != (groupRole{Group: "ops", Role: roleViewer}) {
+		t.Errorf("Expected only the ops role to remain. Got %+v", roles)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/category/"+categoryId+"/group-roles/engineering", nil)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+func TestGroupRolesAreScopedToWorkspace(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t, scopeCategoriesRead, scopeCategoriesWrite)
+	inA := withWorkspace(context.Background(), currentWorkspace{id: addWorkspace(t, "Team A")})
+	c := category{Name: "Team A only"}
+	if err := c.createCategory(inA, a.DB); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.setGroupRole(inA, a.DB, groupRole{Group: "engineering", Role: roleEditor}); err != nil {
+		t.Fatal(err)
+	}
+
+	adminId, admin := addSession(t, "admin@example.com")
+	workspaceB := addWorkspace(t, "Team B")
+	wsB := workspace{Workspace_ID: workspaceB}
+	if err := wsB.setMember(context.Background(), a.DB, &workspaceMember{User_ID: adminId, Role: workspaceRoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "/category/" + c.Category_ID + "/group-roles"
+	for _, caller := range []string{"anonymous", "admin of another workspace"} {
+		for _, req := range []*http.Request{
+			httptest.NewRequest("GET", url, nil),
+			httptest.NewRequest("PUT", url+"/engineering", bytes.NewBufferString(`{"role":"owner"}`)),
+			httptest.NewRequest("DELETE", url+"/engineering", nil),
+		} {
+			if caller != "anonymous" {
+				req.Header.Set(workspaceHeader, workspaceB)
+				req.AddCookie(admin)
+			}
+			response := executeRequest(req)
+			checkResponseCode(t, http.StatusNotFound, response.Code)
+			var p problem
+			json.Unmarshal(response.Body.Bytes(), &p)
+			if p.Code != "category_not_found" {
+				t.Errorf("%s %s by %s: expected code 'category_not_found'. Got '%v'", req.Method, req.URL.Path, caller, p.Code)
+			}
+		}
+	}
+
+	inB := withWorkspace(context.Background(), currentWorkspace{id: workspaceB})
+	if roles, err := c.getGroupRoles(inB, a.DB); err != nil || len(roles) != 0 {
+		t.Errorf("Expected no group roles outside of the workspace. Got %+v, %v", roles, err)
+	}
+	if err := c.setGroupRole(inB, a.DB, groupRole{Group: "engineering", Role: roleOwner}); err != errCategoryNotFound {
+		t.Errorf("Expected setting a role outside of the workspace to fail with %v. Got %v", errCategoryNotFound, err)
+	}
+	if err := c.deleteGroupRole(inB, a.DB, "engineering"); err != errGroupRoleNotFound {
+		t.Errorf("Expected deleting a role outside of the workspace to fail with %v. Got %v", errGroupRoleNotFound, err)
+	}
+	if roles, _ := c.getGroupRoles(inA, a.DB); len(roles) != 1 || roles[0].Role != roleEditor {
+		t.Errorf("Expected the editor role to be left alone. Got %+v", roles)
+	}
+}
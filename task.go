@@ -1,47 +1,150 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"time"
 )
 
 type task struct {
-	Task_ID     int    `json:"task_id"`
-	Category_ID string `json:"category_id"`
-	Task        string `json:"task"`
-	Seq         int    `json:"seq"`
-	Complete    bool   `json:"complete"`
-}
-
-func (t *task) createTask(db *sql.DB) error {
-	err := db.QueryRow(
-		"INSERT INTO tasks(category_id, task, complete) VALUES ($1, $2, $3) RETURNING task_id",
-		t.Category_ID, t.Task, t.Complete,
-	).Scan(&t.Task_ID)
-	return err
+	Task_ID     int        `json:"task_id"`
+	Category_ID string     `json:"category_id"`
+	Task        string     `json:"task"`
+	Seq         int        `json:"seq"`
+	Complete    bool       `json:"complete"`
+	Due_At      *time.Time `json:"due_at,omitempty"`
 }
 
-func (t *task) getTask(db *sql.DB) error {
-	return db.QueryRow(
-		"SELECT task_id, category_id, task, seq, complete FROM tasks WHERE task_id=$1",
-		t.Task_ID,
-	).Scan(&t.Task_ID, &t.Category_ID, &t.Task, &t.Seq, &t.Complete)
+var errTaskNotFound = notFoundError("task_not_found", "Task not found")
+
+// Like for categories, every query is restricted to the workspace of ctx and
+// changes publish their event with db.
+
+func (t *task) createTask(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		`INSERT INTO tasks(category_id, task, complete, due_at, completed_at)
+		SELECT $1, $2, $3, $5, CASE WHEN $3 THEN now() END WHERE EXISTS (SELECT 1 FROM categories WHERE category_id=$1 AND workspace_id=$4)
+		RETURNING task_id, seq`,
+		t.Category_ID, t.Task, t.Complete, workspaceFrom(ctx).id, t.Due_At,
+	).Scan(&t.Task_ID, &t.Seq)
+	if err == sql.ErrNoRows {
+		return errCategoryNotFound
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	return publishEvent(ctx, db, eventTaskCreated, t)
 }
 
-func (t *task) updateTask(db *sql.DB) error {
-	_, err := db.Exec(
-		"UPDATE tasks SET task=$1, seq=$2, complete=$3 WHERE task_id=$4",
-		t.Task, t.Seq, t.Complete, t.Task_ID,
-	)
+func (t *task) getTask(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		`SELECT task_id, category_id, task, seq, complete, due_at FROM tasks WHERE task_id=$1 AND category_id=$2
+		AND category_id IN (SELECT category_id FROM categories WHERE workspace_id=$3)`,
+		t.Task_ID, t.Category_ID, workspaceFrom(ctx).id,
+	).Scan(&t.Task_ID, &t.Category_ID, &t.Task, &t.Seq, &t.Complete, &t.Due_At)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
 	return err
 }
 
-func (t *task) deleteTask(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM tasks WHERE task_id=$1", t.Task_ID)
-	return err
+// The updates join the task with itself to learn whether it was complete
+// before, so task.completed is only published when it becomes complete.
+// completed_at is kept in the same way, for digests.
+
+func (t *task) updateTask(ctx context.Context, db queryer) error {
+	var wasComplete bool
+	err := db.QueryRowContext(ctx,
+		`UPDATE tasks t SET task=$1, seq=$2, complete=$3, due_at=$7,
+			completed_at = CASE WHEN NOT $3 THEN NULL WHEN old.complete THEN old.completed_at ELSE now() END
+		FROM tasks old
+		WHERE t.task_id=$4 AND t.category_id=$5 AND old.task_id = t.task_id
+		AND t.category_id IN (SELECT category_id FROM categories WHERE workspace_id=$6)
+		RETURNING old.complete`,
+		t.Task, t.Seq, t.Complete, t.Task_ID, t.Category_ID, workspaceFrom(ctx).id, t.Due_At,
+	).Scan(&wasComplete)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	return t.publishUpdate(ctx, db, wasComplete)
+}
+
+func (t *task) completeTask(ctx context.Context, db queryer) error {
+	var wasComplete bool
+	err := db.QueryRowContext(ctx,
+		`UPDATE tasks t SET complete=$1,
+			completed_at = CASE WHEN NOT $1 THEN NULL WHEN old.complete THEN old.completed_at ELSE now() END
+		FROM tasks old
+		WHERE t.task_id=$2 AND t.category_id=$3 AND old.task_id = t.task_id
+		AND t.category_id IN (SELECT category_id FROM categories WHERE workspace_id=$4)
+		RETURNING t.task, t.seq, t.due_at, old.complete`,
+		t.Complete, t.Task_ID, t.Category_ID, workspaceFrom(ctx).id,
+	).Scan(&t.Task, &t.Seq, &t.Due_At, &wasComplete)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	return t.publishUpdate(ctx, db, wasComplete)
+}
+
+func (t *task) publishUpdate(ctx context.Context, db queryer, wasComplete bool) error {
+	if err := publishEvent(ctx, db, eventTaskUpdated, t); err != nil {
+		return err
+	}
+	if t.Complete && !wasComplete {
+		return publishEvent(ctx, db, eventTaskCompleted, t)
+	}
+	return nil
 }
 
-func (c *category) getTasks(db *sql.DB) ([]task, error) {
-	rows, err := db.Query("SELECT task_id, category_id, task, seq, complete FROM tasks WHERE category_id=$1", c.Category_ID)
+// moveTask moves the task into the category with targetId.
+func (t *task) moveTask(ctx context.Context, db queryer, targetId string) error {
+	target := category{Category_ID: targetId}
+	if err := target.getCategory(ctx, db); err != nil {
+		return err
+	}
+	err := db.QueryRowContext(ctx,
+		`UPDATE tasks SET category_id=$1 WHERE task_id=$2 AND category_id=$3
+		AND category_id IN (SELECT category_id FROM categories WHERE workspace_id=$4)
+		RETURNING task, seq, complete, due_at`,
+		targetId, t.Task_ID, t.Category_ID, workspaceFrom(ctx).id,
+	).Scan(&t.Task, &t.Seq, &t.Complete, &t.Due_At)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	t.Category_ID = targetId
+	return publishEvent(ctx, db, eventTaskUpdated, t)
+}
+
+func (t *task) deleteTask(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		`DELETE FROM tasks WHERE task_id=$1 AND category_id=$2
+		AND category_id IN (SELECT category_id FROM categories WHERE workspace_id=$3)
+		RETURNING task, seq, complete, due_at`,
+		t.Task_ID, t.Category_ID, workspaceFrom(ctx).id,
+	).Scan(&t.Task, &t.Seq, &t.Complete, &t.Due_At)
+	if err == sql.ErrNoRows {
+		return errTaskNotFound
+	}
+	if err != nil {
+		return dbError(err)
+	}
+	return publishEvent(ctx, db, eventTaskDeleted, t)
+}
+
+func (c *category) getTasks(ctx context.Context, db queryer) ([]task, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT task_id, category_id, task, seq, complete, due_at FROM tasks WHERE category_id=$1 AND category_id IN (SELECT category_id FROM categories WHERE workspace_id=$2)",
+		c.Category_ID, workspaceFrom(ctx).id,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +153,7 @@ func (c *category) getTasks(db *sql.DB) ([]task, error) {
 	tasks := []task{}
 	for rows.Next() {
 		var tsk task
-		err := rows.Scan(&tsk.Task_ID, &tsk.Category_ID, &tsk.Task, &tsk.Seq, &tsk.Complete)
+		err := rows.Scan(&tsk.Task_ID, &tsk.Category_ID, &tsk.Task, &tsk.Seq, &tsk.Complete, &tsk.Due_At)
 		if err != nil {
 			return nil, err
 		}
@@ -29,10 +29,13 @@ func TestGetNonExistentTask(t *testing.T) {
 	response := executeRequest(req)
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 
-	var m map[string]string
-	json.Unmarshal(response.Body.Bytes(), &m)
-	if m["error"] != "Task not found" {
-		t.Errorf("Expected the 'error' key of the response to be set to 'Task not found'. Got %s", m["error"])
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "task_not_found" {
+		t.Errorf("Expected the 'code' key of the response to be set to 'task_not_found'. Got %s", p.Code)
+	}
+	if p.Detail != "Task not found" {
+		t.Errorf("Expected the 'detail' key of the response to be set to 'Task not found'. Got %s", p.Detail)
 	}
 }
 
@@ -145,3 +148,76 @@ func TestDeleteTask(t *testing.T) {
 
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
+
+func TestTaskRoutesAreScopedToCategory(t *testing.T) {
+	clearTables()
+	categoryIds := addCategories(2)
+	taskId := addTaskToCategory(categoryIds[0])
+	otherCategoryId := categoryIds[1]
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/category/%v/task/%v", otherCategoryId, taskId), nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	jsonString := []byte(`{"task":"hijacked task", "complete":true}`)
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/category/%v/task/%v", otherCategoryId, taskId), bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/category/%v/task/%v", otherCategoryId, taskId), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	// the task is untouched in its own category
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/category/%v/task/%v", categoryIds[0], taskId), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["task"] != "Test Task" {
+		t.Errorf("Expected task to be 'Test Task'. Got %s", m["task"])
+	}
+}
+
+func TestBatchTasksAreScopedToCategory(t *testing.T) {
+	clearTables()
+	categoryIds := addCategories(2)
+	taskId := addTaskToCategory(categoryIds[0])
+
+	jsonString := []byte(fmt.Sprintf(`{"operations": [{"op": "delete", "task_id": %v}]}`, taskId))
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/category/%v/tasks:batch", categoryIds[1]), bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/category/%v/task/%v", categoryIds[0], taskId), nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestCreateTaskInNonExistentCategory(t *testing.T) {
+	clearTables()
+
+	jsonString := []byte(`{"task":"Test task","complete": false}`)
+	req, _ := http.NewRequest("POST", "/category/b119178b-2fd2-4a5c-9301-190c341df180/task", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "category_not_found" {
+		t.Errorf("Expected the 'code' key of the response to be set to 'category_not_found'. Got %s", p.Code)
+	}
+}
+
+func TestTaskRoutesWithInvalidCategoryId(t *testing.T) {
+	clearTables()
+
+	req, _ := http.NewRequest("GET", "/category/abc-123/task/1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
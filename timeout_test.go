@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// lockCategories blocks every query on the categories table until the test
+// ends.
+func lockCategories(t *testing.T) {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("LOCK TABLE categories IN ACCESS EXCLUSIVE MODE"); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+}
+
+func activeCategoryQueries(t *testing.T) int {
+	var n int
+	err := a.DB.QueryRow(
+		"SELECT COUNT(*) FROM pg_stat_activity WHERE state='active' AND query LIKE 'SELECT category_id, name, description FROM categories%'",
+	).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func checkTimeoutProblem(t *testing.T, body []byte) {
+	var p problem
+	json.Unmarshal(body, &p)
+	if p.Code != "timeout" {
+		t.Errorf("Expected the 'code' key of the response to be set to 'timeout'. Got %s", p.Code)
+	}
+}
+
+func TestCancelledRequestAbortsQuery(t *testing.T) {
+	clearTables()
+	lockCategories(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	response := executeRequest(req.WithContext(ctx))
+	checkResponseCode(t, http.StatusServiceUnavailable, response.Code)
+	checkTimeoutProblem(t, response.Body.Bytes())
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the request to return soon after it was cancelled. Took %s", elapsed)
+	}
+	if n := activeCategoryQueries(t); n != 0 {
+		t.Errorf("Expected the query to be aborted in Postgres. Still %d running", n)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	clearTables()
+	previous := a.Config.Server.RequestTimeout
+	a.Config.Server.RequestTimeout = 200 * time.Millisecond
+	defer func() { a.Config.Server.RequestTimeout = previous }()
+	lockCategories(t)
+
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusServiceUnavailable, response.Code)
+	checkTimeoutProblem(t, response.Body.Bytes())
+
+	if n := activeCategoryQueries(t); n != 0 {
+		t.Errorf("Expected the query to be aborted in Postgres. Still %d running", n)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	connector, err := pq.NewConnector(a.Config.Database.connectionString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(instrumentedConnector{
+		Connector:    connector,
+		metrics:      newMetrics(),
+		tracer:       &tracer{},
+		queryTimeout: 100 * time.Millisecond,
+	})
+	defer db.Close()
+
+	start := time.Now()
+	_, err = db.ExecContext(context.Background(), "SELECT pg_sleep(5)")
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the query to be cancelled after its timeout. Took %s", elapsed)
+	}
+
+	var e *appError
+	if !errors.As(canceledError(err), &e) || e.Kind != kindTimeout {
+		t.Errorf("Expected a timeout error. Got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal tracer compatible with OpenTelemetry: it continues traces from W3C
+// traceparent headers and exports sampled spans with OTLP over HTTP/JSON.
+
+const traceparentHeader = "traceparent"
+
+type traceID [16]byte
+type spanID [8]byte
+
+func (t traceID) String() string { return hex.EncodeToString(t[:]) }
+func (s spanID) String() string  { return hex.EncodeToString(s[:]) }
+
+type spanContext struct {
+	traceID traceID
+	spanID  spanID
+	sampled bool
+}
+
+// parseTraceparent reads a header such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01, see
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func parseTraceparent(h string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// version 00 has exactly four fields, later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return sc, false
+	}
+	if !decodeHexInto(sc.traceID[:], parts[1]) || !decodeHexInto(sc.spanID[:], parts[2]) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	if sc.traceID == (traceID{}) || sc.spanID == (spanID{}) {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// decodeHexInto accepts lowercase hex of exactly the length of dst.
+func decodeHexInto(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.traceID, sc.spanID, flags)
+}
+
+// values match the OTLP SpanKind enum
+type spanKind int
+
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+	spanKindClient   spanKind = 3
+)
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+type span struct {
+	tracer *tracer
+	name   string
+	kind   spanKind
+	sc     spanContext
+	parent spanID
+	start  time.Time
+
+	mu            sync.Mutex
+	end           time.Time
+	attributes    []attribute
+	failed        bool
+	statusMessage string
+}
+
+// recording reports whether the span will be exported. Spans that are not
+// recorded still carry their context to child spans and outgoing requests.
+func (s *span) recording() bool {
+	return s.tracer != nil && s.tracer.exporter != nil && s.sc.sampled
+}
+
+// setAttributes adds key-value pairs to the span.
+func (s *span) setAttributes(kv ...interface{}) {
+	if !s.recording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.attributes = append(s.attributes, attribute{fmt.Sprint(kv[i]), kv[i+1]})
+	}
+}
+
+// fail marks the span as failed.
+func (s *span) fail(message string) {
+	if !s.recording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.statusMessage = message
+}
+
+// finish ends the span and hands it to the exporter.
+func (s *span) finish() {
+	if !s.recording() {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.exporter.enqueue(s)
+}
+
+type spanKey struct{}
+
+func withSpan(ctx context.Context, s *span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// spanFrom returns the current span of ctx, or nil.
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// withRemoteParent continues the trace of an incoming request.
+func withRemoteParent(ctx context.Context, sc spanContext) context.Context {
+	return withSpan(ctx, &span{sc: sc})
+}
+
+type tracer struct {
+	// fraction of new traces that are sampled; traces continued from a
+	// caller follow the caller's decision
+	sampleRatio float64
+	// nil if spans are not exported
+	exporter *spanExporter
+}
+
+// start begins a span that is a child of the span in ctx, if any.
+func (t *tracer) start(ctx context.Context, name string, kind spanKind, kv ...interface{}) (context.Context, *span) {
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent := spanFrom(ctx); parent != nil {
+		s.sc.traceID = parent.sc.traceID
+		s.sc.sampled = parent.sc.sampled
+		s.parent = parent.sc.spanID
+	} else {
+		rand.Read(s.sc.traceID[:])
+		s.sc.sampled = t.shouldSample(s.sc.traceID)
+	}
+	rand.Read(s.sc.spanID[:])
+	s.setAttributes(kv...)
+	return withSpan(ctx, s), s
+}
+
+// shouldSample decides from the trace ID alone, so every service with the
+// same ratio makes the same decision for a trace.
+func (t *tracer) shouldSample(id traceID) bool {
+	switch {
+	case t.sampleRatio >= 1:
+		return true
+	case t.sampleRatio <= 0:
+		return false
+	}
+	return binary.BigEndian.Uint64(id[8:])>>1 < uint64(t.sampleRatio*(1<<63))
+}
+
+// traceRequests starts a server span for every routed request, continuing
+// the caller's trace if it sent a traceparent header.
+func (a *App) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		if sc, ok := parseTraceparent(req.Header.Get(traceparentHeader)); ok {
+			ctx = withRemoteParent(ctx, sc)
+		}
+
+		route := routeTemplate(req)
+		ctx, s := a.tracer.start(ctx, req.Method+" "+route, spanKindServer,
+			"http.method", req.Method,
+			"http.route", route,
+			"http.target", req.URL.Path,
+		)
+		defer s.finish()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.setAttributes("http.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			s.fail(http.StatusText(rec.status))
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// traceCollector is an in-process OTLP/HTTP endpoint that keeps what it receives.
+type traceCollector struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func newTraceCollector(t *testing.T) *traceCollector {
+	c := &traceCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" || req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var traces otlpTraces
+		if err := json.NewDecoder(req.Body).Decode(&traces); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		for _, rs := range traces.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+		c.mu.Unlock()
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *traceCollector) find(name string) (otlpSpan, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return otlpSpan{}, false
+}
+
+// useCollector makes the test app export its spans to a new collector.
+func useCollector(t *testing.T, sampleRatio float64) (*traceCollector, *spanExporter) {
+	c := newTraceCollector(t)
+	e := newSpanExporter(c.URL, "scheduler-test")
+	previous := *a.tracer
+	a.tracer.sampleRatio, a.tracer.exporter = sampleRatio, e
+	t.Cleanup(func() { *a.tracer = previous })
+	return c, e
+}
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("Expected a valid traceparent")
+	}
+	if sc.traceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.spanID.String() != "00f067aa0ba902b7" || !sc.sampled {
+		t.Errorf("Unexpected span context %s", sc.traceparent())
+	}
+	if got := sc.traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Expected the header to round-trip. Got %s", got)
+	}
+
+	for _, h := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(h); ok {
+			t.Errorf("Expected %q to be rejected", h)
+		}
+	}
+}
+
+func TestSampleRatio(t *testing.T) {
+	tr := &tracer{sampleRatio: 0.25}
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		_, s := tr.start(context.Background(), "job", spanKindInternal)
+		if s.sc.sampled {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Errorf("Expected about 1000 of 4000 traces to be sampled. Got %d", sampled)
+	}
+}
+
+func TestRequestSpanContinuesTrace(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+	c, e := useCollector(t, 0)
+
+	// the caller's sampling decision wins over the ratio of 0
+	req, _ := http.NewRequest("GET", "/category/"+categoryId, nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s, ok := c.find("GET /category/{category_id}")
+	if !ok {
+		t.Fatalf("Expected a server span. Got %+v", c.spans)
+	}
+	if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected the span to continue the caller's trace. Got trace %s parent %s", s.TraceID, s.ParentSpanID)
+	}
+	if s.Kind != spanKindServer {
+		t.Errorf("Expected a server span. Got kind %d", s.Kind)
+	}
+}
+
+func TestUnsampledRequestIsNotExported(t *testing.T) {
+	c, e := useCollector(t, 1)
+
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	executeRequest(req)
+
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.spans) != 0 {
+		t.Errorf("Expected no spans for a trace the caller did not sample. Got %d", len(c.spans))
+	}
+}
+
+func TestQuerySpanIsChildOfRequestSpan(t *testing.T) {
+	clearTables()
+	c, e := useCollector(t, 1)
+
+	ctx, parent := a.tracer.start(context.Background(), "job", spanKindInternal)
+	var n int
+	if err := a.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM categories").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	parent.finish()
+
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s, ok := c.find("select categories")
+	if !ok {
+		t.Fatalf("Expected a query span. Got %+v", c.spans)
+	}
+	if s.ParentSpanID != parent.sc.spanID.String() || s.Kind != spanKindClient {
+		t.Errorf("Expected a client span below the job span. Got parent %s kind %d", s.ParentSpanID, s.Kind)
+	}
+}
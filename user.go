@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type user struct {
+	User_ID string `json:"user_id"`
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+}
+
+var errUserNotFound = notFoundError("user_not_found", "User not found")
+
+func (u *user) createUser(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO users(email, name) VALUES ($1, $2) RETURNING user_id",
+		u.Email, u.Name,
+	).Scan(&u.User_ID)
+	return dbError(err)
+}
+
+func (u *user) getUser(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		"SELECT email, name FROM users WHERE user_id=$1",
+		u.User_ID,
+	).Scan(&u.Email, &u.Name)
+	if err == sql.ErrNoRows {
+		return errUserNotFound
+	}
+	return err
+}
+
+func (u *user) validate() validationErrors {
+	var errs validationErrors
+	errs.required("email", u.Email)
+	errs.maxLength("email", u.Email, 255)
+	if u.Email != "" && !strings.Contains(u.Email, "@") {
+		errs.add("email", "must be an email address")
+	}
+	errs.required("name", u.Name)
+	errs.maxLength("name", u.Name, 255)
+	return errs
+}
+
+func pathUserId(req *http.Request) (string, error) {
+	id := mux.Vars(req)["user_id"]
+	if !isValidUUID(id) {
+		return "", badRequestError("invalid_user_id", "Invalid user ID")
+	}
+	return id, nil
+}
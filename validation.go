@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// largest request body accepted by any handler
+const maxBodyBytes = 1 << 20
+
+const (
+	maxCategoryNameLength        = 255
+	maxCategoryDescriptionLength = 2000
+	maxTaskLength                = 1000
+	maxBatchOperations           = 100
+)
+
+var batchOperationTypes = []string{"create", "update", "complete", "move", "delete"}
+
+var (
+	errInvalidPayload = badRequestError("invalid_payload", "Invalid request payload")
+	errBodyTooLarge   = &appError{Kind: kindTooLarge, Code: "body_too_large", Message: "Request body too large"}
+)
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type validationErrors []fieldError
+
+func (v validationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (v *validationErrors) add(field, message string) {
+	*v = append(*v, fieldError{Field: field, Message: message})
+}
+
+func (v *validationErrors) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "is required")
+	}
+}
+
+func (v *validationErrors) maxLength(field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		v.add(field, fmt.Sprintf("must be at most %d characters", max))
+	}
+}
+
+func (v *validationErrors) min(field string, value, min int) {
+	if value < min {
+		v.add(field, fmt.Sprintf("must be at least %d", min))
+	}
+}
+
+func (v *validationErrors) nonNegative(field string, d time.Duration) {
+	if d < 0 {
+		v.add(field, "must not be negative")
+	}
+}
+
+func (v *validationErrors) oneOf(field, value string, allowed []string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(field, fmt.Sprintf("must be one of: %s", strings.Join(allowed, ", ")))
+}
+
+func (v *validationErrors) uuid(field, value string) {
+	if !isValidUUID(value) {
+		v.add(field, "must be a valid UUID")
+	}
+}
+
+func (c *category) validate() validationErrors {
+	var errs validationErrors
+	errs.required("name", c.Name)
+	errs.maxLength("name", c.Name, maxCategoryNameLength)
+	errs.maxLength("description", c.Description, maxCategoryDescriptionLength)
+	return errs
+}
+
+func (t *task) validate() validationErrors {
+	var errs validationErrors
+	errs.required("task", t.Task)
+	errs.maxLength("task", t.Task, maxTaskLength)
+	errs.min("seq", t.Seq, 0)
+	return errs
+}
+
+func (b *batchRequest) validate() validationErrors {
+	var errs validationErrors
+	if len(b.Operations) == 0 {
+		errs.add("operations", "is required")
+	}
+	if len(b.Operations) > maxBatchOperations {
+		errs.add("operations", fmt.Sprintf("must contain at most %d operations", maxBatchOperations))
+	}
+	return errs
+}
+
+func (op *batchOperation) validate() validationErrors {
+	var errs validationErrors
+	errs.oneOf("op", op.Op, batchOperationTypes)
+	if op.Op != "create" {
+		errs.min("task_id", op.Task_ID, 1)
+	}
+	switch op.Op {
+	case "create", "update":
+		errs.required("task", op.Task)
+		errs.maxLength("task", op.Task, maxTaskLength)
+		errs.min("seq", op.Seq, 0)
+	case "move":
+		errs.uuid("category_id", op.Category_ID)
+	}
+	return errs
+}
+
+// decodeJSONBody decodes a size-limited request body into dst, rejecting
+// unknown fields.
+func decodeJSONBody(w http.ResponseWriter, req *http.Request, dst interface{}) error {
+	req.Body = limitBody(w, req.Body, maxBodyBytes)
+	defer req.Body.Close()
+
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(dst)
+	if err == nil && decoder.More() {
+		err = errors.New("unexpected data after JSON body")
+	}
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	var errs validationErrors
+	switch {
+	case err == errBodyTooLarge:
+		return errBodyTooLarge
+	case errors.As(err, &typeErr):
+		errs.add(typeErr.Field, fmt.Sprintf("must be of type %s", typeErr.Type))
+		return validationError(errs)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		errs.add(strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`), "is not allowed")
+		return validationError(errs)
+	default:
+		return errInvalidPayload
+	}
+}
+
+// limitBody is http.MaxBytesReader failing with errBodyTooLarge, as its own
+// error cannot be told apart from others before Go 1.19.
+func limitBody(w http.ResponseWriter, body io.ReadCloser, n int64) io.ReadCloser {
+	return &limitedBody{ReadCloser: http.MaxBytesReader(w, body, n), limit: n}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	limit, read int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	// the limit has been reached when MaxBytesReader fails on reading more
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		err = errBodyTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateCategoryWithEmptyName(t *testing.T) {
+	clearTables()
+
+	jsonString := []byte(`{"name":"","description": "Test description"}`)
+	req, _ := http.NewRequest("POST", "/category", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var res problem
+	json.Unmarshal(response.Body.Bytes(), &res)
+	if len(res.Fields) != 1 || res.Fields[0].Field != "name" {
+		t.Errorf("Expected a single field error for 'name'. Got %v", res.Fields)
+	}
+}
+
+func TestCreateCategoryWithUnknownField(t *testing.T) {
+	clearTables()
+
+	jsonString := []byte(`{"name":"Test category","colour": "red"}`)
+	req, _ := http.NewRequest("POST", "/category", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var res problem
+	json.Unmarshal(response.Body.Bytes(), &res)
+	if len(res.Fields) != 1 || res.Fields[0].Field != "colour" {
+		t.Errorf("Expected a single field error for 'colour'. Got %v", res.Fields)
+	}
+}
+
+func TestCreateCategoryWithOversizedBody(t *testing.T) {
+	clearTables()
+
+	jsonString := []byte(fmt.Sprintf(`{"name":"Test category","description": "%s"}`, strings.Repeat("a", maxBodyBytes)))
+	req, _ := http.NewRequest("POST", "/category", bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, response.Code)
+}
+
+func TestDecodeJSONBodyLimit(t *testing.T) {
+	padding := func(n int) string {
+		return fmt.Sprintf(`{"name":"%s"}`, strings.Repeat("a", n-len(`{"name":""}`)))
+	}
+	tests := []struct {
+		body string
+		err  error
+	}{
+		{padding(maxBodyBytes), nil},
+		{padding(maxBodyBytes + 1), errBodyTooLarge},
+		{`{"name":`, errInvalidPayload},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "/category", strings.NewReader(test.body))
+		var c category
+		if err := decodeJSONBody(httptest.NewRecorder(), req, &c); err != test.err {
+			t.Errorf("Expected %v for a body of %d bytes. Got %v", test.err, len(test.body), err)
+		}
+	}
+}
+
+func TestCreateTaskWithInvalidFields(t *testing.T) {
+	clearTables()
+	categoryId := addCategory()
+
+	jsonString := []byte(`{"task":"","seq": -1}`)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/category/%v/task", categoryId), bytes.NewBuffer(jsonString))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var res problem
+	json.Unmarshal(response.Body.Bytes(), &res)
+	if len(res.Fields) != 2 {
+		t.Errorf("Expected field errors for 'task' and 'seq'. Got %v", res.Fields)
+	}
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Deliveries are POSTed with the event as body and these headers. The
+// signature lets receivers check that a delivery comes from this server and
+// is recent:
+//
+//	X-Webhook-Signature: t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// keyed with the secret of the webhook.
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	// the event ID, the same for every delivery of an event
+	webhookIDHeader       = "X-Webhook-ID"
+	webhookDeliveryHeader = "X-Webhook-Delivery"
+	webhookUserAgent      = "scheduler-webhooks/1"
+)
+
+// generated secrets look like whsec_<secret>
+const webhookSecretTag = "whsec"
+
+// statuses of a delivery. Pending deliveries are sent once next_attempt_at
+// has passed.
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+var deliveryStatuses = []string{deliveryPending, deliverySucceeded, deliveryFailed}
+
+const (
+	// due deliveries sent at once
+	webhookDeliveryBatch = 20
+	// how much of an error is kept in the delivery log
+	maxDeliveryErrorLength = 512
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+type webhook struct {
+	Webhook_ID string `json:"webhook_id"`
+	URL        string `json:"url"`
+	// event types or prefixes such as task.*, empty for every event
+	Events     []string  `json:"events"`
+	Active     bool      `json:"active"`
+	Created_At time.Time `json:"created_at"`
+	// only returned when the webhook is created
+	Secret string `json:"secret,omitempty"`
+}
+
+type webhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// true if not given
+	Active *bool `json:"active"`
+	// generated when a webhook is created without one, and kept when a
+	// webhook is updated without one
+	Secret string `json:"secret"`
+}
+
+type webhookDelivery struct {
+	Delivery_ID string          `json:"delivery_id"`
+	Webhook_ID  string          `json:"webhook_id"`
+	Event_ID    string          `json:"event_id"`
+	Event_Type  string          `json:"event_type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	// only set while the delivery is pending
+	Next_Attempt_At *time.Time `json:"next_attempt_at,omitempty"`
+	Last_Attempt_At *time.Time `json:"last_attempt_at,omitempty"`
+	// status code of the last response, if there was one
+	Response_Status *int      `json:"response_status,omitempty"`
+	Last_Error      string    `json:"last_error,omitempty"`
+	Created_At      time.Time `json:"created_at"`
+}
+
+var (
+	errWebhookNotFound  = notFoundError("webhook_not_found", "Webhook not found")
+	errDeliveryNotFound = notFoundError("delivery_not_found", "Delivery not found")
+)
+
+func (in webhookInput) validate() validationErrors {
+	var errs validationErrors
+	errs.required("url", in.URL)
+	errs.maxLength("url", in.URL, 2048)
+	if in.URL != "" && !isHTTPURL(in.URL) {
+		errs.add("url", "must be an http or https URL")
+	}
+	for _, e := range in.Events {
+		if !validEventPattern(e) {
+			errs.add("events", fmt.Sprintf("unknown event %q, must be one of %s or a prefix such as task.*", e, strings.Join(eventTypes, ", ")))
+		}
+	}
+	if in.Secret != "" && len(in.Secret) < 16 {
+		errs.add("secret", "must be at least 16 characters")
+	}
+	errs.maxLength("secret", in.Secret, 255)
+	return errs
+}
+
+// webhook returns the webhook described by in.
+func (in webhookInput) webhook() webhook {
+	wh := webhook{URL: in.URL, Events: in.Events, Active: in.Active == nil || *in.Active, Secret: in.Secret}
+	if wh.Events == nil {
+		wh.Events = []string{}
+	}
+	return wh
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return webhookSecretTag + "_" + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// Like categories, webhooks are restricted to the workspace of ctx.
+
+const webhookColumns = "webhook_id, url, events, active, created_at"
+
+func (wh *webhook) scan(row rowScanner) error {
+	return row.Scan(&wh.Webhook_ID, &wh.URL, pq.Array(&wh.Events), &wh.Active, &wh.Created_At)
+}
+
+func (wh *webhook) createWebhook(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO webhooks(workspace_id, url, secret, events, active) VALUES ($1, $2, $3, $4, $5) RETURNING webhook_id, created_at",
+		workspaceFrom(ctx).id, wh.URL, wh.Secret, pq.Array(wh.Events), wh.Active,
+	).Scan(&wh.Webhook_ID, &wh.Created_At)
+	return dbError(err)
+}
+
+func (wh *webhook) getWebhook(ctx context.Context, db queryer) error {
+	err := wh.scan(db.QueryRowContext(ctx,
+		"SELECT "+webhookColumns+" FROM webhooks WHERE webhook_id=$1 AND workspace_id=$2",
+		wh.Webhook_ID, workspaceFrom(ctx).id,
+	))
+	if err == sql.ErrNoRows {
+		return errWebhookNotFound
+	}
+	return err
+}
+
+// updateWebhook replaces the settings of the webhook, and its secret if
+// Secret is set.
+func (wh *webhook) updateWebhook(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		`UPDATE webhooks SET url=$1, events=$2, active=$3, secret=COALESCE(NULLIF($4, ''), secret)
+		WHERE webhook_id=$5 AND workspace_id=$6 RETURNING created_at`,
+		wh.URL, pq.Array(wh.Events), wh.Active, wh.Secret, wh.Webhook_ID, workspaceFrom(ctx).id,
+	).Scan(&wh.Created_At)
+	if err == sql.ErrNoRows {
+		return errWebhookNotFound
+	}
+	return dbError(err)
+}
+
+func (wh *webhook) deleteWebhook(ctx context.Context, db queryer) error {
+	res, err := db.ExecContext(ctx,
+		"DELETE FROM webhooks WHERE webhook_id=$1 AND workspace_id=$2",
+		wh.Webhook_ID, workspaceFrom(ctx).id,
+	)
+	return affectedOrNotFound(res, err, errWebhookNotFound)
+}
+
+func getWebhooks(ctx context.Context, db queryer) ([]webhook, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT "+webhookColumns+" FROM webhooks WHERE workspace_id=$1 ORDER BY created_at",
+		workspaceFrom(ctx).id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []webhook{}
+	for rows.Next() {
+		var wh webhook
+		if err := wh.scan(rows); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// enqueueWebhookDeliveries queues a delivery of e for every active webhook
+// of its workspace subscribed to it. Webhooks that already have a delivery
+// of e are skipped, so the outbox can hand e over more than once.
+func enqueueWebhookDeliveries(ctx context.Context, db queryer, e outboxEvent) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO webhook_deliveries(webhook_id, event_id, event_type, payload)
+		SELECT w.webhook_id, $1, $2, $3 FROM webhooks w
+		WHERE w.workspace_id=$4 AND w.active AND (w.events = '{}' OR w.events && $5)
+			AND NOT EXISTS (SELECT 1 FROM webhook_deliveries d WHERE d.webhook_id = w.webhook_id AND d.event_id = $1)`,
+		e.id, e.eventType, string(e.payload), e.workspaceId, pq.Array(eventPatterns(e.eventType)),
+	)
+	return err
+}
+
+// webhookSink hands the events of the outbox to webhookSender.
+type webhookSink struct {
+	db *sql.DB
+}
+
+func (s webhookSink) name() string { return "webhooks" }
+
+func (s webhookSink) publish(ctx context.Context, e outboxEvent) error {
+	return enqueueWebhookDeliveries(ctx, s.db, e)
+}
+
+const deliveryColumns = "d.delivery_id, d.webhook_id, d.event_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt_at, d.last_attempt_at, d.response_status, d.last_error, d.created_at"
+
+func (d *webhookDelivery) scan(row rowScanner) error {
+	var payload []byte
+	var nextAttemptAt, lastAttemptAt sql.NullTime
+	var responseStatus sql.NullInt64
+	err := row.Scan(&d.Delivery_ID, &d.Webhook_ID, &d.Event_ID, &d.Event_Type, &payload, &d.Status, &d.Attempts,
+		&nextAttemptAt, &lastAttemptAt, &responseStatus, &d.Last_Error, &d.Created_At)
+	if err != nil {
+		return err
+	}
+	d.Payload = payload
+	if d.Status == deliveryPending {
+		d.Next_Attempt_At = nullTime(nextAttemptAt)
+	}
+	d.Last_Attempt_At = nullTime(lastAttemptAt)
+	if responseStatus.Valid {
+		status := int(responseStatus.Int64)
+		d.Response_Status = &status
+	}
+	return nil
+}
+
+// getDeliveries lists the newest deliveries of the webhook, only those with
+// status if it is set.
+func (wh *webhook) getDeliveries(ctx context.Context, db queryer, status string, limit int) ([]webhookDelivery, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT `+deliveryColumns+` FROM webhook_deliveries d JOIN webhooks w ON w.webhook_id = d.webhook_id
+		WHERE d.webhook_id=$1 AND w.workspace_id=$2 AND ($3 = '' OR d.status = $3)
+		ORDER BY d.created_at DESC LIMIT $4`,
+		wh.Webhook_ID, workspaceFrom(ctx).id, status, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []webhookDelivery{}
+	for rows.Next() {
+		var d webhookDelivery
+		if err := d.scan(rows); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// redeliver queues the event of the delivery with deliveryId again. The new
+// delivery keeps the event ID, so receivers can tell it is the same event.
+func (wh *webhook) redeliver(ctx context.Context, db queryer, deliveryId string) (webhookDelivery, error) {
+	var d webhookDelivery
+	err := d.scan(db.QueryRowContext(ctx,
+		`INSERT INTO webhook_deliveries AS d (webhook_id, event_id, event_type, payload)
+		SELECT o.webhook_id, o.event_id, o.event_type, o.payload FROM webhook_deliveries o
+		JOIN webhooks w ON w.webhook_id = o.webhook_id
+		WHERE o.delivery_id=$1 AND o.webhook_id=$2 AND w.workspace_id=$3
+		RETURNING `+deliveryColumns,
+		deliveryId, wh.Webhook_ID, workspaceFrom(ctx).id,
+	))
+	if err == sql.ErrNoRows {
+		return d, errDeliveryNotFound
+	}
+	return d, err
+}
+
+// signWebhook returns the X-Webhook-Signature header of body sent at t.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay is how long a delivery waits after its failed attempt number
+// attempts.
+func (c WebhooksConfig) retryDelay(attempts int) time.Duration {
+	return backoff(c.RetryInterval, c.MaxRetryInterval, attempts)
+}
+
+var errPrivateAddress = errors.New("refusing to connect to a private network address")
+
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		networks = append(networks, n)
+	}
+	return networks
+}()
+
+func isPrivateAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// refusePrivateAddresses is a net.Dialer control function. It sees the
+// address after name resolution, so names pointing at internal services are
+// refused as well.
+func refusePrivateAddresses(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateAddress(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// webhookSender sends the queued deliveries, see deliverDue.
+type webhookSender struct {
+	db      *sql.DB
+	cfg     WebhooksConfig
+	client  *http.Client
+	metrics *metrics
+}
+
+func newWebhookSender(db *sql.DB, cfg WebhooksConfig, m *metrics) *webhookSender {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivateNetworks {
+		dialer.Control = refusePrivateAddresses
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// the address check has to see the receiver rather than a proxy
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &webhookSender{
+		db:  db,
+		cfg: cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			// following a redirect would turn the POST into a GET
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		metrics: m,
+	}
+}
+
+// claimedDelivery is a delivery being sent, with what is needed to send it.
+type claimedDelivery struct {
+	id        string
+	eventId   string
+	eventType string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// claim takes up to webhookDeliveryBatch due deliveries and counts the
+// attempt. They are pushed back by a lease while they are sent, so other
+// instances skip them, and a delivery is retried if this instance stops
+// before recording the outcome.
+func (s *webhookSender) claim(ctx context.Context) ([]claimedDelivery, error) {
+	lease := s.cfg.Timeout + time.Minute
+	rows, err := s.db.QueryContext(ctx,
+		`UPDATE webhook_deliveries d SET attempts = d.attempts + 1, last_attempt_at = now(),
+			next_attempt_at = now() + make_interval(secs => $2)
+		FROM webhooks w
+		WHERE w.webhook_id = d.webhook_id AND d.delivery_id IN (
+			SELECT c.delivery_id FROM webhook_deliveries c JOIN webhooks cw ON cw.webhook_id = c.webhook_id
+			WHERE c.status = 'pending' AND c.next_attempt_at <= now() AND cw.active
+			ORDER BY c.next_attempt_at LIMIT $1
+			FOR UPDATE OF c SKIP LOCKED)
+		RETURNING d.delivery_id, d.event_id, d.event_type, d.payload, d.attempts, w.url, w.secret`,
+		webhookDeliveryBatch, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []claimedDelivery
+	for rows.Next() {
+		var d claimedDelivery
+		if err := rows.Scan(&d.id, &d.eventId, &d.eventType, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, d)
+	}
+	return claimed, rows.Err()
+}
+
+// deliverDue sends every due delivery. It can run on several instances at
+// once, each sending different deliveries.
+func (s *webhookSender) deliverDue(ctx context.Context) error {
+	for {
+		claimed, err := s.claim(ctx)
+		if err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		for _, d := range claimed {
+			wg.Add(1)
+			go func(d claimedDelivery) {
+				defer wg.Done()
+				s.deliver(ctx, d)
+			}(d)
+		}
+		wg.Wait()
+
+		if len(claimed) < webhookDeliveryBatch || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// deliver sends d and records the outcome. Failed deliveries are retried
+// until they run out of attempts.
+func (s *webhookSender) deliver(ctx context.Context, d claimedDelivery) {
+	responseStatus, err := s.send(ctx, d)
+	if ctx.Err() != nil {
+		// cut short by shutdown, sent again once the lease expires
+		return
+	}
+
+	status, outcome, lastError := deliverySucceeded, deliverySucceeded, ""
+	var retryIn time.Duration
+	if err != nil {
+		lastError = err.Error()
+		if len(lastError) > maxDeliveryErrorLength {
+			lastError = lastError[:maxDeliveryErrorLength]
+		}
+		status, outcome = deliveryFailed, deliveryFailed
+		if d.attempts < s.cfg.MaxAttempts {
+			status, outcome = deliveryPending, "retrying"
+			retryIn = s.cfg.retryDelay(d.attempts)
+		}
+		loggerFrom(ctx).warn("webhook delivery failed", "delivery_id", d.id, "event_type", d.eventType,
+			"attempt", d.attempts, "retry_in", retryIn.String(), "error", err)
+	}
+	s.metrics.webhookDeliveries.inc(outcome)
+
+	_, err = s.db.ExecContext(ctx,
+		`UPDATE webhook_deliveries SET status=$2, response_status=$3, last_error=$4,
+			next_attempt_at = now() + make_interval(secs => $5)
+		WHERE delivery_id=$1`,
+		d.id, status, sql.NullInt64{Int64: int64(responseStatus), Valid: responseStatus != 0}, lastError, retryIn.Seconds(),
+	)
+	if err != nil {
+		loggerFrom(ctx).error("could not record webhook delivery", "delivery_id", d.id, "error", err)
+	}
+}
+
+// send POSTs the event of d to its webhook and returns the response status.
+// Only 2xx responses count as delivered.
+func (s *webhookSender) send(ctx context.Context, d claimedDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", webhookUserAgent)
+	req.Header.Set(webhookEventHeader, d.eventType)
+	req.Header.Set(webhookIDHeader, d.eventId)
+	req.Header.Set(webhookDeliveryHeader, d.id)
+	req.Header.Set(webhookSignatureHeader, signWebhook(d.secret, time.Now(), d.payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// lets the connection be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func pathWebhookId(req *http.Request) (string, error) {
+	id := mux.Vars(req)["webhook_id"]
+	if !isValidUUID(id) {
+		return "", badRequestError("invalid_webhook_id", "Invalid webhook ID")
+	}
+	return id, nil
+}
+
+func pathDeliveryId(req *http.Request) (string, error) {
+	id := mux.Vars(req)["delivery_id"]
+	if !isValidUUID(id) {
+		return "", badRequestError("invalid_delivery_id", "Invalid delivery ID")
+	}
+	return id, nil
+}
+
+func (a *App) getWebhooks(w http.ResponseWriter, req *http.Request) {
+	webhooks, err := getWebhooks(req.Context(), a.DB)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, webhooks)
+}
+
+// createWebhook subscribes a URL to events of the workspace. The response
+// is the only one including the secret.
+func (a *App) createWebhook(w http.ResponseWriter, req *http.Request) {
+	var in webhookInput
+	if err := decodeJSONBody(w, req, &in); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := in.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+
+	wh := in.webhook()
+	if wh.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+		wh.Secret = secret
+	}
+	if err := wh.createWebhook(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, wh)
+}
+
+func (a *App) getWebhook(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWebhookId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	wh := webhook{Webhook_ID: id}
+	if err := wh.getWebhook(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, wh)
+}
+
+func (a *App) updateWebhook(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWebhookId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	var in webhookInput
+	if err := decodeJSONBody(w, req, &in); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := in.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+
+	wh := in.webhook()
+	wh.Webhook_ID = id
+	if err := wh.updateWebhook(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	wh.Secret = ""
+	respondWithJSON(w, http.StatusOK, wh)
+}
+
+func (a *App) deleteWebhook(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWebhookId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	wh := webhook{Webhook_ID: id}
+	if err := wh.deleteWebhook(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// getWebhookDeliveries is the delivery log of a webhook, newest first. The
+// status and limit query parameters narrow it down.
+func (a *App) getWebhookDeliveries(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWebhookId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	q := req.URL.Query()
+	status := q.Get("status")
+	if status != "" && !containsString(deliveryStatuses, status) {
+		respondWithProblem(w, req, badRequestError("invalid_status", "Status must be one of: "+strings.Join(deliveryStatuses, ", ")))
+		return
+	}
+	limit := defaultDeliveriesLimit
+	if l := q.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxDeliveriesLimit {
+			respondWithProblem(w, req, badRequestError("invalid_limit", fmt.Sprintf("Limit must be between 1 and %d", maxDeliveriesLimit)))
+			return
+		}
+	}
+
+	ctx := req.Context()
+	wh := webhook{Webhook_ID: id}
+	if err := wh.getWebhook(ctx, a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	deliveries, err := wh.getDeliveries(ctx, a.DB, status, limit)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// redeliverWebhookDelivery sends the event of a delivery again, whatever
+// the outcome of the delivery was.
+func (a *App) redeliverWebhookDelivery(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWebhookId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	deliveryId, err := pathDeliveryId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	wh := webhook{Webhook_ID: id}
+	d, err := wh.redeliver(req.Context(), a.DB, deliveryId)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, d)
+}
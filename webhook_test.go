@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matthi01/scheduler/client"
+)
+
+const testWebhookSecret = "whsec_test-secret-for-deliveries"
+
+// webhookReceiver records the deliveries it receives. It answers with status,
+// 200 unless changed.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	events   []*client.WebhookEvent
+	eventIds []string
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	r := &webhookReceiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		e, err := client.ParseWebhook(req, testWebhookSecret)
+		if err != nil {
+			t.Errorf("Expected a verifiable delivery. Got %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.events = append(r.events, e)
+		r.eventIds = append(r.eventIds, req.Header.Get(webhookIDHeader))
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+// types lists the types of the events received, sorted since deliveries are
+// sent concurrently.
+func (r *webhookReceiver) types() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := []string{}
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// useWebhookSender lets deliveries reach test receivers on the loopback
+// interface and makes them fail after maxAttempts.
+func useWebhookSender(t *testing.T, maxAttempts int) {
+	previous := a.webhooks
+	cfg := a.Config.Webhooks
+	cfg.AllowPrivateNetworks = true
+	cfg.MaxAttempts = maxAttempts
+	a.webhooks = newWebhookSender(a.DB, cfg, a.metrics)
+	t.Cleanup(func() { a.webhooks = previous })
+}
+
+func addWebhook(t *testing.T, url string, events ...string) string {
+	wh := webhookInput{URL: url, Events: events, Secret: testWebhookSecret}.webhook()
+	if err := wh.createWebhook(context.Background(), a.DB); err != nil {
+		t.Fatal(err)
+	}
+	return wh.Webhook_ID
+}
+
+// deliverDue hands the events of the outbox to the webhooks and sends the
+// due deliveries.
+func deliverDue(t *testing.T) {
+	relayDue(t)
+	if err := a.webhooks.deliverDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	clearTables()
+	useWebhookSender(t, 3)
+	receiver := newWebhookReceiver(t)
+	key := addAPIKey("", scopeWebhooksRead, scopeWebhooksWrite)
+	categoryId := addCategory()
+
+	req, _ := http.NewRequest("POST", "/webhooks", bytes.NewBufferString(`{"url":"`+receiver.URL+`","events":["task.*"],"secret":"`+testWebhookSecret+`"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var wh webhook
+	json.Unmarshal(response.Body.Bytes(), &wh)
+
+	req, _ = http.NewRequest("POST", "/category/"+categoryId+"/task", bytes.NewBufferString(`{"task":"Ship it"}`))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var tsk task
+	json.Unmarshal(response.Body.Bytes(), &tsk)
+
+	req, _ = http.NewRequest("PUT", "/category/"+categoryId, bytes.NewBufferString(`{"name":"Renamed","description":""}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", "/category/"+categoryId+"/task/"+strconv.Itoa(tsk.Task_ID), bytes.NewBufferString(`{"task":"Ship it","complete":true}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	deliverDue(t)
+
+	expected := []string{eventTaskCompleted, eventTaskCreated, eventTaskUpdated}
+	if got := receiver.types(); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected the task events %v. Got %v", expected, got)
+	}
+	for _, e := range receiver.events {
+		var data task
+		json.Unmarshal(e.Data, &data)
+		if e.Workspace_ID != defaultWorkspaceId || data.Task_ID != tsk.Task_ID {
+			t.Errorf("Expected an event about task %v in the default workspace. Got %+v", tsk.Task_ID, e)
+		}
+		if e.Type == eventTaskCompleted && !data.Complete {
+			t.Errorf("Expected the completed task in the task.completed event. Got %s", e.Data)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/webhooks/"+wh.Webhook_ID+"/deliveries?status=succeeded", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var deliveries []webhookDelivery
+	json.Unmarshal(response.Body.Bytes(), &deliveries)
+	if len(deliveries) != 3 || deliveries[0].Attempts != 1 || deliveries[0].Response_Status == nil || *deliveries[0].Response_Status != http.StatusOK {
+		t.Errorf("Expected 3 deliveries that succeeded at the first attempt. Got %+v", deliveries)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	clearTables()
+	useWebhookSender(t, 2)
+	receiver := newWebhookReceiver(t)
+	receiver.setStatus(http.StatusInternalServerError)
+	key := addAPIKey("", scopeWebhooksRead, scopeWebhooksWrite)
+	webhookId := addWebhook(t, receiver.URL, eventCategoryDeleted)
+	categoryId := addCategory()
+
+	req, _ := http.NewRequest("DELETE", "/category/"+categoryId, nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	deliverDue(t)
+	// not due again until the retry interval has passed
+	deliverDue(t)
+
+	var d webhookDelivery
+	err := d.scan(a.DB.QueryRow("SELECT " + deliveryColumns + " FROM webhook_deliveries d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != deliveryPending || d.Attempts != 1 || d.Next_Attempt_At == nil || !d.Next_Attempt_At.After(time.Now()) {
+		t.Errorf("Expected a pending delivery to be retried later. Got %+v", d)
+	}
+
+	a.DB.Exec("UPDATE webhook_deliveries SET next_attempt_at = now()")
+	deliverDue(t)
+	d.scan(a.DB.QueryRow("SELECT " + deliveryColumns + " FROM webhook_deliveries d"))
+	if d.Status != deliveryFailed || d.Attempts != 2 || !strings.Contains(d.Last_Error, "500") {
+		t.Errorf("Expected the delivery to fail after 2 attempts. Got %+v", d)
+	}
+
+	receiver.setStatus(http.StatusNoContent)
+	req, _ = http.NewRequest("POST", "/webhooks/"+webhookId+"/deliveries/"+d.Delivery_ID+":redeliver", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var redelivery webhookDelivery
+	json.Unmarshal(response.Body.Bytes(), &redelivery)
+	if redelivery.Event_ID != d.Event_ID || redelivery.Status != deliveryPending {
+		t.Errorf("Expected a pending delivery of event %v. Got %+v", d.Event_ID, redelivery)
+	}
+
+	deliverDue(t)
+	if len(receiver.eventIds) != 3 || receiver.eventIds[2] != d.Event_ID {
+		t.Errorf("Expected event %v to be sent 3 times. Got %v", d.Event_ID, receiver.eventIds)
+	}
+	var status string
+	a.DB.QueryRow("SELECT status FROM webhook_deliveries WHERE delivery_id=$1", redelivery.Delivery_ID).Scan(&status)
+	if status != deliverySucceeded {
+		t.Errorf("Expected the redelivery to succeed. Got %v", status)
+	}
+}
+
+func TestWebhookEventFilter(t *testing.T) {
+	clearTables()
+	addWebhook(t, "https://example.com/hook", eventCategoryCreated)
+	inactive := webhookInput{URL: "https://example.com/paused", Active: new(bool)}.webhook()
+	inactive.Secret = testWebhookSecret
+	inactive.createWebhook(context.Background(), a.DB)
+	elsewhere := addWorkspaceAPIKey(t, addWorkspace(t, "Elsewhere"), scopeCategoriesWrite, scopeTasksWrite)
+
+	for _, key := range []string{"", elsewhere} {
+		req, _ := http.NewRequest("POST", "/category", bytes.NewBufferString(`{"name":"Watched","description":""}`))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+		var c category
+		json.Unmarshal(response.Body.Bytes(), &c)
+
+		req, _ = http.NewRequest("POST", "/category/"+c.Category_ID+"/task", bytes.NewBufferString(`{"task":"Unwatched"}`))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+	}
+
+	var count int
+	a.DB.QueryRow("SELECT count(*) FROM webhook_deliveries").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected a single delivery of category.created in the default workspace. Got %v", count)
+	}
+}
+
+func TestRolledBackBatchPublishesNothing(t *testing.T) {
+	clearTables()
+	addWebhook(t, "https://example.com/hook")
+	categoryId := addCategory()
+
+	req, _ := http.NewRequest("POST", "/category/"+categoryId+"/tasks:batch",
+		bytes.NewBufferString(`{"operations":[{"op":"create","task":"Never"},{"op":"delete","task_id":999}]}`))
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	deliverDue(t)
+	var count int
+	a.DB.QueryRow("SELECT count(*) FROM webhook_deliveries").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected no deliveries for a rolled back batch. Got %v", count)
+	}
+}
+
+func TestWebhooksRequireWorkspaceAdmin(t *testing.T) {
+	clearTables()
+	_, session := addSession(t, "member@example.com")
+
+	req, _ := http.NewRequest("GET", "/webhooks", nil)
+	req.AddCookie(session)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "insufficient_role" {
+		t.Errorf("Expected code 'insufficient_role'. Got '%v'", p.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/workspaces", bytes.NewBufferString(`{"name":"Mine"}`))
+	req.AddCookie(session)
+	response = executeRequest(req)
+	var ws workspace
+	json.Unmarshal(response.Body.Bytes(), &ws)
+
+	req, _ = http.NewRequest("POST", "/webhooks", bytes.NewBufferString(`{"url":"ftp://example.com","events":["task.exploded"]}`))
+	req.Header.Set(workspaceHeader, ws.Workspace_ID)
+	req.AddCookie(session)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if len(p.Fields) != 2 {
+		t.Errorf("Expected errors for url and events. Got %+v", p.Fields)
+	}
+
+	req, _ = http.NewRequest("POST", "/webhooks", bytes.NewBufferString(`{"url":"https://example.com/hook"}`))
+	req.Header.Set(workspaceHeader, ws.Workspace_ID)
+	req.AddCookie(session)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var wh webhook
+	json.Unmarshal(response.Body.Bytes(), &wh)
+	if !strings.HasPrefix(wh.Secret, webhookSecretTag+"_") || !wh.Active {
+		t.Errorf("Expected an active webhook with a generated secret. Got %+v", wh)
+	}
+
+	req, _ = http.NewRequest("GET", "/webhooks/"+wh.Webhook_ID, nil)
+	req.Header.Set(workspaceHeader, ws.Workspace_ID)
+	req.AddCookie(session)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if strings.Contains(response.Body.String(), "secret") {
+		t.Errorf("Expected the secret to be returned only on creation. Got %s", response.Body.String())
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"type":"task.created"}`)
+	header := signWebhook(testWebhookSecret, time.Now(), body)
+	if err := client.VerifyWebhookSignature(testWebhookSecret, header, body, time.Minute); err != nil {
+		t.Errorf("Expected a valid signature. Got %v", err)
+	}
+	if err := client.VerifyWebhookSignature(testWebhookSecret, header, []byte(`{"type":"task.deleted"}`), time.Minute); err != client.ErrInvalidWebhookSignature {
+		t.Errorf("Expected a changed body to be rejected. Got %v", err)
+	}
+	old := signWebhook(testWebhookSecret, time.Now().Add(-time.Hour), body)
+	if err := client.VerifyWebhookSignature(testWebhookSecret, old, body, time.Minute); err != client.ErrWebhookTooOld {
+		t.Errorf("Expected an old delivery to be rejected. Got %v", err)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	cfg := WebhooksConfig{RetryInterval: time.Minute, MaxRetryInterval: time.Hour}
+	for attempts, base := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 20: time.Hour} {
+		if d := cfg.retryDelay(attempts); d < base || d > base+base/10 {
+			t.Errorf("Expected a delay between %v and %v after %d attempts. Got %v", base, base+base/10, attempts, d)
+		}
+	}
+}
+
+func TestWebhooksRefusePrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected no request to reach a loopback address")
+	}))
+	defer srv.Close()
+
+	s := newWebhookSender(nil, defaultConfig().Webhooks, newMetrics())
+	_, err := s.send(context.Background(), claimedDelivery{url: srv.URL, payload: []byte("{}")})
+	if !errors.Is(err, errPrivateAddress) {
+		t.Errorf("Expected %v. Got %v", errPrivateAddress, err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	mathrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// workerGroup runs the background jobs of the server and stops them together.
+type workerGroup struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	running map[string]bool
+}
+
+// start runs fn in its own goroutine until the group is stopped. fn must
+// return once its context is cancelled.
+func (g *workerGroup) start(name string, fn func(ctx context.Context)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ctx == nil {
+		g.ctx, g.cancel = context.WithCancel(context.Background())
+		g.running = map[string]bool{}
+	}
+
+	g.running[name] = true
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer func() {
+			g.mu.Lock()
+			g.running[name] = false
+			g.mu.Unlock()
+		}()
+		fn(withLogger(g.ctx, rootLogger.with("worker", name)))
+	}()
+}
+
+// stop cancels every worker and waits for them to return or ctx to expire.
+func (g *workerGroup) stop(ctx context.Context) error {
+	g.mu.Lock()
+	if g.cancel != nil {
+		g.cancel()
+	}
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// status reports for every started worker whether it is still running.
+func (g *workerGroup) status() map[string]bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	status := map[string]bool{}
+	for name, running := range g.running {
+		status[name] = running
+	}
+	return status
+}
+
+func (g *workerGroup) names() []string {
+	status := g.status()
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// every calls fn each interval until ctx is cancelled. Errors are logged and
+// do not stop the loop.
+func every(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := fn(ctx); err != nil && ctx.Err() == nil {
+			loggerFrom(ctx).error("worker run failed", "worker", name, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// backoff is how long to wait after failed attempt number attempts: initial
+// doubled for every earlier attempt, at most max, plus up to a tenth so jobs
+// that failed together are not retried together.
+func backoff(initial, max time.Duration, attempts int) time.Duration {
+	d := initial
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d + time.Duration(mathrand.Int63n(int64(d/10)+1))
+}
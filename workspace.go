@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata" // time zones validate the same on hosts without tzdata
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// everything created before workspaces lives in the default workspace, which
+// every user can access without being a member
+const defaultWorkspaceId = "00000000-0000-0000-0000-000000000000"
+
+// selects the workspace of a request, see selectWorkspace
+const workspaceHeader = "X-Workspace-ID"
+
+// roles a user can have in a workspace. Admins manage the workspace and its
+// members and own all of its categories.
+const (
+	workspaceRoleMember = "member"
+	workspaceRoleAdmin  = "admin"
+)
+
+var workspaceRoles = []string{workspaceRoleMember, workspaceRoleAdmin}
+
+type workspace struct {
+	Workspace_ID string `json:"workspace_id"`
+	Name         string `json:"name"`
+	// IANA name such as Europe/Berlin, used where the workspace needs a
+	// calendar
+	Time_Zone  string    `json:"time_zone"`
+	Created_At time.Time `json:"created_at"`
+	// role of the requesting user, empty for other principals
+	Role string `json:"role,omitempty"`
+}
+
+type workspaceMember struct {
+	User_ID    string    `json:"user_id"`
+	Email      string    `json:"email"`
+	Name       string    `json:"name"`
+	Role       string    `json:"role"`
+	Created_At time.Time `json:"created_at"`
+}
+
+type workspaceMemberInput struct {
+	Role string `json:"role"`
+}
+
+var (
+	errWorkspaceNotFound  = notFoundError("workspace_not_found", "Workspace not found")
+	errMemberNotFound     = notFoundError("member_not_found", "Member not found")
+	errDefaultWorkspace   = conflictError("default_workspace", "The default workspace is open to all users and cannot be deleted", nil)
+	errLastWorkspaceAdmin = conflictError("last_admin", "A workspace with admins must keep at least one", nil)
+)
+
+// currentWorkspace is the workspace a request operates in and the role of
+// its user there.
+type currentWorkspace struct {
+	id   string
+	role string
+}
+
+type workspaceKey struct{}
+
+func withWorkspace(ctx context.Context, ws currentWorkspace) context.Context {
+	return context.WithValue(ctx, workspaceKey{}, ws)
+}
+
+// workspaceFrom returns the workspace of the request, the default one if
+// selectWorkspace has not run as for commands.
+func workspaceFrom(ctx context.Context) currentWorkspace {
+	if ws, ok := ctx.Value(workspaceKey{}).(currentWorkspace); ok {
+		return ws
+	}
+	return currentWorkspace{id: defaultWorkspaceId}
+}
+
+func workspaceRoleRank(role string) int {
+	for i, r := range workspaceRoles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// parseWorkspaceId accepts any UUID spelling and returns the canonical one.
+func parseWorkspaceId(id string) (string, error) {
+	u, err := uuid.Parse(id)
+	if err != nil {
+		return "", badRequestError("invalid_workspace_id", "Invalid workspace ID")
+	}
+	return u.String(), nil
+}
+
+func pathWorkspaceId(req *http.Request) (string, error) {
+	return parseWorkspaceId(mux.Vars(req)["workspace_id"])
+}
+
+// accessWorkspace checks that p may use the workspace. API keys bound to a
+// workspace cannot use any other, and users only the ones they are members
+// of. Anonymous requests and service keys have no memberships, so they are
+// limited to the workspace of their key or the default workspace. All get
+// errWorkspaceNotFound otherwise, so workspace IDs do not leak.
+func accessWorkspace(ctx context.Context, db queryer, p *principal, id string) (currentWorkspace, error) {
+	ws := currentWorkspace{id: id}
+	if p.workspaceId != "" && p.workspaceId != id {
+		return ws, errWorkspaceNotFound
+	}
+	if p.userId == "" && p.workspaceId == "" && id != defaultWorkspaceId {
+		return ws, errWorkspaceNotFound
+	}
+	if id == defaultWorkspaceId {
+		if p.userId != "" {
+			ws.role = workspaceRoleMember
+		}
+		return ws, nil
+	}
+
+	var role sql.NullString
+	err := db.QueryRowContext(ctx,
+		`SELECT m.role FROM workspaces w
+		LEFT JOIN workspace_members m ON m.workspace_id = w.workspace_id AND m.user_id = $2
+		WHERE w.workspace_id=$1`,
+		id, sql.NullString{String: p.userId, Valid: p.userId != ""},
+	).Scan(&role)
+	if err == sql.ErrNoRows || (err == nil && p.userId != "" && !role.Valid) {
+		return ws, errWorkspaceNotFound
+	}
+	ws.role = role.String
+	return ws, err
+}
+
+// selectWorkspace puts the workspace named by the X-Workspace-ID header in
+// the context. Without the header requests use the workspace their API key
+// is bound to, or the default workspace.
+func (a *App) selectWorkspace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := principalFrom(req.Context())
+		id := req.Header.Get(workspaceHeader)
+		if id == "" {
+			id = p.workspaceId
+		}
+		if id == "" {
+			id = defaultWorkspaceId
+		}
+		id, err := parseWorkspaceId(id)
+		if err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+
+		ws, err := accessWorkspace(req.Context(), a.DB, p, id)
+		if err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(withWorkspace(req.Context(), ws)))
+	})
+}
+
+// requireWorkspaceRole only lets requests through whose user has at least
+// role in the workspace in the path. Other principals are governed by their
+// scopes, like for category roles.
+func (a *App) requireWorkspaceRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, err := pathWorkspaceId(req)
+		if err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+		p := principalFrom(req.Context())
+		ws, err := accessWorkspace(req.Context(), a.DB, p, id)
+		if err != nil {
+			respondWithProblem(w, req, err)
+			return
+		}
+		if p.userId != "" && workspaceRoleRank(ws.role) < workspaceRoleRank(role) {
+			respondWithProblem(w, req, forbiddenError("insufficient_role", fmt.Sprintf("Requires the %s role in the workspace", role)))
+			return
+		}
+		next(w, req)
+	}
+}
+
+// requireCurrentWorkspaceRole is requireWorkspaceRole for the workspace the
+// request operates in, as chosen by selectWorkspace.
+func requireCurrentWorkspaceRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		if principalFrom(ctx).userId != "" && workspaceRoleRank(workspaceFrom(ctx).role) < workspaceRoleRank(role) {
+			respondWithProblem(w, req, forbiddenError("insufficient_role", fmt.Sprintf("Requires the %s role in the workspace", role)))
+			return
+		}
+		next(w, req)
+	}
+}
+
+func (ws *workspace) validate() validationErrors {
+	var errs validationErrors
+	errs.required("name", ws.Name)
+	errs.maxLength("name", ws.Name, 255)
+	if _, err := time.LoadLocation(ws.Time_Zone); err != nil || ws.Time_Zone == "" || ws.Time_Zone == "Local" {
+		errs.add("time_zone", "must be an IANA time zone such as Europe/Berlin")
+	}
+	return errs
+}
+
+func (in workspaceMemberInput) validate() validationErrors {
+	var errs validationErrors
+	errs.oneOf("role", in.Role, workspaceRoles)
+	return errs
+}
+
+const workspaceColumns = "workspace_id, name, time_zone, created_at"
+
+func (ws *workspace) createWorkspace(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO workspaces(name, time_zone) VALUES ($1, $2) RETURNING workspace_id, created_at",
+		ws.Name, ws.Time_Zone,
+	).Scan(&ws.Workspace_ID, &ws.Created_At)
+	return dbError(err)
+}
+
+func (ws *workspace) getWorkspace(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		"SELECT "+workspaceColumns+" FROM workspaces WHERE workspace_id=$1",
+		ws.Workspace_ID,
+	).Scan(&ws.Workspace_ID, &ws.Name, &ws.Time_Zone, &ws.Created_At)
+	if err == sql.ErrNoRows {
+		return errWorkspaceNotFound
+	}
+	return err
+}
+
+func (ws *workspace) updateWorkspace(ctx context.Context, db queryer) error {
+	err := db.QueryRowContext(ctx,
+		"UPDATE workspaces SET name=$1, time_zone=$2 WHERE workspace_id=$3 RETURNING created_at",
+		ws.Name, ws.Time_Zone, ws.Workspace_ID,
+	).Scan(&ws.Created_At)
+	if err == sql.ErrNoRows {
+		return errWorkspaceNotFound
+	}
+	return dbError(err)
+}
+
+// deleteWorkspace deletes the workspace with its categories, tasks and
+// members. It should run in a transaction.
+func (ws *workspace) deleteWorkspace(ctx context.Context, db queryer) error {
+	if ws.Workspace_ID == defaultWorkspaceId {
+		return errDefaultWorkspace
+	}
+	_, err := db.ExecContext(ctx,
+		"DELETE FROM tasks WHERE category_id IN (SELECT category_id FROM categories WHERE workspace_id=$1)",
+		ws.Workspace_ID,
+	)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, "DELETE FROM workspaces WHERE workspace_id=$1", ws.Workspace_ID)
+	return affectedOrNotFound(res, err, errWorkspaceNotFound)
+}
+
+// getWorkspacesOf lists the workspaces userId can access with their role.
+func getWorkspacesOf(ctx context.Context, db queryer, userId string) ([]workspace, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT w.workspace_id, w.name, w.time_zone, w.created_at, COALESCE(m.role, $2) FROM workspaces w
+		LEFT JOIN workspace_members m ON m.workspace_id = w.workspace_id AND m.user_id = $1
+		WHERE m.user_id IS NOT NULL OR w.workspace_id = $3
+		ORDER BY w.created_at`,
+		userId, workspaceRoleMember, defaultWorkspaceId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanWorkspaces(rows)
+}
+
+func scanWorkspaces(rows *sql.Rows) ([]workspace, error) {
+	defer rows.Close()
+
+	workspaces := []workspace{}
+	for rows.Next() {
+		var ws workspace
+		if err := rows.Scan(&ws.Workspace_ID, &ws.Name, &ws.Time_Zone, &ws.Created_At, &ws.Role); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, rows.Err()
+}
+
+func (ws *workspace) getMembers(ctx context.Context, db queryer) ([]workspaceMember, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT u.user_id, u.email, u.name, m.role, m.created_at FROM workspace_members m
+		JOIN users u ON u.user_id = m.user_id WHERE m.workspace_id=$1 ORDER BY u.email`,
+		ws.Workspace_ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []workspaceMember{}
+	for rows.Next() {
+		var m workspaceMember
+		if err := rows.Scan(&m.User_ID, &m.Email, &m.Name, &m.Role, &m.Created_At); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (ws *workspace) setMember(ctx context.Context, db queryer, m *workspaceMember) error {
+	err := db.QueryRowContext(ctx,
+		`INSERT INTO workspace_members(workspace_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO UPDATE SET role=EXCLUDED.role
+		RETURNING created_at`,
+		ws.Workspace_ID, m.User_ID, m.Role,
+	).Scan(&m.Created_At)
+	return dbError(err)
+}
+
+// removeMember also ends the digests and reminders of the member, which would
+// otherwise keep sending them the tasks of the workspace.
+func (ws *workspace) removeMember(ctx context.Context, db queryer, userId string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM workspace_members WHERE workspace_id=$1 AND user_id=$2", ws.Workspace_ID, userId)
+	if err := affectedOrNotFound(res, err, errMemberNotFound); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "DELETE FROM digest_subscriptions WHERE workspace_id=$1 AND user_id=$2", ws.Workspace_ID, userId)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx,
+		`DELETE FROM reminders WHERE user_id=$2 AND task_id IN
+		(SELECT task_id FROM tasks JOIN categories USING (category_id) WHERE categories.workspace_id=$1)`,
+		ws.Workspace_ID, userId)
+	return err
+}
+
+// changeMembers runs fn in a transaction that fails if it leaves a
+// workspace that had admins without any. Member changes of a workspace are
+// serialized so concurrent demotions cannot both pass.
+func (ws *workspace) changeMembers(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	if ws.Workspace_ID == defaultWorkspaceId {
+		return errDefaultWorkspace
+	}
+	return inTransaction(ctx, db, func(tx *sql.Tx) error {
+		var admins int
+		err := tx.QueryRowContext(ctx,
+			`SELECT (SELECT count(*) FROM workspace_members WHERE workspace_id=$1 AND role=$2)
+			FROM workspaces WHERE workspace_id=$1 FOR UPDATE`,
+			ws.Workspace_ID, workspaceRoleAdmin,
+		).Scan(&admins)
+		if err == sql.ErrNoRows {
+			return errWorkspaceNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		if admins > 0 {
+			err = tx.QueryRowContext(ctx,
+				"SELECT count(*) FROM workspace_members WHERE workspace_id=$1 AND role=$2",
+				ws.Workspace_ID, workspaceRoleAdmin,
+			).Scan(&admins)
+			if err == nil && admins == 0 {
+				return errLastWorkspaceAdmin
+			}
+		}
+		return err
+	})
+}
+
+// getWorkspaces lists the workspaces the principal can access.
+func (a *App) getWorkspaces(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	p := principalFrom(ctx)
+
+	var workspaces []workspace
+	var err error
+	if p.userId != "" && p.workspaceId == "" {
+		workspaces, err = getWorkspacesOf(ctx, a.DB, p.userId)
+	} else {
+		// everyone else has a single workspace, see accessWorkspace
+		ws := workspace{Workspace_ID: workspaceFrom(ctx).id}
+		err = ws.getWorkspace(ctx, a.DB)
+		workspaces = []workspace{ws}
+	}
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, workspaces)
+}
+
+// createWorkspace creates a workspace. Users become its first admin.
+func (a *App) createWorkspace(w http.ResponseWriter, req *http.Request) {
+	var ws workspace
+	if err := decodeJSONBody(w, req, &ws); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if ws.Time_Zone == "" {
+		ws.Time_Zone = "UTC"
+	}
+	if errs := ws.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+
+	ws.Role = ""
+
+	ctx := req.Context()
+	p := principalFrom(ctx)
+	err := inTransaction(ctx, a.DB, func(tx *sql.Tx) error {
+		if err := ws.createWorkspace(ctx, tx); err != nil {
+			return err
+		}
+		if p.userId == "" {
+			return nil
+		}
+		ws.Role = workspaceRoleAdmin
+		return ws.setMember(ctx, tx, &workspaceMember{User_ID: p.userId, Role: workspaceRoleAdmin})
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, ws)
+}
+
+func (a *App) getWorkspace(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWorkspaceId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	ws := workspace{Workspace_ID: id}
+	if err := ws.getWorkspace(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, ws)
+}
+
+// updateWorkspace replaces the settings of the workspace.
+func (a *App) updateWorkspace(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWorkspaceId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	var ws workspace
+	if err := decodeJSONBody(w, req, &ws); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if ws.Time_Zone == "" {
+		ws.Time_Zone = "UTC"
+	}
+	if errs := ws.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+	ws.Workspace_ID = id
+	ws.Role = ""
+
+	if err := ws.updateWorkspace(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, ws)
+}
+
+func (a *App) deleteWorkspace(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWorkspaceId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	ctx := req.Context()
+	ws := workspace{Workspace_ID: id}
+	err = inTransaction(ctx, a.DB, func(tx *sql.Tx) error {
+		return ws.deleteWorkspace(ctx, tx)
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getWorkspaceMembers(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWorkspaceId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	ws := workspace{Workspace_ID: id}
+	if err := ws.getWorkspace(req.Context(), a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	members, err := ws.getMembers(req.Context(), a.DB)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, members)
+}
+
+// setWorkspaceMember adds a user to the workspace or changes their role.
+func (a *App) setWorkspaceMember(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWorkspaceId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	userId, err := pathUserId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	var in workspaceMemberInput
+	if err := decodeJSONBody(w, req, &in); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	if errs := in.validate(); len(errs) > 0 {
+		respondWithProblem(w, req, validationError(errs))
+		return
+	}
+
+	ctx := req.Context()
+	u := user{User_ID: userId}
+	if err := u.getUser(ctx, a.DB); err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	m := workspaceMember{User_ID: u.User_ID, Email: u.Email, Name: u.Name, Role: in.Role}
+	ws := workspace{Workspace_ID: id}
+	err = ws.changeMembers(ctx, a.DB, func(tx *sql.Tx) error {
+		return ws.setMember(ctx, tx, &m)
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, m)
+}
+
+func (a *App) removeWorkspaceMember(w http.ResponseWriter, req *http.Request) {
+	id, err := pathWorkspaceId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	userId, err := pathUserId(req)
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+
+	ctx := req.Context()
+	ws := workspace{Workspace_ID: id}
+	err = ws.changeMembers(ctx, a.DB, func(tx *sql.Tx) error {
+		return ws.removeMember(ctx, tx, userId)
+	})
+	if err != nil {
+		respondWithProblem(w, req, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
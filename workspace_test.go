@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func addWorkspace(t *testing.T, name string) string {
+	ws := workspace{Name: name, Time_Zone: "Europe/Berlin"}
+	if err := ws.createWorkspace(context.Background(), a.DB); err != nil {
+		t.Fatal(err)
+	}
+	return ws.Workspace_ID
+}
+
+// addWorkspaceAPIKey creates a service key bound to the workspace.
+func addWorkspaceAPIKey(t *testing.T, workspaceId string, scopes ...string) string {
+	k, _ := newAPIKey(apiKeyInput{Name: "Workspace key", Workspace_ID: workspaceId, Scopes: scopes})
+	if err := k.createAPIKey(context.Background(), a.DB); err != nil {
+		t.Fatal(err)
+	}
+	return k.Key
+}
+
+func TestWorkspaceIsolation(t *testing.T) {
+	clearTables()
+	workspaceId := addWorkspace(t, "Team A")
+	defaultCategoryId := addCategory()
+	bound := addWorkspaceAPIKey(t, workspaceId, scopeCategoriesRead, scopeCategoriesWrite, scopeTasksRead, scopeTasksWrite)
+	service := addAPIKey("", scopeCategoriesRead, scopeCategoriesWrite, scopeTasksRead, scopeTasksWrite)
+
+	req, _ := http.NewRequest("POST", "/category", bytes.NewBufferString(`{"name":"Team A only","description":""}`))
+	req.Header.Set("Authorization", "Bearer "+bound)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var c category
+	json.Unmarshal(response.Body.Bytes(), &c)
+
+	req, _ = http.NewRequest("POST", "/category/"+c.Category_ID+"/task", bytes.NewBufferString(`{"task":"Plan"}`))
+	req.Header.Set("Authorization", "Bearer "+bound)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var tsk task
+	json.Unmarshal(response.Body.Bytes(), &tsk)
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	response = executeRequest(req)
+	var categories []category
+	json.Unmarshal(response.Body.Bytes(), &categories)
+	if len(categories) != 1 || categories[0].Category_ID != defaultCategoryId {
+		t.Errorf("Expected only the category of the default workspace. Got %+v", categories)
+	}
+
+	for _, url := range []string{"/category/" + c.Category_ID, "/category/" + c.Category_ID + "/task/" + strconv.Itoa(tsk.Task_ID)} {
+		req, _ = http.NewRequest("GET", url, nil)
+		checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+		req, _ = http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+bound)
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+
+	// anonymous requests and service keys cannot pick another workspace
+	for _, key := range []string{"", service} {
+		for _, method := range []string{"GET", "DELETE"} {
+			req, _ = http.NewRequest(method, "/category/"+c.Category_ID, nil)
+			req.Header.Set(workspaceHeader, workspaceId)
+			if key != "" {
+				req.Header.Set("Authorization", "Bearer "+key)
+			}
+			response = executeRequest(req)
+			checkResponseCode(t, http.StatusNotFound, response.Code)
+			var p problem
+			json.Unmarshal(response.Body.Bytes(), &p)
+			if p.Code != "workspace_not_found" {
+				t.Errorf("Expected code 'workspace_not_found'. Got '%v'", p.Code)
+			}
+		}
+	}
+
+	req, _ = http.NewRequest("DELETE", "/category/"+defaultCategoryId, nil)
+	req.Header.Set("Authorization", "Bearer "+bound)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.Header.Set(workspaceHeader, "not-a-workspace")
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+}
+
+func TestWorkspaceMembership(t *testing.T) {
+	clearTables()
+	useAnonymousScopes(t)
+	adminId, admin := addSession(t, "admin@example.com")
+	memberId, member := addSession(t, "member@example.com")
+
+	req, _ := http.NewRequest("POST", "/workspaces", bytes.NewBufferString(`{"name":"Team B","time_zone":"America/New_York"}`))
+	req.AddCookie(admin)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var ws workspace
+	json.Unmarshal(response.Body.Bytes(), &ws)
+	if ws.Role != workspaceRoleAdmin || ws.Time_Zone != "America/New_York" {
+		t.Errorf("Expected the creator to be admin of a workspace in New York time. Got %+v", ws)
+	}
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.Header.Set(workspaceHeader, ws.Workspace_ID)
+	req.AddCookie(member)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+	var p problem
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "workspace_not_found" {
+		t.Errorf("Expected code 'workspace_not_found'. Got '%v'", p.Code)
+	}
+
+	req, _ = http.NewRequest("PUT", "/workspaces/"+ws.Workspace_ID+"/members/"+memberId, bytes.NewBufferString(`{"role":"member"}`))
+	req.AddCookie(admin)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("POST", "/category", bytes.NewBufferString(`{"name":"Mine","description":""}`))
+	req.Header.Set(workspaceHeader, ws.Workspace_ID)
+	req.AddCookie(member)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var c category
+	json.Unmarshal(response.Body.Bytes(), &c)
+
+	// admins own every category of their workspace
+	req, _ = http.NewRequest("DELETE", "/category/"+c.Category_ID, nil)
+	req.Header.Set(workspaceHeader, ws.Workspace_ID)
+	req.AddCookie(admin)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", "/workspaces/"+ws.Workspace_ID, bytes.NewBufferString(`{"name":"Taken over"}`))
+	req.AddCookie(member)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/workspaces", nil)
+	req.AddCookie(member)
+	response = executeRequest(req)
+	var workspaces []workspace
+	json.Unmarshal(response.Body.Bytes(), &workspaces)
+	if len(workspaces) != 2 || workspaces[0].Workspace_ID != defaultWorkspaceId || workspaces[1].Role != workspaceRoleMember {
+		t.Errorf("Expected the default workspace and Team B as member. Got %+v", workspaces)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/workspaces/"+ws.Workspace_ID+"/members/"+adminId, nil)
+	req.AddCookie(admin)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &p)
+	if p.Code != "last_admin" {
+		t.Errorf("Expected code 'last_admin'. Got '%v'", p.Code)
+	}
+
+	// reminders of the member in other workspaces survive the removal
+	var teamCategoryId string
+	a.DB.QueryRow("INSERT INTO categories(name, description, workspace_id) VALUES('Team', '', $1) RETURNING category_id", ws.Workspace_ID).Scan(&teamCategoryId)
+	for _, taskId := range []int{addTaskToCategory(teamCategoryId), addTaskToCategory(addCategory())} {
+		a.DB.Exec("INSERT INTO reminders(task_id, user_id, before_due_seconds, channels) VALUES($1, $2, 60, '{inbox}')", taskId, memberId)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/workspaces/"+ws.Workspace_ID+"/members/"+memberId, nil)
+	req.AddCookie(admin)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	var reminders int
+	a.DB.QueryRow("SELECT count(*) FROM reminders WHERE user_id=$1", memberId).Scan(&reminders)
+	if reminders != 1 {
+		t.Errorf("Expected only the reminder outside Team B to be kept. Got %v reminders", reminders)
+	}
+
+	req, _ = http.NewRequest("GET", "/workspaces/"+ws.Workspace_ID, nil)
+	req.AddCookie(member)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+func TestWorkspaceBoundAPIKey(t *testing.T) {
+	clearTables()
+	workspaceId := addWorkspace(t, "Team C")
+	addCategory()
+	key := addWorkspaceAPIKey(t, workspaceId, scopeCategoriesRead, scopeWorkspacesRead)
+
+	req, _ := http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if strings.TrimSpace(response.Body.String()) != "[]" {
+		t.Errorf("Expected the key to use its own workspace. Got %s", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/categories", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set(workspaceHeader, defaultWorkspaceId)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("GET", "/workspaces/"+defaultWorkspaceId, nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	checkResponseCode(t, http.StatusNotFound, executeRequest(req).Code)
+}
+
+func TestUpdateWorkspace(t *testing.T) {
+	clearTables()
+	workspaceId := addWorkspace(t, "Team D")
+	key := addWorkspaceAPIKey(t, workspaceId, scopeWorkspacesWrite)
+
+	req, _ := http.NewRequest("PUT", "/workspaces/"+workspaceId, bytes.NewBufferString(`{"name":"Team D","time_zone":"Mars/Olympus_Mons"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	checkResponseCode(t, http.StatusUnprocessableEntity, executeRequest(req).Code)
+
+	req, _ = http.NewRequest("PUT", "/workspaces/"+workspaceId, bytes.NewBufferString(`{"name":"Team D","time_zone":"Asia/Tokyo"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var ws workspace
+	json.Unmarshal(response.Body.Bytes(), &ws)
+	if ws.Time_Zone != "Asia/Tokyo" {
+		t.Errorf("Expected time zone 'Asia/Tokyo'. Got '%v'", ws.Time_Zone)
+	}
+}
+
+func TestDeleteWorkspace(t *testing.T) {
+	clearTables()
+	workspaceId := addWorkspace(t, "Team E")
+	key := addWorkspaceAPIKey(t, workspaceId, scopeWorkspacesWrite)
+	ctx := withWorkspace(context.Background(), currentWorkspace{id: workspaceId})
+	c := category{Name: "Doomed"}
+	c.createCategory(ctx, a.DB)
+	(&task{Category_ID: c.Category_ID, Task: "Doomed too"}).createTask(ctx, a.DB)
+
+	req, _ := http.NewRequest("DELETE", "/workspaces/"+workspaceId, nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	var count int
+	a.DB.QueryRow("SELECT count(*) FROM tasks WHERE category_id=$1", c.Category_ID).Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected the tasks of the workspace to be deleted")
+	}
+
+	req, _ = http.NewRequest("DELETE", "/workspaces/"+defaultWorkspaceId, nil)
+	req.Header.Set("Authorization", "Bearer "+addAPIKey("", scopeWorkspacesWrite))
+	checkResponseCode(t, http.StatusConflict, executeRequest(req).Code)
+}